@@ -0,0 +1,54 @@
+package api
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/fabiolb/fabio/route"
+)
+
+// DryRunHandler builds a routing table from the current service config
+// and proposed manual overrides and returns the differences to the active
+// routing table. The routing table is not changed.
+type DryRunHandler struct {
+	// ServiceConfig returns the current routing config
+	// generated from the registry.
+	ServiceConfig func() string
+}
+
+type dryRun struct {
+	Error string `json:"error,omitempty"`
+	*route.TableDiff
+}
+
+func (h *DryRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Print("[ERROR] ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var svccfg string
+	if h.ServiceConfig != nil {
+		svccfg = h.ServiceConfig()
+	}
+
+	t, err := route.NewTableFrom(nil, svccfg, string(body))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, r, dryRun{Error: err.Error()})
+		return
+	}
+
+	diff := route.Diff(route.GetTable(), t)
+	writeJSON(w, r, dryRun{TableDiff: &diff})
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fabiolb/fabio/route"
+)
+
+// ExplainHandler shows how the routing table selects
+// the route for a request.
+type ExplainHandler struct {
+	// Matcher is the name of the route matcher.
+	Matcher string
+}
+
+type explainRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+func (h *ExplainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var er explainRequest
+	if err := json.NewDecoder(r.Body).Decode(&er); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	u, err := url.Parse(er.URL)
+	if err != nil || u.Host == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	req := &http.Request{
+		Method: er.Method,
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{},
+	}
+	if req.Method == "" {
+		req.Method = "GET"
+	}
+	for k, v := range er.Headers {
+		req.Header.Set(k, v)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		// only used to detect the default port
+		req.TLS = &tls.ConnectionState{}
+	}
+
+	writeJSON(w, r, route.GetTable().Explain(req, h.Matcher))
+}
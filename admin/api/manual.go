@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/fabiolb/fabio/registry"
+	"github.com/fabiolb/fabio/route"
 )
 
 // ManualHandler provides a fetch and update handler for the manual overrides api.
@@ -43,6 +44,11 @@ func (h *ManualHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		defer r.Body.Close()
 
+		if _, err := route.Parse(m.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		ok, err := registry.Default.WriteManual(m.Value, m.Version)
 		if err != nil {
 			log.Print("[ERROR] ", err)
@@ -3,7 +3,6 @@ package api
 import (
 	"fmt"
 	"net/http"
-	"sort"
 	"strings"
 
 	"github.com/fabiolb/fabio/route"
@@ -20,9 +19,12 @@ type apiRoute struct {
 	Opts    string   `json:"opts"`
 	Weight  float64  `json:"weight"`
 	Tags    []string `json:"tags,omitempty"`
+	Prio    int      `json:"prio,omitempty"`
 	Cmd     string   `json:"cmd"`
 	Rate1   float64  `json:"rate1"`
 	Pct99   float64  `json:"pct99"`
+	Active  int      `json:"active,omitempty"`
+	Queued  int      `json:"queued,omitempty"`
 }
 
 func (h *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -34,14 +36,9 @@ func (h *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var hosts []string
-	for host := range t {
-		hosts = append(hosts, host)
-	}
-	sort.Strings(hosts)
-
+	// list the routes in the order in which they are evaluated
 	var routes []apiRoute
-	for _, host := range hosts {
+	for _, host := range t.Hosts() {
 		for _, tr := range t[host] {
 			var opts []string
 			for k, v := range tr.Opts {
@@ -58,10 +55,15 @@ func (h *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					Opts:    strings.Join(opts, " "),
 					Weight:  tg.Weight,
 					Tags:    tg.Tags,
+					Prio:    tr.Prio,
 					Cmd:     "route add",
 					Rate1:   tg.Timer.Rate1(),
 					Pct99:   tg.Timer.Percentile(0.99),
 				}
+				if tg.ConnLimiter != nil {
+					ar.Active = tg.ConnLimiter.Active()
+					ar.Queued = tg.ConnLimiter.Queued()
+				}
 				routes = append(routes, ar)
 			}
 		}
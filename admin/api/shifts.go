@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/fabiolb/fabio/route"
+)
+
+// ShiftsHandler lists the traffic shifts. The shifts are paused and
+// aborted with the state option of the 'route shift' command in the
+// routing table so that the change reaches all instances.
+type ShiftsHandler struct{}
+
+func (h *ShiftsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, route.Shifts.List())
+}
@@ -19,16 +19,21 @@ type Server struct {
 	Version  string
 	Commands string
 	Cfg      *config.Config
+
+	// ServiceConfig returns the current routing config
+	// generated from the registry.
+	ServiceConfig func() string
 }
 
 // ListenAndServe starts the admin server.
 func (s *Server) ListenAndServe(l config.Listen, tlscfg *tls.Config) error {
-	return proxy.ListenAndServeHTTP(l, s.handler(), tlscfg)
+	return proxy.ListenAndServeAdmin(l, s.handler(), tlscfg)
 }
 
 func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 
+	// only endpoints which change state require rw access
 	switch s.Access {
 	case "ro":
 		mux.HandleFunc("/api/manual", forbidden)
@@ -40,6 +45,9 @@ func (s *Server) handler() http.Handler {
 
 	mux.Handle("/api/config", &api.ConfigHandler{s.Cfg})
 	mux.Handle("/api/routes", &api.RoutesHandler{})
+	mux.Handle("/api/routes/dryrun", &api.DryRunHandler{ServiceConfig: s.ServiceConfig})
+	mux.Handle("/api/routes/explain", &api.ExplainHandler{Matcher: s.matcher()})
+	mux.Handle("/api/shifts", &api.ShiftsHandler{})
 	mux.Handle("/api/version", &api.VersionHandler{s.Version})
 	mux.Handle("/routes", &ui.RoutesHandler{Color: s.Color, Title: s.Title, Version: s.Version})
 	mux.HandleFunc("/logo.svg", ui.HandleLogo)
@@ -48,7 +56,21 @@ func (s *Server) handler() http.Handler {
 	return mux
 }
 
+// matcher returns the name of the configured route matcher.
+func (s *Server) matcher() string {
+	if s.Cfg == nil {
+		return ""
+	}
+	return s.Cfg.Proxy.Matcher
+}
+
+// handleHealth reports 503 Service Unavailable during the shutdown
+// so that load balancers stop sending traffic.
 func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if proxy.Draining() {
+		http.Error(w, "DRAINING", http.StatusServiceUnavailable)
+		return
+	}
 	fmt.Fprintln(w, "OK")
 }
 
@@ -1,9 +1,13 @@
 package admin
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/fabiolb/fabio/route"
 )
 
 func TestAdminServerAccess(t *testing.T) {
@@ -37,8 +41,11 @@ func TestAdminServerAccess(t *testing.T) {
 
 	roTests := []test{
 		{"/api/manual", 403},
+		{"/api/routes/explain", 405},
 		{"/api/config", 200},
 		{"/api/routes", 200},
+		{"/api/routes/dryrun", 405},
+		{"/api/shifts", 200},
 		{"/api/version", 200},
 		{"/manual", 403},
 		{"/routes", 200},
@@ -49,8 +56,11 @@ func TestAdminServerAccess(t *testing.T) {
 
 	rwTests := []test{
 		{"/api/manual", 200},
+		{"/api/routes/explain", 405},
 		{"/api/config", 200},
 		{"/api/routes", 200},
+		{"/api/routes/dryrun", 405},
+		{"/api/shifts", 200},
 		{"/api/version", 200},
 		{"/manual", 200},
 		{"/routes", 200},
@@ -62,3 +72,48 @@ func TestAdminServerAccess(t *testing.T) {
 	testAccess("ro", roTests)
 	testAccess("rw", rwTests)
 }
+
+func TestAdminServerDryRun(t *testing.T) {
+	svccfg := "route add svc / http://1.2.3.4/\nroute add svc /foo http://1.2.3.5/"
+	tbl, err := route.NewTable(svccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer route.SetTable(route.GetTable())
+	route.SetTable(tbl)
+
+	srv := &Server{Access: "ro", ServiceConfig: func() string { return svccfg }}
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+
+	post := func(body string) (int, map[string]interface{}) {
+		resp, err := http.Post(ts.URL+"/api/routes/dryrun", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+		defer resp.Body.Close()
+		var v map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+		return resp.StatusCode, v
+	}
+
+	code, v := post("- cmd: route del\n  service: svc\n  src: /foo\n- service: svc\n  src: /\n  dst: http://1.2.3.6/\n")
+	if got, want := code, 200; got != want {
+		t.Fatalf("got code %d want %d", got, want)
+	}
+	for _, k := range []string{"added", "removed", "reweighted"} {
+		if got, want := len(v[k].([]interface{})), 1; got != want {
+			t.Errorf("got %d %s targets want %d", got, k, want)
+		}
+	}
+
+	code, v = post("route add svc")
+	if got, want := code, 400; got != want {
+		t.Fatalf("got code %d want %d", got, want)
+	}
+	if got, want := v["error"], "line 1: syntax error: 'route add' invalid"; got != want {
+		t.Fatalf("got error %q want %q", got, want)
+	}
+}
@@ -104,7 +104,7 @@ $(function(){
 			data: JSON.stringify(data),
 			contentType: 'application/json',
 			statusCode: {
-				400: function(jqXHR, textStatus, err) { alert(err); },
+				400: function(jqXHR, textStatus, err) { alert(jqXHR.responseText); },
 				409: function(jqXHR, textStatus, err) { alert(err); },
 				500: function(jqXHR, textStatus, err) { alert(err); }
 			},
@@ -75,6 +75,10 @@ func (s ConsulSource) LoadClientCAs() (*x509.CertPool, error) {
 }
 
 func (s ConsulSource) Certificates() chan []tls.Certificate {
+	return s.certificates(nil)
+}
+
+func (s ConsulSource) certificates(done <-chan struct{}) chan []tls.Certificate {
 	if s.CertURL == "" {
 		return nil
 	}
@@ -90,7 +94,7 @@ func (s ConsulSource) Certificates() chan []tls.Certificate {
 	}
 
 	pemBlocksCh := make(chan map[string][]byte, 1)
-	go watchKV(client, key, pemBlocksCh)
+	go watchKV(client, key, pemBlocksCh, done)
 
 	ch := make(chan []tls.Certificate, 1)
 	go func() {
@@ -100,14 +104,21 @@ func (s ConsulSource) Certificates() chan []tls.Certificate {
 				log.Printf("[ERROR] cert: Failed to load certificates. %s", err)
 				continue
 			}
-			ch <- certs
+			select {
+			case ch <- certs:
+			case <-done:
+				return
+			}
 		}
 	}()
 	return ch
 }
 
-// watchKV monitors a key in the KV store for changes.
-func watchKV(client *api.Client, key string, pemBlocks chan map[string][]byte) {
+// watchKV monitors a key in the KV store for changes until done
+// is closed. It closes pemBlocks when it returns.
+func watchKV(client *api.Client, key string, pemBlocks chan map[string][]byte, done <-chan struct{}) {
+	defer close(pemBlocks)
+
 	var lastIndex uint64
 	var lastValue map[string][]byte
 
@@ -115,13 +126,19 @@ func watchKV(client *api.Client, key string, pemBlocks chan map[string][]byte) {
 		value, index, err := getCerts(client, key, lastIndex)
 		if err != nil {
 			log.Printf("[WARN] cert: Error fetching certificates from %s. %v", key, err)
-			time.Sleep(time.Second)
+			if !sleep(time.Second, done) {
+				return
+			}
 			continue
 		}
 
 		if !reflect.DeepEqual(value, lastValue) || index != lastIndex {
 			log.Printf("[INFO] cert: Certificate index changed to #%d", index)
-			pemBlocks <- value
+			select {
+			case pemBlocks <- value:
+			case <-done:
+				return
+			}
 			lastValue, lastIndex = value, index
 		}
 	}
@@ -38,6 +38,10 @@ func (s FileSource) Certificates() chan []tls.Certificate {
 	return ch
 }
 
+func (s FileSource) certificates(done <-chan struct{}) chan []tls.Certificate {
+	return s.Certificates()
+}
+
 func loadX509KeyPair(certFile, keyFile string) tls.Certificate {
 	if certFile == "" {
 		exit.Fatalf("[FATAL] cert: CertFile is required")
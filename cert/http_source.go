@@ -26,7 +26,11 @@ func (s HTTPSource) LoadClientCAs() (*x509.CertPool, error) {
 }
 
 func (s HTTPSource) Certificates() chan []tls.Certificate {
+	return s.certificates(nil)
+}
+
+func (s HTTPSource) certificates(done <-chan struct{}) chan []tls.Certificate {
 	ch := make(chan []tls.Certificate, 1)
-	go watch(ch, s.Refresh, s.CertURL, loadURL)
+	go watch(ch, done, s.Refresh, s.CertURL, loadURL)
 	return ch
 }
@@ -26,9 +26,13 @@ func (s PathSource) LoadClientCAs() (*x509.CertPool, error) {
 }
 
 func (s PathSource) Certificates() chan []tls.Certificate {
+	return s.certificates(nil)
+}
+
+func (s PathSource) certificates(done <-chan struct{}) chan []tls.Certificate {
 	path := makePath(s.Path, s.CertPath, DefaultCertPath)
 	ch := make(chan []tls.Certificate, 1)
-	go watch(ch, s.Refresh, path, loadPath)
+	go watch(ch, done, s.Refresh, path, loadPath)
 	return ch
 }
 
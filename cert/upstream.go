@@ -0,0 +1,330 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// Upstream provides TLS configurations for connections to upstream
+// servers. The CA bundles for verifying the server certificates and the
+// client certificates are loaded from the certificate sources on first
+// use and are updated when the sources change until Close is called.
+// The CA bundles are loaded from the upstreamca option of the sources.
+// A nil Upstream provides configurations without CA bundles and client
+// certificates.
+type Upstream struct {
+	// Sources contains the certificate sources by name.
+	Sources map[string]config.CertSource
+
+	// mu guards the maps and the stop channel but is not
+	// held while a source is loaded.
+	mu     sync.Mutex
+	stores map[string]*upstreamSource
+	pools  map[string]*upstreamSource
+	stop   chan struct{}
+	closed bool
+}
+
+// upstreamSource is the CA bundle or the certificate store
+// of a certificate source which is loaded on first use.
+type upstreamSource struct {
+	// mu serializes loading the source so that a slow source
+	// does not block the connections which use other sources.
+	mu     sync.Mutex
+	loaded bool
+	pool   atomic.Value // *x509.CertPool
+	store  *Store
+}
+
+// UpstreamConfig contains the TLS settings of a route for connections
+// to upstream servers.
+type UpstreamConfig struct {
+	// CA is the name of the certificate source with the CA bundle
+	// which verifies the server certificate.
+	CA string
+
+	// Cert is the name of the certificate source with the client
+	// certificate which is presented to the server.
+	Cert string
+
+	// ServerName is sent to the server in the TLS handshake (SNI).
+	ServerName string
+
+	// VerifyName is the name which the server certificate must be
+	// valid for. The default is ServerName.
+	VerifyName string
+
+	// InsecureSkipVerify disables the verification of the server
+	// certificate unless a CA bundle is configured.
+	InsecureSkipVerify bool
+}
+
+var errNoUpstream = errors.New("cert: no certificate sources for upstream connections")
+
+// TLSConfig returns a TLS configuration for a connection to an upstream
+// server. The CA bundle is taken from the upstream CA certificates of the
+// source and the first certificate of the source is presented as client
+// certificate. The configuration reflects the current state of the
+// sources and should not be reused for new connections.
+func (u *Upstream) TLSConfig(c UpstreamConfig) (*tls.Config, error) {
+	x := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify && c.CA == "",
+	}
+	if (c.CA != "" || c.Cert != "") && u == nil {
+		return nil, errNoUpstream
+	}
+	if c.CA != "" {
+		pool, err := u.pool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		x.RootCAs = pool
+	}
+	if c.Cert != "" {
+		store, err := u.store(c.Cert)
+		if err != nil {
+			return nil, err
+		}
+		x.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cs := store.certstore()
+			if len(cs.Certificates) == 0 {
+				// send no certificate and let the server decide
+				return &tls.Certificate{}, nil
+			}
+			return &cs.Certificates[0], nil
+		}
+	}
+	if c.VerifyName != "" && c.VerifyName != c.ServerName && !x.InsecureSkipVerify {
+		// the standard verification uses the server name
+		// from the handshake. Verify the certificate for
+		// the other name instead.
+		roots := x.RootCAs
+		x.InsecureSkipVerify = true
+		x.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyServer(cs.PeerCertificates, roots, c.VerifyName)
+		}
+	}
+	return x, nil
+}
+
+// verifyServer verifies that the certificate chain of a server is
+// valid for the given name. If roots is nil the system roots are used.
+func verifyServer(certs []*x509.Certificate, roots *x509.CertPool, name string) error {
+	if len(certs) == 0 {
+		return errors.New("cert: server sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+func (u *Upstream) source(name string) (config.CertSource, Source, error) {
+	cfg, ok := u.Sources[name]
+	if !ok {
+		return cfg, nil, fmt.Errorf("cert: unknown certificate source %q", name)
+	}
+	src, err := NewSource(cfg)
+	return cfg, src, err
+}
+
+// caSource returns a source which loads the upstream CA certificates
+// of the certificate source with LoadClientCAs. The client CA
+// certificates verify the clients of the listeners and must not
+// be trusted for the upstream servers.
+func (u *Upstream) caSource(name string) (config.CertSource, Source, error) {
+	cfg, ok := u.Sources[name]
+	if !ok {
+		return cfg, nil, fmt.Errorf("cert: unknown certificate source %q", name)
+	}
+	if cfg.UpstreamCAPath == "" {
+		return cfg, nil, fmt.Errorf("cert: certificate source %q has no upstreamca option", name)
+	}
+	cfg.ClientCAPath = cfg.UpstreamCAPath
+	src, err := NewSource(cfg)
+	return cfg, src, err
+}
+
+// stoppable is implemented by the sources which
+// stop sending certificates when done is closed.
+type stoppable interface {
+	certificates(done <-chan struct{}) chan []tls.Certificate
+}
+
+// certificates returns the channel with the certificates of the
+// source which are no longer sent after Close was called.
+func (u *Upstream) certificates(src Source) chan []tls.Certificate {
+	if s, ok := src.(stoppable); ok {
+		return s.certificates(u.done())
+	}
+	return src.Certificates()
+}
+
+// entry returns the entry for the certificate source from m
+// and creates it on first use.
+func (u *Upstream) entry(m *map[string]*upstreamSource, name string) (*upstreamSource, error) {
+	if _, ok := u.Sources[name]; !ok {
+		return nil, fmt.Errorf("cert: unknown certificate source %q", name)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if *m == nil {
+		*m = map[string]*upstreamSource{}
+	}
+	e := (*m)[name]
+	if e == nil {
+		e = new(upstreamSource)
+		(*m)[name] = e
+	}
+	return e, nil
+}
+
+// done returns the channel which is closed by Close.
+func (u *Upstream) done() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stop == nil {
+		u.stop = make(chan struct{})
+	}
+	return u.stop
+}
+
+// Close stops updating the CA bundles and certificates
+// which have already been loaded.
+func (u *Upstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stop == nil {
+		u.stop = make(chan struct{})
+	}
+	if !u.closed {
+		close(u.stop)
+		u.closed = true
+	}
+}
+
+// pool returns the current CA bundle of the certificate source. The
+// bundle is reloaded in the refresh interval of the source.
+func (u *Upstream) pool(name string) (*x509.CertPool, error) {
+	e, err := u.entry(&u.pools, name)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.loaded {
+		return e.pool.Load().(*x509.CertPool), nil
+	}
+
+	cfg, src, err := u.caSource(name)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := src.LoadClientCAs()
+	if err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		return nil, fmt.Errorf("cert: certificate source %q has no CA certificates", name)
+	}
+	e.pool.Store(pool)
+	e.loaded = true
+
+	if cfg.Refresh > 0 {
+		go u.refreshPool(name, src, cfg.Refresh, &e.pool)
+	}
+	return pool, nil
+}
+
+// refreshPool reloads the CA bundle of the source in the
+// refresh interval until Close is called.
+func (u *Upstream) refreshPool(name string, src Source, refresh time.Duration, v *atomic.Value) {
+	stop := u.done()
+	t := time.NewTicker(refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		pool, err := src.LoadClientCAs()
+		if err != nil || pool == nil {
+			log.Printf("[ERROR] cert: Cannot reload CA certificates from %s. %v", name, err)
+			continue
+		}
+		v.Store(pool)
+	}
+}
+
+// store returns the certificate store which is updated with the
+// certificates of the source.
+func (u *Upstream) store(name string) (*Store, error) {
+	e, err := u.entry(&u.stores, name)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.loaded {
+		return e.store, nil
+	}
+
+	_, src, err := u.source(name)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewStore()
+	ch := u.certificates(src)
+
+	// wait for the initial certificates so that the
+	// first connection can present a certificate.
+	select {
+	case certs, ok := <-ch:
+		if ok {
+			store.SetCertificates(certs)
+		}
+	case <-time.After(5 * time.Second):
+		log.Printf("[WARN] cert: No certificates from %s yet", name)
+	}
+	e.store, e.loaded = store, true
+
+	go u.updateStore(store, ch)
+	return store, nil
+}
+
+// updateStore updates the store with the certificates
+// from the source until Close is called.
+func (u *Upstream) updateStore(store *Store, ch chan []tls.Certificate) {
+	stop := u.done()
+	for {
+		select {
+		case <-stop:
+			return
+		case certs, ok := <-ch:
+			if !ok {
+				return
+			}
+			store.SetCertificates(certs)
+		}
+	}
+}
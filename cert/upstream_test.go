@@ -0,0 +1,102 @@
+package cert
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+func TestUpstreamLoadsSourcesIndependently(t *testing.T) {
+	started, block := make(chan bool, 1), make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- true:
+		default:
+		}
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	certPEM, _ := makePEM("localhost", time.Minute)
+	writeFile(filepath.Join(dir, "ca.pem"), certPEM)
+
+	u := &Upstream{Sources: map[string]config.CertSource{
+		"slow": {Name: "slow", Type: "http", CertPath: srv.URL},
+		"ca":   {Name: "ca", Type: "path", UpstreamCAPath: dir},
+	}}
+	defer u.Close()
+
+	// the store waits for the certificates of the slow source
+	go u.store("slow")
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := u.pool("ca")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("loading the CA bundle is blocked by another source")
+	}
+
+	if _, err := u.pool("unknown"); err == nil {
+		t.Fatal("got nil want error for unknown source")
+	}
+
+	u.Close()
+	u.Close()
+}
+
+func TestUpstreamIgnoresClientCAs(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	certPEM, _ := makePEM("localhost", time.Minute)
+	writeFile(filepath.Join(dir, "ca.pem"), certPEM)
+
+	u := &Upstream{Sources: map[string]config.CertSource{
+		"listener": {Name: "listener", Type: "path", ClientCAPath: dir},
+	}}
+	defer u.Close()
+
+	if _, err := u.TLSConfig(UpstreamConfig{CA: "listener"}); err == nil {
+		t.Fatal("got nil want error for source without upstreamca")
+	}
+}
+
+func TestUpstreamCloseStopsCertificates(t *testing.T) {
+	certPEM, keyPEM := makePEM("localhost", time.Minute)
+	load := func(string) (map[string][]byte, error) {
+		return map[string][]byte{"localhost-cert.pem": certPEM, "localhost-key.pem": keyPEM}, nil
+	}
+
+	u := &Upstream{}
+
+	// nobody reads the certificates and
+	// watch blocks until Close is called
+	ch, done := make(chan []tls.Certificate), make(chan bool)
+	go func() {
+		watch(ch, u.done(), time.Second, "test", load)
+		close(done)
+	}()
+
+	u.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("certificates are still watched after Close")
+	}
+}
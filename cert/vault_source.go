@@ -147,8 +147,12 @@ func (s *VaultSource) LoadClientCAs() (*x509.CertPool, error) {
 }
 
 func (s *VaultSource) Certificates() chan []tls.Certificate {
+	return s.certificates(nil)
+}
+
+func (s *VaultSource) certificates(done <-chan struct{}) chan []tls.Certificate {
 	ch := make(chan []tls.Certificate, 1)
-	go watch(ch, s.Refresh, s.CertPath, s.load)
+	go watch(ch, done, s.Refresh, s.CertPath, s.load)
 	return ch
 }
 
@@ -7,8 +7,9 @@ import (
 	"time"
 )
 
-// watch monitors the result of the loadFn function for changes.
-func watch(ch chan []tls.Certificate, refresh time.Duration, path string, loadFn func(path string) (map[string][]byte, error)) {
+// watch monitors the result of the loadFn function for changes
+// until done is closed. A nil done channel is never closed.
+func watch(ch chan []tls.Certificate, done <-chan struct{}, refresh time.Duration, path string, loadFn func(path string) (map[string][]byte, error)) {
 	once := refresh <= 0
 
 	// do not refresh more often than once a second to prevent busy loops
@@ -21,12 +22,16 @@ func watch(ch chan []tls.Certificate, refresh time.Duration, path string, loadFn
 		next, err := loadFn(path)
 		if err != nil {
 			log.Printf("[ERROR] cert: Cannot load certificates from %s. %s", path, err)
-			time.Sleep(refresh)
+			if !sleep(refresh, done) {
+				return
+			}
 			continue
 		}
 
 		if reflect.DeepEqual(next, last) {
-			time.Sleep(refresh)
+			if !sleep(refresh, done) {
+				return
+			}
 			continue
 		}
 
@@ -36,7 +41,11 @@ func watch(ch chan []tls.Certificate, refresh time.Duration, path string, loadFn
 			continue
 		}
 
-		ch <- certs
+		select {
+		case ch <- certs:
+		case <-done:
+			return
+		}
 		last = next
 
 		if once {
@@ -44,3 +53,16 @@ func watch(ch chan []tls.Certificate, refresh time.Duration, path string, loadFn
 		}
 	}
 }
+
+// sleep waits for the duration and returns false
+// if done is closed before.
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
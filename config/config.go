@@ -1,6 +1,7 @@
 package config
 
 import (
+	"net"
 	"net/http"
 	"regexp"
 	"time"
@@ -11,8 +12,10 @@ type Config struct {
 	Proxy       Proxy
 	Registry    Registry
 	Listen      []Listen
+	CertSources map[string]CertSource
 	Log         Log
 	Metrics     Metrics
+	Tracing     Tracing
 	UI          UI
 	Runtime     Runtime
 	ProfileMode string
@@ -28,6 +31,11 @@ type CertSource struct {
 	CAUpgradeCN  string
 	Refresh      time.Duration
 	Header       http.Header
+
+	// UpstreamCAPath is the path to the CA certificates which
+	// verify the HTTPS upstream servers of the 'tlsca' route
+	// option. It has the same format as ClientCAPath.
+	UpstreamCAPath string
 }
 
 type Listen struct {
@@ -40,6 +48,16 @@ type Listen struct {
 	TLSMinVersion uint16
 	TLSMaxVersion uint16
 	TLSCiphers    []uint16
+
+	// ProxyProto is 'on' or 'required' if the connections can or must
+	// start with a PROXY protocol header. It is empty if the PROXY
+	// protocol is disabled.
+	ProxyProto string
+
+	// ProxyProtoTrust contains the networks of the peers which can
+	// send a PROXY protocol header. It must not be empty if the PROXY
+	// protocol is enabled.
+	ProxyProtoTrust []*net.IPNet
 }
 
 type UI struct {
@@ -55,16 +73,21 @@ type Proxy struct {
 	NoRouteStatus         int
 	MaxConn               int
 	ShutdownWait          time.Duration
+	DrainTimeout          time.Duration
 	DialTimeout           time.Duration
 	ResponseHeaderTimeout time.Duration
 	KeepAliveTimeout      time.Duration
 	FlushInterval         time.Duration
+	WSIdleTimeout         time.Duration
 	LocalIP               string
 	ClientIPHeader        string
+	TrustedProxies        []*net.IPNet
 	TLSHeader             string
 	TLSHeaderValue        string
 	GZIPContentTypes      *regexp.Regexp
 	RequestID             string
+	MaxBody               int64
+	ErrorPages            string
 }
 
 type Runtime struct {
@@ -96,6 +119,16 @@ type Metrics struct {
 	Circonus     Circonus
 }
 
+type Tracing struct {
+	Target      string
+	Collector   string
+	ServiceName string
+	SampleRate  float64
+	Propagation []string
+	BatchSize   int
+	Interval    time.Duration
+}
+
 type Registry struct {
 	Backend string
 	Static  Static
@@ -32,6 +32,13 @@ var defaultConfig = &Config{
 			APIApp: "fabio",
 		},
 	},
+	Tracing: Tracing{
+		ServiceName: "fabio",
+		SampleRate:  1,
+		Propagation: []string{"w3c"},
+		BatchSize:   512,
+		Interval:    5 * time.Second,
+	},
 	Proxy: Proxy{
 		MaxConn:       10000,
 		Strategy:      "rnd",
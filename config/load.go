@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"regexp"
 	"runtime"
@@ -115,26 +116,33 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	var certSourcesValue string
 	var readTimeout, writeTimeout time.Duration
 	var gzipContentTypesValue string
+	var maxBodyValue string
+	var trustedProxiesValue string
 
 	f.IntVar(&cfg.Proxy.MaxConn, "proxy.maxconn", defaultConfig.Proxy.MaxConn, "maximum number of cached connections")
 	f.StringVar(&cfg.Proxy.Strategy, "proxy.strategy", defaultConfig.Proxy.Strategy, "load balancing strategy")
 	f.StringVar(&cfg.Proxy.Matcher, "proxy.matcher", defaultConfig.Proxy.Matcher, "path matching algorithm")
 	f.IntVar(&cfg.Proxy.NoRouteStatus, "proxy.noroutestatus", defaultConfig.Proxy.NoRouteStatus, "status code for invalid route")
 	f.DurationVar(&cfg.Proxy.ShutdownWait, "proxy.shutdownwait", defaultConfig.Proxy.ShutdownWait, "time for graceful shutdown")
+	f.DurationVar(&cfg.Proxy.DrainTimeout, "proxy.draintimeout", defaultConfig.Proxy.DrainTimeout, "grace period for TCP and websocket connections during shutdown")
 	f.DurationVar(&cfg.Proxy.DialTimeout, "proxy.dialtimeout", defaultConfig.Proxy.DialTimeout, "connection timeout for backend connections")
 	f.DurationVar(&cfg.Proxy.ResponseHeaderTimeout, "proxy.responseheadertimeout", defaultConfig.Proxy.ResponseHeaderTimeout, "response header timeout")
 	f.DurationVar(&cfg.Proxy.KeepAliveTimeout, "proxy.keepalivetimeout", defaultConfig.Proxy.KeepAliveTimeout, "keep-alive timeout")
 	f.StringVar(&cfg.Proxy.LocalIP, "proxy.localip", defaultConfig.Proxy.LocalIP, "fabio address in Forward headers")
 	f.StringVar(&cfg.Proxy.ClientIPHeader, "proxy.header.clientip", defaultConfig.Proxy.ClientIPHeader, "header for the request ip")
+	f.StringVar(&trustedProxiesValue, "proxy.trustedproxies", "", "networks of the proxies which can set the client ip in forwarding headers")
 	f.StringVar(&cfg.Proxy.TLSHeader, "proxy.header.tls", defaultConfig.Proxy.TLSHeader, "header for TLS connections")
 	f.StringVar(&cfg.Proxy.TLSHeaderValue, "proxy.header.tls.value", defaultConfig.Proxy.TLSHeaderValue, "value for TLS connection header")
 	f.StringVar(&cfg.Proxy.RequestID, "proxy.header.requestid", defaultConfig.Proxy.RequestID, "header for reqest id")
 	f.StringVar(&gzipContentTypesValue, "proxy.gzip.contenttype", defaultValues.GZIPContentTypesValue, "regexp of content types to compress")
+	f.StringVar(&maxBodyValue, "proxy.maxbody", "", "maximum size of request bodies, e.g. 10MB")
+	f.StringVar(&cfg.Proxy.ErrorPages, "proxy.errorpages", defaultConfig.Proxy.ErrorPages, "path to error page templates")
 	f.StringVar(&listenerValue, "proxy.addr", defaultValues.ListenerValue, "listener config")
 	f.StringVar(&certSourcesValue, "proxy.cs", defaultValues.CertSourcesValue, "certificate sources")
 	f.DurationVar(&readTimeout, "proxy.readtimeout", defaultValues.ReadTimeout, "read timeout for incoming requests")
 	f.DurationVar(&writeTimeout, "proxy.writetimeout", defaultValues.WriteTimeout, "write timeout for outgoing responses")
 	f.DurationVar(&cfg.Proxy.FlushInterval, "proxy.flushinterval", defaultConfig.Proxy.FlushInterval, "flush interval for streaming responses")
+	f.DurationVar(&cfg.Proxy.WSIdleTimeout, "proxy.ws.idletimeout", defaultConfig.Proxy.WSIdleTimeout, "idle timeout for websocket connections")
 	f.StringVar(&cfg.Log.AccessFormat, "log.access.format", defaultConfig.Log.AccessFormat, "access log format")
 	f.StringVar(&cfg.Log.AccessTarget, "log.access.target", defaultConfig.Log.AccessTarget, "access log target")
 	f.StringVar(&cfg.Log.RoutesFormat, "log.routes.format", defaultConfig.Log.RoutesFormat, "log format of routing table updates")
@@ -149,6 +157,13 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	f.StringVar(&cfg.Metrics.Circonus.APIURL, "metrics.circonus.apiurl", defaultConfig.Metrics.Circonus.APIURL, "Circonus API URL")
 	f.StringVar(&cfg.Metrics.Circonus.BrokerID, "metrics.circonus.brokerid", defaultConfig.Metrics.Circonus.BrokerID, "Circonus Broker ID")
 	f.StringVar(&cfg.Metrics.Circonus.CheckID, "metrics.circonus.checkid", defaultConfig.Metrics.Circonus.CheckID, "Circonus Check ID")
+	f.StringVar(&cfg.Tracing.Target, "tracing.target", defaultConfig.Tracing.Target, "tracing backend, one of [otlp, zipkin]")
+	f.StringVar(&cfg.Tracing.Collector, "tracing.collector", defaultConfig.Tracing.Collector, "URL of the trace collector")
+	f.StringVar(&cfg.Tracing.ServiceName, "tracing.servicename", defaultConfig.Tracing.ServiceName, "service name of the spans")
+	f.Float64Var(&cfg.Tracing.SampleRate, "tracing.samplerate", defaultConfig.Tracing.SampleRate, "fraction of new traces which are sampled")
+	f.StringSliceVar(&cfg.Tracing.Propagation, "tracing.propagation", defaultConfig.Tracing.Propagation, "trace headers for upstream requests, any of [w3c, b3]")
+	f.IntVar(&cfg.Tracing.BatchSize, "tracing.batchsize", defaultConfig.Tracing.BatchSize, "maximum number of spans per export")
+	f.DurationVar(&cfg.Tracing.Interval, "tracing.interval", defaultConfig.Tracing.Interval, "export interval for spans")
 	f.StringVar(&cfg.Registry.Backend, "registry.backend", defaultConfig.Registry.Backend, "registry backend")
 	f.DurationVar(&cfg.Registry.Timeout, "registry.timeout", defaultConfig.Registry.Timeout, "timeout for registry to become available")
 	f.DurationVar(&cfg.Registry.Retry, "registry.retry", defaultConfig.Registry.Retry, "retry interval during startup")
@@ -205,6 +220,9 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	if err != nil {
 		return nil, err
 	}
+	if len(certSources) > 0 {
+		cfg.CertSources = certSources
+	}
 
 	if uiListenerValue != "" {
 		kvs, err := parseKVSlice(uiListenerValue)
@@ -237,6 +255,20 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 		}
 	}
 
+	if maxBodyValue != "" {
+		cfg.Proxy.MaxBody, err = ParseSize(maxBodyValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy.maxbody: %s", err)
+		}
+	}
+
+	if trustedProxiesValue != "" {
+		cfg.Proxy.TrustedProxies, err = parseCIDRs(trustedProxiesValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy.trustedproxies: %s", err)
+		}
+	}
+
 	if cfg.Proxy.Strategy != "rr" && cfg.Proxy.Strategy != "rnd" {
 		return nil, fmt.Errorf("invalid proxy.strategy: %s", cfg.Proxy.Strategy)
 	}
@@ -249,6 +281,10 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 		return nil, fmt.Errorf("invalid ui.access: %s", cfg.UI.Access)
 	}
 
+	if err := checkTracing(cfg.Tracing); err != nil {
+		return nil, err
+	}
+
 	// handle deprecations
 	deprecate := func(name, msg string) {
 		if f.IsSet(name) {
@@ -264,6 +300,29 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	return cfg, nil
 }
 
+// checkTracing validates the tracing configuration.
+func checkTracing(t Tracing) error {
+	switch t.Target {
+	case "":
+		return nil
+	case "otlp", "zipkin":
+	default:
+		return fmt.Errorf("invalid tracing.target: %s", t.Target)
+	}
+	if t.Collector == "" {
+		return fmt.Errorf("tracing.collector required for tracing.target %s", t.Target)
+	}
+	if t.SampleRate < 0 || t.SampleRate > 1 {
+		return fmt.Errorf("invalid tracing.samplerate: %v", t.SampleRate)
+	}
+	for _, p := range t.Propagation {
+		if p != "w3c" && p != "b3" {
+			return fmt.Errorf("invalid tracing.propagation: %s", p)
+		}
+	}
+	return nil
+}
+
 // parseScheme splits a url into scheme and address and defaults
 // to "http" if no scheme was given.
 func parseScheme(s string) (scheme, addr string) {
@@ -395,6 +454,21 @@ func parseListen(cfg map[string]string, cs map[string]CertSource, readTimeout, w
 				return Listen{}, err
 			}
 			l.TLSCiphers = c
+		case "pxyproto":
+			switch v {
+			case "off":
+				l.ProxyProto = ""
+			case "on", "required":
+				l.ProxyProto = v
+			default:
+				return Listen{}, fmt.Errorf("invalid value %q for pxyproto", v)
+			}
+		case "pxytrust":
+			n, err := parseCIDRs(v)
+			if err != nil {
+				return Listen{}, err
+			}
+			l.ProxyProtoTrust = n
 		}
 	}
 
@@ -410,6 +484,17 @@ func parseListen(cfg map[string]string, cs map[string]CertSource, readTimeout, w
 	if csName == "" && l.Proto == "https" {
 		return Listen{}, fmt.Errorf("proto 'https' requires cert source")
 	}
+	unix := strings.HasPrefix(l.Addr, "unix:")
+	if unix && l.Proto != "http" && l.Proto != "https" {
+		return Listen{}, fmt.Errorf("unix socket requires proto 'http' or 'https'")
+	}
+	// connections on a unix socket have no client address
+	if unix && l.ProxyProto != "required" {
+		return Listen{}, fmt.Errorf("unix socket requires pxyproto=required")
+	}
+	if !unix && l.ProxyProto != "" && len(l.ProxyProtoTrust) == 0 {
+		return Listen{}, fmt.Errorf("pxyproto requires pxytrust")
+	}
 
 	return
 }
@@ -446,6 +531,36 @@ var tlsciphers = map[string]uint16{
 	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  0xcca9,
 }
 
+// parseCIDRs parses a comma separated list of networks in CIDR notation.
+// IP addresses are networks with a single address.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 func parseTLSVersion(s string) (uint16, error) {
 	s = strings.ToLower(strings.TrimSpace(s))
 	if n, ok := tlsver[s]; ok {
@@ -517,6 +632,8 @@ func parseCertSource(cfg map[string]string) (c CertSource, err error) {
 			c.KeyPath = v
 		case "clientca":
 			c.ClientCAPath = v
+		case "upstreamca":
+			c.UpstreamCAPath = v
 		case "caupgcn":
 			c.CAUpgradeCN = v
 		case "refresh":
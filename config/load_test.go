@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -91,6 +92,37 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.addr", "unix:/run/fabio.sock;proto=http;pxyproto=required"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{Addr: "unix:/run/fabio.sock", Proto: "http", ProxyProto: "required"}}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.addr with PROXY protocol",
+			args: []string{"-proxy.addr", `:5555;pxyproto=required;pxytrust="10.0.0.0/8, 1.2.3.4,::1"`},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{
+					Addr:       ":5555",
+					Proto:      "http",
+					ProxyProto: "required",
+					ProxyProtoTrust: []*net.IPNet{
+						{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+						{IP: net.IP{1, 2, 3, 4}, Mask: net.CIDRMask(32, 32)},
+						{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+					},
+				}}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.addr", ":5555;pxyproto=off"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{Addr: ":5555", Proto: "http"}}
+				return cfg
+			},
+		},
 		{
 			desc: "-proxy.addr with tls configs",
 			args: []string{"-proxy.addr", `:5555;rt=1s;wt=2s;tlsmin=0x0300;tlsmax=0x305;tlsciphers="0x123,0x456"`},
@@ -133,6 +165,7 @@ func TestLoad(t *testing.T) {
 			cfg: func(cfg *Config) *Config {
 				cfg.Listen = []Listen{Listen{Addr: ":5555", Proto: "https"}}
 				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "file", CertPath: "value"}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -142,6 +175,7 @@ func TestLoad(t *testing.T) {
 			cfg: func(cfg *Config) *Config {
 				cfg.Listen = []Listen{Listen{Addr: ":5555", Proto: "https"}}
 				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "path", CertPath: "value", Refresh: 3 * time.Second}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -151,6 +185,7 @@ func TestLoad(t *testing.T) {
 			cfg: func(cfg *Config) *Config {
 				cfg.Listen = []Listen{Listen{Addr: ":5555", Proto: "https"}}
 				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "http", CertPath: "value", Refresh: 3 * time.Second}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -160,6 +195,7 @@ func TestLoad(t *testing.T) {
 			cfg: func(cfg *Config) *Config {
 				cfg.Listen = []Listen{Listen{Addr: ":5555", Proto: "https"}}
 				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "consul", CertPath: "value"}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -169,6 +205,7 @@ func TestLoad(t *testing.T) {
 			cfg: func(cfg *Config) *Config {
 				cfg.Listen = []Listen{Listen{Addr: ":5555", Proto: "https"}}
 				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "vault", CertPath: "value", Refresh: 3 * time.Second}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -192,12 +229,13 @@ func TestLoad(t *testing.T) {
 						},
 					},
 				}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
 		{
 			desc: "-proxy.addr with cert source with full options",
-			args: []string{"-proxy.addr", ":5555;cs=name;strictmatch=true;proto=https", "-proxy.cs", "cs=name;type=path;cert=foo;clientca=bar;refresh=2s;hdr=a: b;caupgcn=furb"},
+			args: []string{"-proxy.addr", ":5555;cs=name;strictmatch=true;proto=https", "-proxy.cs", "cs=name;type=path;cert=foo;clientca=bar;upstreamca=baz;refresh=2s;hdr=a: b;caupgcn=furb"},
 			cfg: func(cfg *Config) *Config {
 				cfg.Listen = []Listen{
 					Listen{
@@ -205,16 +243,18 @@ func TestLoad(t *testing.T) {
 						Proto:       "https",
 						StrictMatch: true,
 						CertSource: CertSource{
-							Name:         "name",
-							Type:         "path",
-							CertPath:     "foo",
-							ClientCAPath: "bar",
-							Refresh:      2 * time.Second,
-							Header:       http.Header{"A": []string{"b"}},
-							CAUpgradeCN:  "furb",
+							Name:           "name",
+							Type:           "path",
+							CertPath:       "foo",
+							ClientCAPath:   "bar",
+							UpstreamCAPath: "baz",
+							Refresh:        2 * time.Second,
+							Header:         http.Header{"A": []string{"b"}},
+							CAUpgradeCN:    "furb",
 						},
 					},
 				}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -235,6 +275,7 @@ func TestLoad(t *testing.T) {
 					Type:     "consul",
 					CertPath: "http://localhost:8500/v1/kv/ssl?token=token",
 				}
+				cfg.CertSources = map[string]CertSource{cfg.Listen[0].CertSource.Name: cfg.Listen[0].CertSource}
 				return cfg
 			},
 		},
@@ -287,6 +328,13 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.draintimeout", "5m"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.DrainTimeout = 5 * time.Minute
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.responseheadertimeout", "5ms"},
 			cfg: func(cfg *Config) *Config {
@@ -329,6 +377,13 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.ws.idletimeout", "5m"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.WSIdleTimeout = 5 * time.Minute
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.maxconn", "555"},
 			cfg: func(cfg *Config) *Config {
@@ -371,6 +426,30 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.errorpages", "/etc/fabio/errors"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.ErrorPages = "/etc/fabio/errors"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.maxbody", "10MB"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.MaxBody = 10 << 20
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.trustedproxies", "10.0.0.0/8, 192.168.1.1"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.TrustedProxies = []*net.IPNet{
+					{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+					{IP: net.IP{192, 168, 1, 1}, Mask: net.CIDRMask(32, 32)},
+				}
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.log.routes", "foobar"},
 			cfg: func(cfg *Config) *Config {
@@ -585,6 +664,16 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-tracing.target", "zipkin", "-tracing.collector", "http://localhost:9411/api/v2/spans", "-tracing.samplerate", "0.25", "-tracing.propagation", "w3c,b3"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Tracing.Target = "zipkin"
+				cfg.Tracing.Collector = "http://localhost:9411/api/v2/spans"
+				cfg.Tracing.SampleRate = 0.25
+				cfg.Tracing.Propagation = []string{"w3c", "b3"}
+				return cfg
+			},
+		},
 		{
 			args: []string{"-metrics.circonus.apiapp", "value"},
 			cfg: func(cfg *Config) *Config {
@@ -665,6 +754,7 @@ func TestLoad(t *testing.T) {
 				cfg.UI.Listen.CertSource.Type = "file"
 				cfg.UI.Listen.CertSource.CertPath = "value"
 				cfg.Registry.Consul.CheckScheme = "https"
+				cfg.CertSources = map[string]CertSource{"ui": cfg.UI.Listen.CertSource}
 				return cfg
 			},
 		},
@@ -791,6 +881,26 @@ func TestLoad(t *testing.T) {
 		},
 
 		// errors
+		{
+			args: []string{"-tracing.target", "otlp"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("tracing.collector required for tracing.target otlp"),
+		},
+		{
+			args: []string{"-tracing.target", "otlp", "-tracing.collector", "http://localhost:4318/v1/traces", "-tracing.samplerate", "2"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("invalid tracing.samplerate: 2"),
+		},
+		{
+			args: []string{"-proxy.maxbody", "10XB"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid proxy.maxbody: invalid size "10XB"`),
+		},
+		{
+			args: []string{"-proxy.trustedproxies", "10.0.0.0/8,foo"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid proxy.trustedproxies: invalid ip address "foo"`),
+		},
 		{
 			desc: "-proxy.addr with unknown cert source 'foo'",
 			args: []string{"-proxy.addr", ":5555;cs=foo"},
@@ -809,6 +919,36 @@ func TestLoad(t *testing.T) {
 			cfg:  func(cfg *Config) *Config { return nil },
 			err:  errors.New("proto 'https' requires cert source"),
 		},
+		{
+			desc: "-proxy.addr with invalid pxyproto",
+			args: []string{"-proxy.addr", ":5555;pxyproto=v1"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("invalid value \"v1\" for pxyproto"),
+		},
+		{
+			desc: "-proxy.addr with pxyproto requires pxytrust",
+			args: []string{"-proxy.addr", ":5555;pxyproto=on"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("pxyproto requires pxytrust"),
+		},
+		{
+			desc: "-proxy.addr with invalid pxytrust",
+			args: []string{"-proxy.addr", ":5555;pxyproto=on;pxytrust=10.0.0.0/33"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("invalid network \"10.0.0.0/33\""),
+		},
+		{
+			desc: "-proxy.addr with unix socket and proto 'tcp' requires proto 'http' or 'https'",
+			args: []string{"-proxy.addr", "unix:/run/fabio.sock;proto=tcp"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("unix socket requires proto 'http' or 'https'"),
+		},
+		{
+			desc: "-proxy.addr with unix socket requires pxyproto=required",
+			args: []string{"-proxy.addr", "unix:/run/fabio.sock;proto=http;pxyproto=on"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("unix socket requires pxyproto=required"),
+		},
 		{
 			desc: "-proxy.addr with cert source and proto 'http' requires proto 'https' or 'tcp'",
 			args: []string{"-proxy.addr", ":5555;cs=name;proto=http", "-proxy.cs", "cs=name;type=path;cert=value"},
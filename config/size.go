@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits maps the supported size suffixes to their multiplier.
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"K":  1 << 10,
+	"KB": 1 << 10,
+	"M":  1 << 20,
+	"MB": 1 << 20,
+	"G":  1 << 30,
+	"GB": 1 << 30,
+}
+
+// ParseSize parses a size in bytes with an optional unit suffix like
+// '512', '64KB', '10MB' or '1G'. Units are powers of 1024 and are not
+// case sensitive.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	n := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' })
+	if n < 0 {
+		n = len(v)
+	}
+
+	mult, ok := sizeUnits[strings.TrimSpace(v[n:])]
+	if n == 0 || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	i, err := strconv.ParseInt(v[:n], 10, 64)
+	if err != nil || i > (1<<63-1)/mult {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return i * mult, nil
+}
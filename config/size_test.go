@@ -0,0 +1,36 @@
+package config
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		size int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512b", 512, false},
+		{"64KB", 64 << 10, false},
+		{"64k", 64 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"10 MB", 10 << 20, false},
+		{"1G", 1 << 30, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1", 0, true},
+		{"1.5MB", 0, true},
+		{"10TB", 0, true},
+		{"99999999999GB", 0, true},
+	}
+
+	for _, tt := range tests {
+		size, err := ParseSize(tt.in)
+		if got, want := err != nil, tt.err; got != want {
+			t.Errorf("%q: got error %v want %v", tt.in, err, want)
+		}
+		if got, want := size, tt.size; got != want {
+			t.Errorf("%q: got %d want %d", tt.in, got, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package connlimit implements a limit for concurrent requests
+// with a bounded FIFO queue for requests which exceed the limit.
+package connlimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/metrics"
+)
+
+// DefaultQueueTimeout is the maximum time a request waits in the
+// queue if the limiter has no queue timeout.
+const DefaultQueueTimeout = 30 * time.Second
+
+var (
+	// ErrQueueFull is returned by Acquire when the limit has been
+	// reached and the queue has no more room.
+	ErrQueueFull = errors.New("connlimit: queue full")
+
+	// ErrTimeout is returned by Acquire when the request waited
+	// longer than the queue timeout.
+	ErrTimeout = errors.New("connlimit: queue timeout")
+)
+
+// Limiter limits the number of concurrent requests. Requests which exceed
+// the limit wait in a FIFO queue until a slot becomes available, the queue
+// timeout expires or their context is done. A Limiter is safe to be used
+// by multiple go routines.
+type Limiter struct {
+	// Max is the maximum number of concurrent requests.
+	Max int
+
+	// QueueSize is the maximum number of waiting requests.
+	QueueSize int
+
+	// QueueTimeout is the maximum time a request waits in the queue.
+	// The default is DefaultQueueTimeout.
+	QueueTimeout time.Duration
+
+	// ActiveGauge and QueuedGauge are updated with the number of
+	// active and waiting requests if they are not nil.
+	ActiveGauge metrics.Gauge
+	QueuedGauge metrics.Gauge
+
+	mu     sync.Mutex
+	active int
+	queue  []chan struct{}
+}
+
+// New creates a limiter for max concurrent requests with a queue for
+// queueSize requests which wait at most queueTimeout.
+func New(max, queueSize int, queueTimeout time.Duration) *Limiter {
+	return &Limiter{Max: max, QueueSize: queueSize, QueueTimeout: queueTimeout}
+}
+
+// Acquire reserves a slot for a request and must be followed by a call to
+// Release when the request has completed and Acquire returned no error.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.active < l.Max && len(l.queue) == 0 {
+		l.active++
+		l.report()
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.queue) >= l.QueueSize {
+		l.mu.Unlock()
+		return ErrQueueFull
+	}
+	ready := make(chan struct{})
+	l.queue = append(l.queue, ready)
+	l.report()
+	l.mu.Unlock()
+
+	timeout := l.QueueTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, c := range l.queue {
+		if c == ready {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			l.report()
+			return err
+		}
+	}
+	// Release handed over the slot while we gave up
+	// waiting. Pass it on since the caller won't
+	// release it.
+	l.release()
+	return err
+}
+
+// Release frees the slot of a request and passes it to the
+// first waiting request.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	l.release()
+	l.mu.Unlock()
+}
+
+func (l *Limiter) release() {
+	defer l.report()
+	if len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		return
+	}
+	l.active--
+}
+
+// report updates the gauges. l.mu must be held.
+func (l *Limiter) report() {
+	if l.ActiveGauge != nil {
+		l.ActiveGauge.Update(int64(l.active))
+	}
+	if l.QueuedGauge != nil {
+		l.QueuedGauge.Update(int64(len(l.queue)))
+	}
+}
+
+// Active returns the number of requests which hold a slot.
+func (l *Limiter) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// Queued returns the number of requests which wait for a slot.
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
@@ -0,0 +1,125 @@
+package connlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(1, 1, 0)
+	ctx := context.Background()
+
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal("Acquire: ", err)
+	}
+
+	// second request waits in the queue
+	done := make(chan error)
+	go func() { done <- l.Acquire(ctx) }()
+	waitFor(t, func() bool { return l.Queued() == 1 })
+
+	// third request is rejected
+	if got, want := l.Acquire(ctx), ErrQueueFull; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// release passes the slot to the waiting request
+	l.Release()
+	if err := <-done; err != nil {
+		t.Fatal("Acquire: ", err)
+	}
+	if got, want := l.Active(), 1; got != want {
+		t.Fatalf("got %d active want %d", got, want)
+	}
+	if got, want := l.Queued(), 0; got != want {
+		t.Fatalf("got %d queued want %d", got, want)
+	}
+
+	l.Release()
+	if got, want := l.Active(), 0; got != want {
+		t.Fatalf("got %d active want %d", got, want)
+	}
+}
+
+func TestLimiterFIFO(t *testing.T) {
+	l := New(1, 2, 0)
+	ctx := context.Background()
+	l.Acquire(ctx)
+
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		i := i
+		go func() {
+			l.Acquire(ctx)
+			order <- i
+			l.Release()
+		}()
+		waitFor(t, func() bool { return l.Queued() == i })
+	}
+
+	l.Release()
+	if a, b := <-order, <-order; a != 1 || b != 2 {
+		t.Fatalf("got order %d,%d want 1,2", a, b)
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	l := New(1, 1, 10*time.Millisecond)
+	ctx := context.Background()
+	l.Acquire(ctx)
+
+	if got, want := l.Acquire(ctx), ErrTimeout; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got, want := l.Queued(), 0; got != want {
+		t.Fatalf("got %d queued want %d", got, want)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if got, want := l.Acquire(cctx), context.Canceled; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func waitFor(t *testing.T, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type gauge struct{ n int64 }
+
+func (g *gauge) Update(n int64) { g.n = n }
+
+func TestLimiterGauges(t *testing.T) {
+	l := New(1, 1, 0)
+	active, queued := &gauge{}, &gauge{}
+	l.ActiveGauge, l.QueuedGauge = active, queued
+	ctx := context.Background()
+
+	l.Acquire(ctx)
+	done := make(chan error)
+	go func() { done <- l.Acquire(ctx) }()
+	waitFor(t, func() bool { return l.Queued() == 1 })
+
+	l.mu.Lock()
+	gotActive, gotQueued := active.n, queued.n
+	l.mu.Unlock()
+	if gotActive != 1 || gotQueued != 1 {
+		t.Fatalf("got active=%d queued=%d want active=1 queued=1", gotActive, gotQueued)
+	}
+
+	l.Release()
+	<-done
+	l.Release()
+	if active.n != 0 || queued.n != 0 {
+		t.Fatalf("got active=%d queued=%d want active=0 queued=0", active.n, queued.n)
+	}
+}
@@ -18,6 +18,7 @@
 //   $request_url             - request URL
 //   $request_proto           - request protocol
 //   $response_body_size      - response body size in bytes
+//   $response_grpc_status    - gRPC status code of the response
 //   $response_status         - response status code
 //   $response_time_ms        - response time in S.sss format
 //   $response_time_us        - response time in S.ssssss format
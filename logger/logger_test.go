@@ -75,6 +75,7 @@ func TestLog(t *testing.T) {
 			StatusCode:    200,
 			ContentLength: 1234,
 			Header:        http.Header{"foo": []string{"bar"}},
+			Trailer:       http.Header{"Grpc-Status": []string{"5"}},
 			Request: &http.Request{
 				RemoteAddr: "5.6.7.8:1234",
 			},
@@ -104,6 +105,7 @@ func TestLog(t *testing.T) {
 		{"$request_uri", "/?q=x\n"},
 		{"$request_url", "http://foo.com/?q=x\n"},
 		{"$response_body_size", "1234\n"},
+		{"$response_grpc_status", "5\n"},
 		{"$response_status", "200\n"},
 		{"$response_time_ms", "0.123\n"},       // TODO(fs): is this correct?
 		{"$response_time_ns", "0.123456789\n"}, // TODO(fs): is this correct?
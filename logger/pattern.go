@@ -118,6 +118,15 @@ var fields = map[string]field{
 	"$response_body_size": func(b *bytes.Buffer, e *Event) {
 		atoi(b, e.Response.ContentLength, 0)
 	},
+	"$response_grpc_status": func(b *bytes.Buffer, e *Event) {
+		// gRPC sends the status in the trailer unless
+		// the response has no body.
+		v := e.Response.Trailer.Get("Grpc-Status")
+		if v == "" {
+			v = e.Response.Header.Get("Grpc-Status")
+		}
+		b.WriteString(v)
+	},
 	"$response_status": func(b *bytes.Buffer, e *Event) {
 		atoi(b, int64(e.Response.StatusCode), 0)
 	},
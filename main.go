@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"runtime"
@@ -31,6 +30,8 @@ import (
 	"github.com/fabiolb/fabio/registry/file"
 	"github.com/fabiolb/fabio/registry/static"
 	"github.com/fabiolb/fabio/route"
+	"github.com/fabiolb/fabio/trace"
+	"github.com/fabiolb/fabio/upgrade"
 	"github.com/pkg/profile"
 	dmp "github.com/sergi/go-diff/diffmatchpatch"
 )
@@ -47,6 +48,10 @@ var version = "1.5.1"
 
 var shuttingDown int32
 
+// tracer creates and exports the spans of the HTTP requests.
+// It is nil if tracing is disabled.
+var tracer *trace.Tracer
+
 func main() {
 	cfg, err := config.Load(os.Args, os.Environ())
 	if err != nil {
@@ -57,7 +62,7 @@ func main() {
 		return
 	}
 
-	log.Printf("[INFO] Runtime config\n" + toJSON(cfg))
+	log.Printf("[INFO] Runtime config\n%s", toJSON(cfg))
 	log.Printf("[INFO] Version %s starting", version)
 	log.Printf("[INFO] Go runtime is %s", runtime.Version())
 
@@ -89,19 +94,27 @@ func main() {
 
 	exit.Listen(func(s os.Signal) {
 		atomic.StoreInt32(&shuttingDown, 1)
-		proxy.Shutdown(cfg.Proxy.ShutdownWait)
+		if upgrade.Completed() {
+			// the new process serves the admin API and
+			// keeps the registration with the backend.
+			proxy.CloseAdmin()
+		}
+		proxy.Shutdown(cfg.Proxy.ShutdownWait, cfg.Proxy.DrainTimeout)
+		tracer.Flush()
 		if prof != nil {
 			prof.Stop()
 		}
-		if registry.Default == nil {
+		if registry.Default == nil || upgrade.Completed() {
 			return
 		}
 		registry.Default.Deregister()
 	})
+	upgrade.Listen()
 
 	// init metrics early since that create the global metric registries
 	// that are used by other parts of the code.
 	initMetrics(cfg)
+	initTracing(cfg)
 	initRuntime(cfg)
 	initBackend(cfg)
 	startAdmin(cfg)
@@ -113,11 +126,12 @@ func main() {
 
 	// create proxies after metrics since they use the metrics registry.
 	startServers(cfg)
+	upgrade.Ready()
 	exit.Wait()
 	log.Print("[INFO] Down")
 }
 
-func newHTTPProxy(cfg *config.Config) http.Handler {
+func newHTTPProxy(cfg *config.Config, upstream *cert.Upstream) http.Handler {
 	var w io.Writer
 	switch cfg.Log.AccessTarget {
 	case "":
@@ -150,53 +164,49 @@ func newHTTPProxy(cfg *config.Config) http.Handler {
 	}
 
 	pick := route.Picker[cfg.Proxy.Strategy]
-	match := route.Matcher[cfg.Proxy.Matcher]
 	notFound := metrics.DefaultRegistry.GetCounter("notfound")
 	log.Printf("[INFO] Using routing strategy %q", cfg.Proxy.Strategy)
 	log.Printf("[INFO] Using route matching %q", cfg.Proxy.Matcher)
 
-	newTransport := func(tlscfg *tls.Config) *http.Transport {
-		return &http.Transport{
-			ResponseHeaderTimeout: cfg.Proxy.ResponseHeaderTimeout,
-			MaxIdleConnsPerHost:   cfg.Proxy.MaxConn,
-			Dial: (&net.Dialer{
-				Timeout:   cfg.Proxy.DialTimeout,
-				KeepAlive: cfg.Proxy.KeepAliveTimeout,
-			}).Dial,
-			TLSClientConfig: tlscfg,
-		}
+	pages, err := proxy.LoadErrorPages(cfg.Proxy.ErrorPages)
+	if err != nil {
+		exit.Fatal("[FATAL] Invalid error pages. ", err)
 	}
 
 	return &proxy.HTTPProxy{
 		Config:            cfg.Proxy,
-		Transport:         newTransport(nil),
-		InsecureTransport: newTransport(&tls.Config{InsecureSkipVerify: true}),
+		Transport:         proxy.NewTransport(cfg.Proxy, nil),
+		InsecureTransport: proxy.NewTransport(cfg.Proxy, &tls.Config{InsecureSkipVerify: true}),
+		UpstreamTLS:       upstream,
+		ErrorPages:        pages,
 		Lookup: func(r *http.Request) *route.Target {
-			t := route.GetTable().Lookup(r, r.Header.Get("trace"), pick, match)
+			t := route.Lookup(r, r.Header.Get("trace"), pick, cfg.Proxy.Matcher)
 			if t == nil {
 				notFound.Inc(1)
 				log.Print("[WARN] No route for ", r.Host, r.URL)
 			}
 			return t
 		},
-		Requests: metrics.DefaultRegistry.GetTimer("requests"),
-		Noroute:  metrics.DefaultRegistry.GetCounter("notfound"),
-		Logger:   l,
-		IAM:      aaa,
+		Requests:    metrics.DefaultRegistry.GetTimer("requests"),
+		Noroute:     metrics.DefaultRegistry.GetCounter("notfound"),
+		RateLimited: metrics.DefaultRegistry.GetCounter("ratelimited"),
+		WSConns:     metrics.DefaultRegistry.GetGauge("ws.conn"),
+		Logger:      l,
+		Tracer:      tracer,
+		IAM:         aaa,
 	}
 }
 
-func lookupHostFn(cfg *config.Config) func(string) string {
+func lookupHostFn(cfg *config.Config) func(string) *route.Target {
 	pick := route.Picker[cfg.Proxy.Strategy]
 	notFound := metrics.DefaultRegistry.GetCounter("notfound")
-	return func(host string) string {
-		t := route.GetTable().LookupHost(host, pick)
+	return func(host string) *route.Target {
+		t := route.LookupHost(host, pick)
 		if t == nil {
 			notFound.Inc(1)
 			log.Print("[WARN] No route for ", host)
-			return ""
 		}
-		return t.URL.Host
+		return t
 	}
 }
 
@@ -231,6 +241,8 @@ func startAdmin(cfg *config.Config) {
 			Version:  version,
 			Commands: route.Commands,
 			Cfg:      cfg,
+
+			ServiceConfig: func() string { return serviceConfig.Load().(string) },
 		}
 		if err := srv.ListenAndServe(l, tlscfg); err != nil {
 			exit.Fatal("[FATAL] ui: ", err)
@@ -239,6 +251,10 @@ func startAdmin(cfg *config.Config) {
 }
 
 func startServers(cfg *config.Config) {
+	// all listeners share the certificate sources
+	// for connections to upstream servers
+	upstream := &cert.Upstream{Sources: cfg.CertSources}
+	exit.Listen(func(os.Signal) { upstream.Close() })
 	for _, l := range cfg.Listen {
 		l := l // capture loop var for go routines below
 		tlscfg, err := makeTLSConfig(l)
@@ -254,14 +270,14 @@ func startServers(cfg *config.Config) {
 		switch l.Proto {
 		case "http", "https":
 			go func() {
-				h := newHTTPProxy(cfg)
+				h := newHTTPProxy(cfg, upstream)
 				if err := proxy.ListenAndServeHTTP(l, h, tlscfg); err != nil {
 					exit.Fatal("[FATAL] ", err)
 				}
 			}()
 		case "tcp":
 			go func() {
-				h := &tcp.Proxy{cfg.Proxy.DialTimeout, lookupHostFn(cfg)}
+				h := &tcp.Proxy{cfg.Proxy.DialTimeout, lookupHostFn(cfg), upstream}
 				if err := proxy.ListenAndServeTCP(l, h, tlscfg); err != nil {
 					exit.Fatal("[FATAL] ", err)
 				}
@@ -294,6 +310,19 @@ func initMetrics(cfg *config.Config) {
 	}
 }
 
+func initTracing(cfg *config.Config) {
+	if cfg.Tracing.Target == "" {
+		log.Printf("[INFO] Tracing disabled")
+		return
+	}
+
+	var err error
+	if tracer, err = trace.New(cfg.Tracing); err != nil {
+		exit.Fatal("[FATAL] ", err)
+	}
+	log.Printf("[INFO] Sending traces to %s collector %s", cfg.Tracing.Target, cfg.Tracing.Collector)
+}
+
 func initRuntime(cfg *config.Config) {
 	if os.Getenv("GOGC") == "" {
 		log.Print("[INFO] Setting GOGC=", cfg.Runtime.GOGC)
@@ -344,6 +373,14 @@ func initBackend(cfg *config.Config) {
 	}
 }
 
+// serviceConfig stores the last routing config
+// generated from the registry.
+var serviceConfig atomic.Value
+
+func init() {
+	serviceConfig.Store("")
+}
+
 func watchBackend(cfg *config.Config, first chan bool) {
 	var (
 		last   string
@@ -356,20 +393,31 @@ func watchBackend(cfg *config.Config, first chan bool) {
 	svc := registry.Default.WatchServices()
 	man := registry.Default.WatchManual()
 
+	// shifts change the weights of the routing
+	// table without a change of the config.
+	shifts := time.NewTicker(time.Second)
+	defer shifts.Stop()
+
 	for {
+		var shifted bool
 		select {
 		case svccfg = <-svc:
+			serviceConfig.Store(svccfg)
 		case mancfg = <-man:
+		case <-shifts.C:
+			if shifted = route.Shifts.Tick(); !shifted {
+				continue
+			}
 		}
 
 		// manual config overrides service config
 		// order matters
 		next := svccfg + "\n" + mancfg
-		if next == last {
+		if next == last && !shifted {
 			continue
 		}
 
-		t, err := route.NewTable(next)
+		t, err := route.NewTableFrom(route.GetTable(), svccfg, mancfg)
 		if err != nil {
 			log.Printf("[WARN] %s", err)
 			continue
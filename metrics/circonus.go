@@ -89,6 +89,12 @@ func (m *cgmRegistry) GetCounter(name string) Counter {
 	return &cgmCounter{m.metrics, metricName}
 }
 
+// GetGauge returns a gauge for the given metric name.
+func (m *cgmRegistry) GetGauge(name string) Gauge {
+	metricName := fmt.Sprintf("%s`%s", m.prefix, name)
+	return &cgmGauge{m.metrics, metricName}
+}
+
 // GetTimer returns a timer for the given metric name.
 func (m *cgmRegistry) GetTimer(name string) Timer {
 	metricName := fmt.Sprintf("%s`%s", m.prefix, name)
@@ -105,6 +111,16 @@ func (c *cgmCounter) Inc(n int64) {
 	c.metrics.IncrementByValue(c.name, uint64(n))
 }
 
+type cgmGauge struct {
+	metrics *cgm.CirconusMetrics
+	name    string
+}
+
+// Update sets the gauge to n.
+func (g *cgmGauge) Update(n int64) {
+	g.metrics.SetGauge(g.name, n)
+}
+
 type cgmTimer struct {
 	metrics *cgm.CirconusMetrics
 	name    string
@@ -141,6 +141,12 @@ func TargetName(service, host, path string, targetURL *url.URL) (string, error)
 	return name.String(), nil
 }
 
+// RouteName returns the metrics name prefix for the metrics of the
+// route with the given host and path.
+func RouteName(host, path string) string {
+	return "route." + clean(host) + "." + clean(path)
+}
+
 // clean creates safe names for graphite reporting by replacing
 // some characters with underscores.
 // TODO(fs): This may need updating for other metrics backends.
@@ -25,6 +25,11 @@ type Registry interface {
 	// otherwise the existing metric should be returned.
 	GetCounter(name string) Counter
 
+	// GetGauge returns a gauge metric for the given name.
+	// If the metric does not exist yet it should be created
+	// otherwise the existing metric should be returned.
+	GetGauge(name string) Gauge
+
 	// GetTimer returns a timer metric for the given name.
 	// If the metric does not exist yet it should be created
 	// otherwise the existing metric should be returned.
@@ -37,6 +42,12 @@ type Counter interface {
 	Inc(n int64)
 }
 
+// Gauge defines a metric for a value which can go up and down.
+type Gauge interface {
+	// Update sets the gauge to 'n'.
+	Update(n int64)
+}
+
 // Timer defines a metric for counting and timing durations for events.
 type Timer interface {
 	// Percentile returns the nth percentile of the duration.
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fabiolb/fabio/route"
+)
+
+// isPreflight returns true if the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// servePreflight answers a CORS preflight request. Requests from origins
+// which are not allowed are rejected with 403 Forbidden. It returns the
+// response status.
+func servePreflight(w http.ResponseWriter, r *http.Request, c *route.CORS) int {
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if !c.AllowOrigin(origin) || !containsFold(c.Methods, method) {
+		w.WriteHeader(http.StatusForbidden)
+		return http.StatusForbidden
+	}
+
+	setAllowOrigin(h, origin, c)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+
+	reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+	switch {
+	case len(c.Headers) > 0:
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+	case reqHeaders != "":
+		h.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
+
+// addCORSHeaders removes the CORS headers of the upstream server and adds
+// the CORS headers of the route to the response of a request from an
+// allowed origin.
+func addCORSHeaders(h http.Header, origin string, c *route.CORS) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+	h.Add("Vary", "Origin")
+	if !c.AllowOrigin(origin) {
+		return
+	}
+	setAllowOrigin(h, origin, c)
+	if len(c.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+}
+
+// setAllowOrigin sets the Access-Control-Allow-Origin and
+// Access-Control-Allow-Credentials headers. A wildcard is only returned
+// for requests without credentials since browsers reject it otherwise.
+func setAllowOrigin(h http.Header, origin string, c *route.CORS) {
+	if c.AllowAll() && !c.Credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		h.Del("Access-Control-Allow-Credentials")
+	}
+}
+
+func containsFold(a []string, s string) bool {
+	for _, v := range a {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorPages contains the templates for the responses which the proxy
+// generates for errors. Templates are named '<status>.<ext>' or
+// 'default.<ext>' where ext is either 'html' or 'json'. Templates in
+// sub-directories are used for routes with the 'errorpages' option.
+type ErrorPages struct {
+	// pages contains the templates by '[<set>/]<name>.<ext>'
+	pages map[string]errorTemplate
+}
+
+type errorTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// errorData contains the fields which can be used in the templates.
+type errorData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	Host       string
+	Path       string
+	Method     string
+}
+
+var errorFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// LoadErrorPages loads the error page templates from the directory and
+// its sub-directories. It returns nil if dir is empty.
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ErrorPages{pages: map[string]errorTemplate{}}
+	if err := e.load(dir, ""); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		if err := e.load(filepath.Join(dir, f.Name()), f.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *ErrorPages) load(dir, set string) error {
+	for _, ext := range []string{"html", "json"} {
+		files, err := filepath.Glob(filepath.Join(dir, "*."+ext))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			name := filepath.Base(file)
+			var t errorTemplate
+			if ext == "html" {
+				t, err = htmltemplate.New(name).Funcs(htmltemplate.FuncMap(errorFuncs)).Parse(string(b))
+			} else {
+				t, err = texttemplate.New(name).Funcs(texttemplate.FuncMap(errorFuncs)).Parse(string(b))
+			}
+			if err != nil {
+				return err
+			}
+			e.pages[path.Join(set, name)] = t
+		}
+	}
+	return nil
+}
+
+// page returns the template for the status in the given format. The
+// templates of the set take precedence over the top level templates.
+func (e *ErrorPages) page(set string, status int, ext string) errorTemplate {
+	sets := []string{""}
+	if set != "" {
+		sets = []string{set, ""}
+	}
+	for _, s := range sets {
+		for _, name := range []string{strconv.Itoa(status), "default"} {
+			if t := e.pages[path.Join(s, name+"."+ext)]; t != nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// write sends the error page for the status. The format is chosen by
+// the Accept header of the request. If there is no template for the
+// preferred format the other one is used. Without a template or if e is
+// nil only the status code is sent.
+func (e *ErrorPages) write(w http.ResponseWriter, r *http.Request, u *url.URL, set string, status int, requestID string) {
+	if e == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	formats := []string{"html", "json"}
+	if quality(r.Header.Get("Accept"), "application/json") > quality(r.Header.Get("Accept"), "text/html") {
+		formats = []string{"json", "html"}
+	}
+
+	var t errorTemplate
+	var format string
+	for _, format = range formats {
+		if t = e.page(set, status, format); t != nil {
+			break
+		}
+	}
+	if t == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	data := &errorData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  requestID,
+		Host:       u.Host,
+		Path:       u.Path,
+		Method:     r.Method,
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		log.Printf("[ERROR] Cannot render error page for status %d. %s", status, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	contentType := "text/html; charset=utf-8"
+	if format == "json" {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
+// quality returns the quality value of the media type in the Accept
+// header. An exact match takes precedence over wildcards. The result
+// is 0 if the media type is not accepted.
+func quality(accept, mediaType string) float64 {
+	typ := mediaType[:strings.Index(mediaType, "/")]
+	exact, wildcard := -1.0, -1.0
+	for _, s := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mt {
+		case mediaType:
+			if q > exact {
+				exact = q
+			}
+		case typ + "/*", "*/*":
+			if q > wildcard {
+				wildcard = q
+			}
+		}
+	}
+	switch {
+	case exact >= 0:
+		return exact
+	case wildcard >= 0:
+		return wildcard
+	default:
+		return 0
+	}
+}
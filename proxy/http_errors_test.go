@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuality(t *testing.T) {
+	tests := []struct {
+		accept, mediaType string
+		q                 float64
+	}{
+		{"", "text/html", 0},
+		{"text/html", "text/html", 1},
+		{"text/html", "application/json", 0},
+		{"text/html;q=0.5, */*;q=0.8", "text/html", 0.5},
+		{"text/html;q=0.5, */*;q=0.8", "application/json", 0.8},
+		{"application/*;q=0.3", "application/json", 0.3},
+		{"application/json;q=x, text/html", "application/json", 0},
+	}
+	for i, tt := range tests {
+		if got, want := quality(tt.accept, tt.mediaType), tt.q; got != want {
+			t.Errorf("%d: got %v want %v", i, got, want)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"502.html":        `<p>{{.Status}} {{.StatusText}} {{.Host}}</p>`,
+		"default.html":    `<p>{{.Status}} {{.Path}}</p>`,
+		"default.json":    `{"status":{{.Status}},"id":{{json .RequestID}}}`,
+		"api/404.json":    `{"error":"not found","path":{{json .Path}}}`,
+		"api/ignored.txt": `foo`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		pages  *ErrorPages
+		accept string
+		set    string
+		status int
+		ctype  string
+		body   string
+	}{
+		{"no pages", nil, "", "", 502, "", ""},
+		{"status page", pages, "text/html", "", 502, "text/html; charset=utf-8", "<p>502 Bad Gateway example.com</p>"},
+		{"default page", pages, "", "", 503, "text/html; charset=utf-8", "<p>503 /a&lt;b</p>"},
+		{"json", pages, "application/json", "", 503, "application/json", `{"status":503,"id":"abc"}`},
+		{"json default page", pages, "application/json", "", 502, "application/json", `{"status":502,"id":"abc"}`},
+		{"route page", pages, "application/json", "api", 404, "application/json", `{"error":"not found","path":"/a\u003cb"}`},
+		{"route fallback", pages, "application/json", "api", 503, "application/json", `{"status":503,"id":"abc"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			u := &url.URL{Host: "example.com", Path: "/a<b"}
+
+			w := httptest.NewRecorder()
+			tt.pages.write(w, r, u, tt.set, tt.status, "abc")
+			if got, want := w.Code, tt.status; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			if got, want := w.Header().Get("Content-Type"), tt.ctype; got != want {
+				t.Fatalf("got content type %q want %q", got, want)
+			}
+			if got, want := w.Body.String(), tt.body; got != want {
+				t.Fatalf("got body %q want %q", got, want)
+			}
+		})
+	}
+
+	// invalid templates are rejected
+	if err := ioutil.WriteFile(filepath.Join(dir, "500.html"), []byte("{{.Status"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadErrorPages(dir); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
@@ -1,10 +1,16 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"time"
+
+	"github.com/fabiolb/fabio/trace"
 )
 
 func newHTTPProxy(target *url.URL, tr http.RoundTripper, flush time.Duration) http.Handler {
@@ -25,7 +31,39 @@ func newHTTPProxy(target *url.URL, tr http.RoundTripper, flush time.Duration) ht
 		},
 		FlushInterval: flush,
 		Transport:     &transport{tr, nil, nil},
+		ErrorHandler:  handleProxyError,
+	}
+}
+
+// handleProxyError responds with the status from proxyErrorStatus.
+func handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := proxyErrorStatus(r, err)
+	trace.FromContext(r.Context()).SetStatus(status)
+	w.WriteHeader(status)
+}
+
+// proxyErrorStatus logs the error and returns 504 Gateway Timeout when
+// the upstream request timed out, 413 Request Entity Too Large when the
+// request body exceeded the limit and 502 Bad Gateway for all other
+// errors.
+func proxyErrorStatus(r *http.Request, err error) int {
+	log.Printf("[ERROR] Proxy error for %s. %s", r.URL, err)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if isTimeout(r.Context(), err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func isTimeout(ctx context.Context, err error) bool {
+	if ctx.Err() == context.DeadlineExceeded {
+		return true
 	}
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
 }
 
 // transport executes the roundtrip and captures the response. It is not
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 
 	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
 )
 
 // addHeaders adds/updates headers in request
@@ -104,6 +107,171 @@ func addHeaders(r *http.Request, cfg config.Proxy, stripPath string) error {
 	return nil
 }
 
+// applyHeaderOps modifies the headers according to the header options
+// of a route. Variables in the header values are expanded with the vars
+// function.
+func applyHeaderOps(h http.Header, ops []route.HeaderOp, vars func(string) string) {
+	for _, op := range ops {
+		switch op.Action {
+		case "del":
+			h.Del(op.Name)
+		case "set":
+			h.Set(op.Name, os.Expand(op.Value, vars))
+		case "add":
+			h.Add(op.Name, os.Expand(op.Value, vars))
+		}
+	}
+}
+
+// addResponseHeaders adds the CORS headers and applies the response
+// header options of the route. The responses of the upstream server and
+// the responses of the proxy, e.g. error pages, pass through it.
+func addResponseHeaders(h http.Header, t *route.Target, origin string, vars func(string) string) {
+	if t.CORS != nil {
+		addCORSHeaders(h, origin, t.CORS)
+	}
+	applyHeaderOps(h, t.ResponseHeaders, vars)
+}
+
+// headerVars returns a function which expands the variables that can
+// be used in the values of the route header options. requestURL is the
+// URL of the incoming request since r.URL and r.Host may have been
+// modified for the upstream request.
+func headerVars(r *http.Request, requestURL *url.URL, cfg config.Proxy) func(string) string {
+	return func(name string) string {
+		switch name {
+		case "remote_addr":
+			return r.RemoteAddr
+		case "remote_host":
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			return host
+		case "remote_port":
+			_, port, _ := net.SplitHostPort(r.RemoteAddr)
+			return port
+		case "request_host":
+			return requestURL.Host
+		case "request_id":
+			if cfg.RequestID == "" {
+				return ""
+			}
+			return r.Header.Get(cfg.RequestID)
+		case "request_method":
+			return r.Method
+		case "request_scheme":
+			return requestURL.Scheme
+		case "request_uri":
+			return requestURL.RequestURI()
+		}
+		if strings.HasPrefix(name, "header.") {
+			return r.Header.Get(name[len("header."):])
+		}
+		return ""
+	}
+}
+
+// forwardingHeaders are the headers which proxies use to pass
+// information about the client to the upstream server.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// trustForwarded replaces the remote address of the request with the
+// address of the client and returns the address of the peer.
+//
+// If the peer is a trusted proxy the client is the first untrusted
+// address in the Forwarded or, if that is missing, the X-Forwarded-For
+// header from the right. The walk stops at an invalid or obfuscated
+// address and then uses the last trusted proxy. Otherwise, the peer is
+// the client and its forwarding headers are removed since they cannot
+// be trusted. The port of the client is 0 if the headers do not
+// contain it.
+//
+// The X-Real-Ip header is set to the ip address of the client.
+func trustForwarded(r *http.Request, trusted []*net.IPNet) (peer string) {
+	peer = r.RemoteAddr
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return peer
+	}
+	ip := net.ParseIP(host)
+
+	if !trustedIP(ip, trusted) {
+		for _, h := range forwardingHeaders {
+			r.Header.Del(h)
+		}
+	} else {
+		hops := forwardedHops(r.Header)
+		for i := len(hops) - 1; i >= 0; i-- {
+			hopIP, hopPort := parseHop(hops[i])
+			if hopIP == nil {
+				break
+			}
+			ip, port = hopIP, hopPort
+			if !trustedIP(ip, trusted) {
+				break
+			}
+		}
+	}
+
+	r.RemoteAddr = net.JoinHostPort(ip.String(), port)
+	r.Header.Set("X-Real-Ip", ip.String())
+	return peer
+}
+
+// trustedIP returns true if the ip address is in one of the networks.
+func trustedIP(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops returns the 'for' values of the Forwarded header or the
+// values of the X-Forwarded-For header in the order of the proxies.
+// The value is empty for elements of the Forwarded header without a
+// 'for' parameter.
+func forwardedHops(h http.Header) []string {
+	if fwd := h.Values("Forwarded"); len(fwd) > 0 {
+		var hops []string
+		for _, elem := range strings.Split(strings.Join(fwd, ","), ",") {
+			var hop string
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hop = v
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	if xff := h.Values("X-Forwarded-For"); len(xff) > 0 {
+		return strings.Split(strings.Join(xff, ","), ",")
+	}
+	return nil
+}
+
+// parseHop parses an address from a forwarding header which can be
+// quoted, have a port and have brackets around ipv6 addresses. The
+// port is 0 if the address does not have one.
+func parseHop(s string) (net.IP, string) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	port := "0"
+	if host, p, err := net.SplitHostPort(s); err == nil {
+		s, port = host, p
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	return net.ParseIP(s), port
+}
+
 var tlsver = map[uint16]string{
 	tls.VersionSSL30: "ssl30",
 	tls.VersionTLS10: "tls10",
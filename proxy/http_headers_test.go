@@ -3,6 +3,7 @@ package proxy
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"testing"
 
@@ -356,6 +357,102 @@ func TestAddHeaders(t *testing.T) {
 	}
 }
 
+func TestTrustForwarded(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	trusted := []*net.IPNet{private, v6}
+
+	tests := []struct {
+		desc   string
+		remote string
+		hdr    http.Header
+		addr   string
+		want   http.Header
+	}{
+		{
+			desc:   "untrusted peer without headers",
+			remote: "1.2.3.4:5555",
+			hdr:    http.Header{},
+			addr:   "1.2.3.4:5555",
+			want:   http.Header{"X-Real-Ip": {"1.2.3.4"}},
+		},
+		{
+			desc:   "untrusted peer with spoofed headers",
+			remote: "1.2.3.4:5555",
+			hdr: http.Header{
+				"Forwarded":         {"for=6.6.6.6"},
+				"X-Forwarded-For":   {"6.6.6.6"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Real-Ip":         {"6.6.6.6"},
+			},
+			addr: "1.2.3.4:5555",
+			want: http.Header{"X-Real-Ip": {"1.2.3.4"}},
+		},
+		{
+			desc:   "trusted peer without headers",
+			remote: "10.0.0.1:5555",
+			hdr:    http.Header{},
+			addr:   "10.0.0.1:5555",
+			want:   http.Header{"X-Real-Ip": {"10.0.0.1"}},
+		},
+		{
+			desc:   "trusted peer with x-forwarded-for",
+			remote: "10.0.0.1:5555",
+			hdr:    http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4", "10.0.0.2"}, "X-Real-Ip": {"6.6.6.6"}},
+			addr:   "1.2.3.4:0",
+			want:   http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4", "10.0.0.2"}, "X-Real-Ip": {"1.2.3.4"}},
+		},
+		{
+			desc:   "trusted peer with forwarded",
+			remote: "10.0.0.1:5555",
+			hdr: http.Header{
+				"Forwarded":       {`for=6.6.6.6, for="[2001:db8::1]:4711";proto=https, for=10.0.0.2;by=10.0.0.1`},
+				"X-Forwarded-For": {"7.7.7.7"},
+			},
+			addr: "6.6.6.6:0",
+			want: http.Header{
+				"Forwarded":       {`for=6.6.6.6, for="[2001:db8::1]:4711";proto=https, for=10.0.0.2;by=10.0.0.1`},
+				"X-Forwarded-For": {"7.7.7.7"},
+				"X-Real-Ip":       {"6.6.6.6"},
+			},
+		},
+		{
+			desc:   "trusted peer with port in forwarded",
+			remote: "10.0.0.1:5555",
+			hdr:    http.Header{"Forwarded": {`for="1.2.3.4:4711"`}},
+			addr:   "1.2.3.4:4711",
+			want:   http.Header{"Forwarded": {`for="1.2.3.4:4711"`}, "X-Real-Ip": {"1.2.3.4"}},
+		},
+		{
+			desc:   "trusted peer with obfuscated address",
+			remote: "10.0.0.1:5555",
+			hdr:    http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}},
+			addr:   "10.0.0.2:0",
+			want:   http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}, "X-Real-Ip": {"10.0.0.2"}},
+		},
+		{
+			desc:   "trusted peer with only trusted proxies",
+			remote: "10.0.0.1:5555",
+			hdr:    http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			addr:   "10.0.0.3:0",
+			want:   http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}, "X-Real-Ip": {"10.0.0.3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remote, Header: tt.hdr}
+			if got, want := trustForwarded(r, trusted), tt.remote; got != want {
+				t.Fatalf("got peer %q want %q", got, want)
+			}
+			if got, want := r.RemoteAddr, tt.addr; got != want {
+				t.Fatalf("got remote addr %q want %q", got, want)
+			}
+			verify.Values(t, "", r.Header, tt.want)
+		})
+	}
+}
+
 func TestLocalPort(t *testing.T) {
 	tests := []struct {
 		r    *http.Request
@@ -398,4 +495,5 @@ func BenchmarkUint16Base16(b *testing.B) {
 			s = uint16base16(uint16(i))
 		}
 	})
+	_ = s
 }
@@ -5,24 +5,31 @@ import (
 	"compress/gzip"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/fabiolb/fabio/cert"
 	"github.com/fabiolb/fabio/config"
 	"github.com/fabiolb/fabio/logger"
 	"github.com/fabiolb/fabio/proxy/internal"
+	"github.com/fabiolb/fabio/proxy/tcp/tcptest"
 	"github.com/fabiolb/fabio/route"
+	"github.com/fabiolb/fabio/trace"
 	"github.com/pascaldekloe/goe/verify"
+	"golang.org/x/net/http2"
 )
 
 func TestProxyProducesCorrectXffHeader(t *testing.T) {
@@ -50,6 +57,92 @@ func TestProxyProducesCorrectXffHeader(t *testing.T) {
 	}
 }
 
+func TestProxyTrustedProxies(t *testing.T) {
+	var gotXFF, gotRealIP string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF, gotRealIP = r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-Ip")
+	}))
+	defer server.Close()
+
+	tbl, _ := route.NewTable("route add mock / " + server.URL + ` opts "ratelimit=1/m burst=1"`)
+
+	newProxy := func(trusted string, w io.Writer) *httptest.Server {
+		_, n, _ := net.ParseCIDR(trusted)
+		l, err := logger.New(w, "$response_status $remote_host")
+		if err != nil {
+			t.Fatal("logger.New: ", err)
+		}
+		return httptest.NewServer(&HTTPProxy{
+			Config:    config.Proxy{TrustedProxies: []*net.IPNet{n}},
+			Transport: http.DefaultTransport,
+			Lookup: func(r *http.Request) *route.Target {
+				return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+			},
+			Logger: l,
+		})
+	}
+
+	do := func(proxy *httptest.Server, xff string) int {
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Header.Set("X-Forwarded-For", xff)
+		req.Header.Set("X-Real-Ip", "6.6.6.6")
+		resp, _ := mustDo(req)
+		return resp.StatusCode
+	}
+
+	t.Run("trusted peer", func(t *testing.T) {
+		var b bytes.Buffer
+		proxy := newProxy("127.0.0.0/8", &b)
+		defer proxy.Close()
+
+		if got, want := do(proxy, "6.6.6.6, 3.3.3.3"), 200; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+		if got, want := gotXFF, "6.6.6.6, 3.3.3.3, 127.0.0.1"; got != want {
+			t.Fatalf("got X-Forwarded-For %q want %q", got, want)
+		}
+		if got, want := gotRealIP, "3.3.3.3"; got != want {
+			t.Fatalf("got X-Real-Ip %q want %q", got, want)
+		}
+
+		// the rate limit applies to the client and not to the proxy
+		if got, want := do(proxy, "3.3.3.3"), 429; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+		if got, want := do(proxy, "4.4.4.4"), 200; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+		if got, want := b.String(), "200 3.3.3.3\n429 3.3.3.3\n200 4.4.4.4\n"; got != want {
+			t.Fatalf("got access log %q want %q", got, want)
+		}
+	})
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		var b bytes.Buffer
+		proxy := newProxy("10.0.0.0/8", &b)
+		defer proxy.Close()
+
+		// start with a fresh rate limiter for the peer
+		tbl, _ = route.NewTable("route add mock / " + server.URL + ` opts "ratelimit=1/m burst=1"`)
+
+		if got, want := do(proxy, "5.5.5.5"), 200; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+		if got, want := gotXFF, "127.0.0.1"; got != want {
+			t.Fatalf("got X-Forwarded-For %q want %q", got, want)
+		}
+		if got, want := gotRealIP, "127.0.0.1"; got != want {
+			t.Fatalf("got X-Real-Ip %q want %q", got, want)
+		}
+		if got, want := do(proxy, "7.7.7.7"), 429; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+		if got, want := b.String(), "200 127.0.0.1\n429 127.0.0.1\n"; got != want {
+			t.Fatalf("got access log %q want %q", got, want)
+		}
+	})
+}
+
 func TestProxyRequestIDHeader(t *testing.T) {
 	got := "not called"
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -117,6 +210,657 @@ func TestProxyStripsPath(t *testing.T) {
 	}
 }
 
+func TestProxyHeaderOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		w.Header().Set("X-Client", r.Header.Get("X-Client"))
+		w.Header().Set("X-Request", r.Header.Get("X-Request"))
+		w.Header().Set("X-Secret", r.Header.Get("X-Secret"))
+	}))
+	defer server.Close()
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Config:    config.Proxy{RequestID: "X-Request-Id"},
+		Transport: http.DefaultTransport,
+		UUID:      func() string { return "f47ac10b-58cc-0372-8567-0e02b2c3d479" },
+		Lookup: func(r *http.Request) *route.Target {
+			opts := "reqhdr.del=X-Secret reqhdr.set.X-Client=$remote_host reqhdr.set.X-Request=${request_id}@$request_host " +
+				"resphdr.del=Server resphdr.set.Strict-Transport-Security=max-age=31536000;%20includeSubDomains"
+			tbl, _ := route.NewTable("route add mock / " + server.URL + ` opts "` + opts + `"`)
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Header.Set("X-Secret", "secret")
+	resp, _ := mustDo(req)
+
+	host := proxy.URL[len("http://"):]
+	want := map[string]string{
+		"Server":                    "",
+		"X-Client":                  "127.0.0.1",
+		"X-Request":                 "f47ac10b-58cc-0372-8567-0e02b2c3d479@" + host,
+		"X-Secret":                  "",
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+	}
+	for k, v := range want {
+		if got := resp.Header.Get(k); got != v {
+			t.Errorf("%s: got %q want %q", k, got, v)
+		}
+	}
+}
+
+func TestProxyHeaderOptionsOnProxyResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// upstream which is not listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	opts := "resphdr.set.X-Route=mock cors.origins=https://example.com"
+	routes := "route add mock /down http://" + down + ` opts "` + opts + `"` + "\n"
+	routes += "route add mock /limited " + server.URL + ` opts "` + opts + ` ratelimit=1/m burst=1"`
+	tbl, _ := route.NewTable(routes)
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	do := func(path string) *http.Response {
+		req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		req.Header.Set("Origin", "https://example.com")
+		resp, _ := mustDo(req)
+		return resp
+	}
+
+	// use up the burst of the rate limit
+	do("/limited")
+	for path, status := range map[string]int{"/down": 502, "/limited": 429} {
+		resp := do(path)
+		if got, want := resp.StatusCode, status; got != want {
+			t.Fatalf("%s: got status %d want %d", path, got, want)
+		}
+		want := map[string]string{
+			"X-Route":                     "mock",
+			"Access-Control-Allow-Origin": "https://example.com",
+			"Vary":                        "Origin",
+		}
+		for k, v := range want {
+			if got := resp.Header.Get(k); got != v {
+				t.Errorf("%s: %s: got %q want %q", path, k, got, v)
+			}
+		}
+	}
+}
+
+func TestProxyRouteTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("sleep"))
+		time.Sleep(d)
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	routes := "route add mock /total " + server.URL + ` opts "timeout=50ms"` + "\n"
+	routes += "route add mock /header " + server.URL + ` opts "responsetimeout=50ms"` + "\n"
+	routes += "route add mock / " + server.URL
+	tbl, _ := route.NewTable(routes)
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/total?sleep=0s", http.StatusOK},
+		{"/total?sleep=200ms", http.StatusGatewayTimeout},
+		{"/header?sleep=0s", http.StatusOK},
+		{"/header?sleep=200ms", http.StatusGatewayTimeout},
+		{"/?sleep=200ms", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		resp, _ := mustGet(proxy.URL + tt.path)
+		if got, want := resp.StatusCode, tt.status; got != want {
+			t.Errorf("%s: got status %d want %d", tt.path, got, want)
+		}
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tbl, _ := route.NewTable("route add mock / " + server.URL + ` opts "ratelimit=1/m burst=2 key=header:X-Api-Key"`)
+
+	var b bytes.Buffer
+	l, err := logger.New(&b, "$response_status $header.X-Api-Key")
+	if err != nil {
+		t.Fatal("logger.New: ", err)
+	}
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+		Logger: l,
+	})
+	defer proxy.Close()
+
+	do := func(apiKey string) *http.Response {
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		resp, _ := mustDo(req)
+		return resp
+	}
+
+	for i, want := range []int{200, 200, 429} {
+		if got := do("a").StatusCode; got != want {
+			t.Fatalf("request %d: got status %d want %d", i, got, want)
+		}
+	}
+
+	resp := do("a")
+	if got, want := resp.Header.Get("Retry-After"), "60"; got != want {
+		t.Fatalf("got Retry-After %q want %q", got, want)
+	}
+
+	// different key has its own bucket
+	if got, want := do("b").StatusCode, 200; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+
+	if got, want := b.String(), "200 a\n200 a\n429 a\n429 a\n200 b\n"; got != want {
+		t.Fatalf("got log %q want %q", got, want)
+	}
+}
+
+func TestProxyMaxConns(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+	defer server.Close()
+
+	tbl, _ := route.NewTable("route add mock / " + server.URL + ` opts "maxconns=1 maxqueue=1"`)
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	status := make(chan int, 2)
+	get := func() {
+		resp, _ := mustGet(proxy.URL)
+		status <- resp.StatusCode
+	}
+
+	// first request is active and the second one is queued
+	go get()
+	<-started
+	go get()
+	lim := tbl.Lookup(&http.Request{Host: "foo", URL: &url.URL{Path: "/"}}, "", route.Picker["rr"], route.Matcher["prefix"]).ConnLimiter
+	for lim.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is full
+	if resp, _ := mustGet(proxy.URL); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	release <- true
+	<-started
+	release <- true
+	for i := 0; i < 2; i++ {
+		if got, want := <-status, http.StatusOK; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+	}
+	if got, want := lim.Active(), 0; got != want {
+		t.Fatalf("got %d active want %d", got, want)
+	}
+}
+
+func TestProxyMaxBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	routes := "route add mock /upload " + server.URL + ` opts "maxbody=1KB"` + "\n"
+	routes += "route add mock / " + server.URL
+	tbl, _ := route.NewTable(routes)
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Config:    config.Proxy{MaxBody: 10},
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	tests := []struct {
+		desc    string
+		path    string
+		size    int
+		chunked bool
+		status  int
+	}{
+		{"small body", "/", 10, false, http.StatusOK},
+		{"large body", "/", 11, false, http.StatusRequestEntityTooLarge},
+		{"large chunked body", "/", 100, true, http.StatusRequestEntityTooLarge},
+		{"route limit", "/upload", 1024, false, http.StatusOK},
+		{"large body over route limit", "/upload", 1025, false, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(make([]byte, tt.size))
+			if tt.chunked {
+				// hide the length from the http client
+				body = ioutil.NopCloser(body)
+			}
+			req, _ := http.NewRequest("POST", proxy.URL+tt.path, body)
+			resp, _ := mustDo(req)
+			if got, want := resp.StatusCode, tt.status; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestProxyCORS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.com")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Upstream")
+		fmt.Fprint(w, r.Method)
+	}))
+	defer server.Close()
+
+	opts := "cors.origins=https://*.example.com cors.methods=GET,PUT cors.credentials=true cors.maxage=1m cors.expose=X-Total"
+	tbl, _ := route.NewTable("route add mock / " + server.URL + ` opts "` + opts + `"`)
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	tests := []struct {
+		desc   string
+		method string
+		hdr    map[string]string
+		status int
+		body   string
+		want   map[string]string
+	}{
+		{
+			desc:   "preflight",
+			method: "OPTIONS",
+			hdr: map[string]string{
+				"Origin":                         "https://www.example.com",
+				"Access-Control-Request-Method":  "PUT",
+				"Access-Control-Request-Headers": "X-Foo",
+			},
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://www.example.com",
+				"Access-Control-Allow-Methods":     "GET, PUT",
+				"Access-Control-Allow-Headers":     "X-Foo",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "60",
+			},
+		},
+		{
+			desc:   "preflight with invalid origin",
+			method: "OPTIONS",
+			hdr: map[string]string{
+				"Origin":                        "https://www.other.com",
+				"Access-Control-Request-Method": "PUT",
+			},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			desc:   "preflight with invalid method",
+			method: "OPTIONS",
+			hdr: map[string]string{
+				"Origin":                        "https://www.example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			desc:   "options without preflight headers is proxied",
+			method: "OPTIONS",
+			status: http.StatusOK,
+			body:   "OPTIONS",
+		},
+		{
+			desc:   "proxied request",
+			method: "GET",
+			hdr:    map[string]string{"Origin": "https://www.example.com"},
+			status: http.StatusOK,
+			body:   "GET",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://www.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Total",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			desc:   "proxied request with invalid origin",
+			method: "GET",
+			hdr:    map[string]string{"Origin": "https://www.other.com"},
+			status: http.StatusOK,
+			body:   "GET",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "",
+				"Vary":                             "Origin",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, proxy.URL, nil)
+			for k, v := range tt.hdr {
+				req.Header.Set(k, v)
+			}
+			resp, body := mustDo(req)
+			if got, want := resp.StatusCode, tt.status; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			if got, want := string(body), tt.body; got != want {
+				t.Fatalf("got body %q want %q", got, want)
+			}
+			for k, v := range tt.want {
+				if got := resp.Header.Get(k); got != v {
+					t.Errorf("%s: got %q want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyGRPCUpstream(t *testing.T) {
+	// h2c upstream server which answers like a gRPC service
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h2s := &http2.Server{}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		fmt.Fprint(w, "msg")
+		w.Header().Set("Grpc-Status", "5")
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h2s.ServeConn(c, &http2.ServeConnOpts{Handler: h})
+		}
+	}()
+
+	var b bytes.Buffer
+	lg, err := logger.New(&b, "$response_status $response_grpc_status")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return &route.Target{URL: mustParse("http://" + l.Addr().String()), Proto: "grpc"}
+		},
+		Logger: lg,
+	})
+
+	resp, body := mustGet(proxy.URL)
+	proxy.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := string(body), "msg"; got != want {
+		t.Fatalf("got body %q want %q", got, want)
+	}
+	if got, want := resp.Trailer.Get("Grpc-Status"), "5"; got != want {
+		t.Fatalf("got trailer %q want %q", got, want)
+	}
+	if got, want := b.String(), "200 5\n"; got != want {
+		t.Fatalf("got log %q want %q", got, want)
+	}
+}
+
+func TestProxyErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "default.html"), []byte("{{.Status}} {{.RequestID}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream which is not listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Config:     config.Proxy{NoRouteStatus: 404, RequestID: "X-Request-Id"},
+		Transport:  http.DefaultTransport,
+		ErrorPages: pages,
+		UUID:       func() string { return "abc" },
+		Lookup: func(r *http.Request) *route.Target {
+			if r.URL.Path == "/noroute" {
+				return nil
+			}
+			return &route.Target{URL: mustParse("http://" + addr)}
+		},
+	})
+	defer proxy.Close()
+
+	for path, body := range map[string]string{"/noroute": "404 abc", "/down": "502 abc"} {
+		_, got := mustGet(proxy.URL + path)
+		if string(got) != body {
+			t.Errorf("%s: got body %q want %q", path, got, body)
+		}
+	}
+}
+
+func TestProxyTracing(t *testing.T) {
+	spans := make(chan []map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			t.Error(err)
+		}
+		spans <- v
+	}))
+	defer collector.Close()
+
+	tracer, err := trace.New(config.Tracing{
+		Target:      "zipkin",
+		Collector:   collector.URL,
+		ServiceName: "fabio",
+		SampleRate:  1,
+		Propagation: []string{"w3c"},
+		BatchSize:   10,
+		Interval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(201)
+	}))
+	defer server.Close()
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Tracer:    tracer,
+		Lookup: func(r *http.Request) *route.Target {
+			return &route.Target{Service: "svc", Route: "/foo", URL: mustParse(server.URL)}
+		},
+	})
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/foo", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	tracer.Flush()
+
+	got := <-spans
+	if len(got) != 2 {
+		t.Fatalf("got %d spans want 2", len(got))
+	}
+	client, srv := got[0], got[1]
+	if got, want := srv["parentId"], "00f067aa0ba902b7"; got != want {
+		t.Fatalf("got server parent %v want %v", got, want)
+	}
+	if got, want := client["parentId"], srv["id"]; got != want {
+		t.Fatalf("got client parent %v want %v", got, want)
+	}
+	if got, want := srv["name"], "GET /foo"; got != want {
+		t.Fatalf("got name %v want %v", got, want)
+	}
+	tags := srv["tags"].(map[string]interface{})
+	if tags["fabio.service"] != "svc" || tags["fabio.route"] != "/foo" || tags["http.status_code"] != "201" {
+		t.Fatalf("got tags %v", tags)
+	}
+
+	// the upstream server is a child of the client span
+	if got, want := traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+client["id"].(string)+"-01"; got != want {
+		t.Fatalf("got traceparent %q want %q", got, want)
+	}
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstreamSock := filepath.Join(dir, "upstream.sock")
+	proxySock := filepath.Join(dir, "fabio.sock")
+
+	// upstream server on a unix socket
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Host, r.Header.Get("X-Real-Ip"), r.URL.Path)
+	}))
+	ul, err := net.Listen("unix", upstreamSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener = ul
+	server.Start()
+	defer server.Close()
+
+	// stale socket file from a previous run
+	sl, err := net.Listen("unix", proxySock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl.Close()
+
+	tbl, _ := route.NewTable("route add svc / unix://" + upstreamSock)
+	go func() {
+		h := &HTTPProxy{
+			Transport: http.DefaultTransport,
+			Lookup: func(r *http.Request) *route.Target {
+				return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+			},
+		}
+		l := config.Listen{Addr: "unix:" + proxySock, ProxyProto: "required"}
+		if err := ListenAndServeHTTP(l, h, nil); err != nil {
+			t.Log("ListenAndServeHTTP: ", err)
+		}
+	}()
+	defer Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				c, err := tcptest.NewRetryDialer().Dial("unix", proxySock)
+				if err != nil {
+					return nil, err
+				}
+				_, err = c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"))
+				return c, err
+			},
+		},
+	}
+	resp, err := client.Get("http://example.com/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := resp.StatusCode, 200; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := string(body), "example.com 1.2.3.4 /foo"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
 //	TestProxyHost
 func TestProxyHost(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -231,6 +975,7 @@ func TestProxyLogOutput(t *testing.T) {
 		"request_uri:/foo?x=y",
 		"request_url:http://example.com/foo?x=y",
 		"response_body_size:3",
+		"response_grpc_status:",
 		"response_status:200",
 		"response_time_ms:1.111",
 		"response_time_ns:1.111111111",
@@ -313,6 +1058,94 @@ func TestProxyHTTPSUpstreamSkipVerify(t *testing.T) {
 	}
 }
 
+func TestProxyHTTPSUpstreamTLSOptions(t *testing.T) {
+	// the upstream server responds with the server name
+	// and the name of the client certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.ServerName, ",", r.TLS.PeerCertificates[0].DNSNames[0])
+	}))
+	server.TLS = tlsServerConfig()
+	server.TLS.ClientAuth = tls.RequireAnyClientCert
+	server.StartTLS()
+	defer server.Close()
+
+	upstream, cleanup := testUpstreamTLS(t)
+	defer cleanup()
+
+	tests := []struct {
+		desc   string
+		opts   string
+		host   string
+		status int
+		body   string
+	}{
+		{"client cert", "tlsca=up tlscert=up", "", 200, ",example.com"},
+		{"server name", "tlsca=up tlscert=up tlsservername=example.com", "", 200, "example.com,example.com"},
+		{"wrong server name", "tlsca=up tlscert=up tlsservername=foo.com", "", 502, ""},
+		{"no client cert", "tlsca=up", "", 502, ""},
+		{"unknown cert source", "tlsca=down tlscert=up", "", 502, ""},
+		{"sni", "tlsca=up tlscert=up sni=foo.com tlsservername=example.com", "", 200, "foo.com,example.com"},
+		{"sni without server name", "tlsca=up tlscert=up sni=foo.com", "", 502, ""},
+		{"sni host", "tlsca=up tlscert=up sni=host tlsservername=example.com", "Www.Example.com:1234", 200, "www.example.com,example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			proxy := httptest.NewServer(&HTTPProxy{
+				Transport:   http.DefaultTransport,
+				UpstreamTLS: upstream,
+				Lookup: func(r *http.Request) *route.Target {
+					tbl, _ := route.NewTable("route add srv / " + server.URL + ` opts "proto=https ` + tt.opts + `"`)
+					return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+				},
+			})
+			defer proxy.Close()
+
+			req, _ := http.NewRequest("GET", proxy.URL, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			resp, body := mustDo(req)
+			if got, want := resp.StatusCode, tt.status; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			if got, want := string(body), tt.body; got != want {
+				t.Fatalf("got body %q want %q", got, want)
+			}
+		})
+	}
+}
+
+// testUpstreamTLS returns the certificate source 'up' with
+// the test certificate as client certificate and CA bundle.
+func testUpstreamTLS(t *testing.T) (u *cert.Upstream, cleanup func()) {
+	dir, err := ioutil.TempDir("", "fabio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"cert/localhost-cert.pem": internal.LocalhostCert,
+		"cert/localhost-key.pem":  internal.LocalhostKey,
+		"upstreamca/ca.pem":       internal.LocalhostCert,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u = &cert.Upstream{Sources: map[string]config.CertSource{
+		"up": config.CertSource{Name: "up", Type: "path", CertPath: filepath.Join(dir, "cert"), UpstreamCAPath: filepath.Join(dir, "upstreamca")},
+	}}
+	return u, func() {
+		u.Close()
+		os.RemoveAll(dir)
+	}
+}
+
 func TestProxyGzipHandler(t *testing.T) {
 	tests := []struct {
 		desc            string
@@ -488,6 +1321,7 @@ func BenchmarkProxyLogger(b *testing.B) {
 		got = r.Header.Get("X-Forwarded-For")
 	}))
 	defer server.Close()
+	_ = got
 
 	format := "remote_addr time request body_bytes_sent http_referer http_user_agent server_name proxy_endpoint response_time request_args "
 	l, err := logger.New(os.Stdout, format)
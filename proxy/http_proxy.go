@@ -1,21 +1,27 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fabiolb/fabio/cert"
 	"github.com/fabiolb/fabio/config"
 	"github.com/fabiolb/fabio/iam"
 	"github.com/fabiolb/fabio/logger"
 	"github.com/fabiolb/fabio/metrics"
 	"github.com/fabiolb/fabio/proxy/gzip"
 	"github.com/fabiolb/fabio/route"
+	"github.com/fabiolb/fabio/trace"
 	"github.com/fabiolb/fabio/uuid"
 )
 
@@ -37,6 +43,14 @@ type HTTPProxy struct {
 	// self-signed certs.
 	InsecureTransport http.RoundTripper
 
+	// UpstreamTLS provides the CA bundles and client certificates
+	// for targets with the 'tlsca' and 'tlscert' route options.
+	UpstreamTLS *cert.Upstream
+
+	// ErrorPages contains the templates for the error responses
+	// of the proxy. The responses have no body if it is nil.
+	ErrorPages *ErrorPages
+
 	// Lookup returns a target host for the given request.
 	// The proxy will panic if this value is nil.
 	Lookup func(*http.Request) *route.Target
@@ -48,6 +62,14 @@ type HTTPProxy struct {
 	// where Lookup() returns nil.
 	Noroute metrics.Counter
 
+	// RateLimited is a counter metric which is updated for every
+	// request which was rejected by the rate limiter of a route.
+	RateLimited metrics.Counter
+
+	// WSConns is a gauge metric with the number of open websocket
+	// sessions.
+	WSConns metrics.Gauge
+
 	// Logger is the access logger for the requests.
 	Logger logger.Logger
 
@@ -55,9 +77,22 @@ type HTTPProxy struct {
 	// If UUID is nil, uuid.NewUUID() is used.
 	UUID func() string
 
+	// Tracer creates the spans for the requests. Tracing is
+	// disabled if it is nil.
+	Tracer *trace.Tracer
+
 	// IAM performs identity and access management for a given request.  It is disabled if set
 	// to nil
 	IAM iam.IAM
+
+	// wsActive is the number of open websocket sessions.
+	wsActive atomic.Int64
+
+	// mu guards transports and hostTransports which contain the
+	// connection pools for targets with route specific settings.
+	mu             sync.Mutex
+	transports     map[transportKey]http.RoundTripper
+	hostTransports *transportCache
 }
 
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -65,9 +100,78 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic("no lookup function")
 	}
 
+	// from here on the remote address of the request is the address
+	// of the client which can differ from the address of the peer if
+	// the request was forwarded by a trusted proxy.
+	peer := r.RemoteAddr
+	if len(p.Config.TrustedProxies) > 0 {
+		peer = trustForwarded(r, p.Config.TrustedProxies)
+	}
+
+	// build the request url since r.URL will get modified
+	// by the reverse proxy and contains only the RequestURI anyway
+	requestURL := &url.URL{
+		Scheme:   scheme(r),
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+
+	// set the request id before the lookup so that
+	// it is available for the error pages
+	if p.Config.RequestID != "" {
+		id := p.UUID
+		if id == nil {
+			id = uuid.NewUUID
+		}
+		r.Header.Set(p.Config.RequestID, id())
+	}
+
+	// join or start the trace before the lookup so that
+	// rejected requests are traced as well
+	span := p.Tracer.StartServer(r.Method, r.Header)
+	if span != nil {
+		defer span.Finish()
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.scheme", requestURL.Scheme)
+		span.SetAttr("http.host", requestURL.Host)
+		span.SetAttr("http.target", requestURL.Path)
+		r = r.WithContext(trace.NewContext(r.Context(), span))
+	}
+
 	t := p.Lookup(r)
 	if t == nil {
-		w.WriteHeader(p.Config.NoRouteStatus)
+		p.writeError(w, r, requestURL, nil, p.Config.NoRouteStatus)
+		return
+	}
+
+	if span != nil {
+		span.Name = r.Method + " " + t.Route
+		span.SetAttr("fabio.route", t.Route)
+		span.SetAttr("fabio.service", t.Service)
+	}
+
+	timeNow := p.Time
+	if timeNow == nil {
+		timeNow = time.Now
+	}
+
+	if t.RateLimiter != nil {
+		if ok, retry := t.RateLimiter.Allow(rateLimitKey(r, t.RateLimitKey)); !ok {
+			if p.RateLimited != nil {
+				p.RateLimited.Inc(1)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			p.writeError(w, r, requestURL, t, http.StatusTooManyRequests)
+			p.logRejected(r, requestURL, t, http.StatusTooManyRequests, timeNow())
+			return
+		}
+	}
+
+	if t.CORS != nil && isPreflight(r) {
+		applyHeaderOps(w.Header(), t.ResponseHeaders, headerVars(r, requestURL, p.Config))
+		status := servePreflight(w, r, t.CORS)
+		p.logRejected(r, requestURL, t, status, timeNow())
 		return
 	}
 
@@ -76,24 +180,28 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if t.AuthEnabled && p.IAM != nil {
 		data, err := p.IAM.Authenticate(r)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			p.writeError(w, r, requestURL, t, http.StatusUnauthorized)
 			return
 		}
 		// This may augment the original request with additional data if authorization is
 		// successful.
 		if err := p.IAM.Authorize(r, data); err != nil {
-			w.WriteHeader(http.StatusForbidden)
+			p.writeError(w, r, requestURL, t, http.StatusForbidden)
 			return
 		}
 	}
 
-	// build the request url since r.URL will get modified
-	// by the reverse proxy and contains only the RequestURI anyway
-	requestURL := &url.URL{
-		Scheme:   scheme(r),
-		Host:     r.Host,
-		Path:     r.URL.Path,
-		RawQuery: r.URL.RawQuery,
+	maxBody := p.Config.MaxBody
+	if t.MaxBody > 0 {
+		maxBody = t.MaxBody
+	}
+	if maxBody > 0 && r.Body != nil {
+		if r.ContentLength > maxBody {
+			p.writeError(w, r, requestURL, t, http.StatusRequestEntityTooLarge)
+			p.logRejected(r, requestURL, t, http.StatusRequestEntityTooLarge, timeNow())
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
 	}
 
 	// build the real target url that is passed to the proxy
@@ -107,6 +215,13 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		targetURL.RawQuery = t.URL.RawQuery + "&" + r.URL.RawQuery
 	}
+	upstreamAddr := targetURL.Host
+	if t.Socket != "" {
+		// requests to unix sockets are plain HTTP requests. The
+		// connection pool of the target dials the socket.
+		targetURL.Scheme, targetURL.Host = "http", "localhost"
+		upstreamAddr = "unix:" + t.Socket
+	}
 
 	if t.Host == "dst" {
 		r.Host = targetURL.Host
@@ -125,52 +240,150 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if p.Config.RequestID != "" {
-		id := p.UUID
-		if id == nil {
-			id = uuid.NewUUID
-		}
-		r.Header.Set(p.Config.RequestID, id())
+	vars := headerVars(r, requestURL, p.Config)
+	if len(t.RequestHeaders) > 0 {
+		applyHeaderOps(r.Header, t.RequestHeaders, vars)
 	}
 
 	upgrade, accept := r.Header.Get("Upgrade"), r.Header.Get("Accept")
 
-	tr := p.Transport
-	if t.TLSSkipVerify {
-		tr = p.InsecureTransport
+	tr := p.transport(t, requestURL.Host)
+
+	dialer := &net.Dialer{Timeout: p.Config.DialTimeout}
+	if t.DialTimeout > 0 {
+		dialer.Timeout = t.DialTimeout
+	}
+
+	idleTimeout := p.Config.WSIdleTimeout
+	if t.WSIdleTimeout > 0 {
+		idleTimeout = t.WSIdleTimeout
 	}
 
+	origin := r.Header.Get("Origin")
+	respHeaders := len(t.ResponseHeaders) > 0 || t.CORS != nil
+
 	var h http.Handler
+	var raw *rawProxy
 	switch {
 	case upgrade == "websocket" || upgrade == "Websocket":
-		if targetURL.Scheme == "https" || targetURL.Scheme == "wss" {
-			h = newRawProxy(targetURL, func(network, address string) (net.Conn, error) {
-				return tls.Dial(network, address, tr.(*http.Transport).TLSClientConfig)
-			})
-		} else {
-			h = newRawProxy(targetURL, net.Dial)
+		htr, _ := tr.(*http.Transport)
+		switch {
+		case t.Socket != "":
+			raw = newRawProxy(targetURL, func(network, address string) (net.Conn, error) {
+				return dialer.Dial("unix", t.Socket)
+			}, idleTimeout)
+		case targetURL.Scheme != "https" && targetURL.Scheme != "wss":
+			raw = newRawProxy(targetURL, dialer.Dial, idleTimeout)
+		case htr == nil:
+			// the HTTP/2 connection pools of h2c and grpc
+			// routes cannot dial TLS websocket connections.
+			p.writeError(w, r, requestURL, t, http.StatusBadGateway)
+			p.logRejected(r, requestURL, t, http.StatusBadGateway, timeNow())
+			return
+		case htr.DialTLS != nil:
+			// route specific upstream TLS settings
+			raw = newRawProxy(targetURL, htr.DialTLS, idleTimeout)
+		default:
+			raw = newRawProxy(targetURL, func(network, address string) (net.Conn, error) {
+				return tls.DialWithDialer(dialer, network, address, htr.TLSClientConfig)
+			}, idleTimeout)
 		}
+		if respHeaders {
+			raw.header = func(h http.Header) { addResponseHeaders(h, t, origin, vars) }
+		}
+		h = raw
 
 	case accept == "text/event-stream":
 		// use the flush interval for SSE (server-sent events)
 		// must be > 0s to be effective
 		h = newHTTPProxy(targetURL, tr, p.Config.FlushInterval)
 
+	case t.Proto != "":
+		// flush immediately since gRPC and other HTTP/2
+		// services stream requests and responses
+		h = newHTTPProxy(targetURL, tr, -1)
+
 	default:
 		h = newHTTPProxy(targetURL, tr, time.Duration(0))
 	}
 
+	if rp, ok := h.(*httputil.ReverseProxy); ok && (respHeaders || t.Proto != "") {
+		rp.ModifyResponse = func(resp *http.Response) error {
+			if t.Proto != "" && len(resp.Trailer) > 0 {
+				// HTTP/1.1 clients receive trailers only
+				// with chunked transfer encoding.
+				resp.Header.Del("Content-Length")
+				resp.ContentLength = -1
+			}
+			addResponseHeaders(resp.Header, t, origin, vars)
+			return nil
+		}
+	}
+
+	if rp, ok := h.(*httputil.ReverseProxy); ok {
+		rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			p.writeError(w, r, requestURL, t, proxyErrorStatus(r, err))
+		}
+	}
+
 	if p.Config.GZIPContentTypes != nil {
 		h = gzip.NewGzipHandler(h, p.Config.GZIPContentTypes)
 	}
 
-	timeNow := p.Time
-	if timeNow == nil {
-		timeNow = time.Now
+	if raw != nil && t.WSLimiter != nil {
+		if err := t.WSLimiter.Acquire(r.Context()); err != nil {
+			metrics.DefaultRegistry.GetCounter("ws.rejected").Inc(1)
+			p.writeError(w, r, requestURL, t, http.StatusServiceUnavailable)
+			p.logRejected(r, requestURL, t, http.StatusServiceUnavailable, timeNow())
+			return
+		}
+		defer t.WSLimiter.Release()
+	}
+
+	if t.ConnLimiter != nil {
+		if err := t.ConnLimiter.Acquire(r.Context()); err != nil {
+			p.writeError(w, r, requestURL, t, http.StatusServiceUnavailable)
+			p.logRejected(r, requestURL, t, http.StatusServiceUnavailable, timeNow())
+			return
+		}
+		defer t.ConnLimiter.Release()
+	}
+
+	// the total request timeout does not apply to websocket
+	// connections since they are long-lived.
+	if t.Timeout > 0 && upgrade == "" {
+		ctx, cancel := context.WithTimeout(r.Context(), t.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// the upstream span is sent to the target as parent
+	client := span.StartChild(r.Method, trace.KindClient)
+	if client != nil {
+		defer client.Finish()
+		client.SetAttr("http.method", r.Method)
+		client.SetAttr("http.url", targetURL.String())
+		client.SetAttr("net.peer.name", targetURL.Host)
+		client.SetAttr("fabio.service", t.Service)
+		client.Inject(r.Header)
+	}
+
+	// the reverse proxy adds the address of the peer and not the
+	// address of the client to the X-Forwarded-For header.
+	in := r
+	if peer != r.RemoteAddr {
+		in = r.WithContext(r.Context())
+		in.RemoteAddr = peer
 	}
 
 	start := timeNow()
-	h.ServeHTTP(w, r)
+	if raw != nil {
+		p.updateWSConns(1)
+	}
+	h.ServeHTTP(w, in)
+	if raw != nil {
+		p.updateWSConns(-1)
+	}
 	end := timeNow()
 	dur := end.Sub(start)
 
@@ -181,6 +394,26 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		t.Timer.Update(dur)
 	}
 
+	// websocket sessions are logged when they are closed
+	if raw != nil {
+		metrics.DefaultRegistry.GetTimer(key(raw.status)).Update(dur)
+		client.SetStatus(raw.status)
+		span.SetStatus(raw.status)
+		if p.Logger != nil {
+			p.Logger.Log(&logger.Event{
+				Start:           start,
+				End:             end,
+				Request:         r,
+				Response:        &http.Response{StatusCode: raw.status, ContentLength: raw.bytesOut},
+				RequestURL:      requestURL,
+				UpstreamAddr:    upstreamAddr,
+				UpstreamService: t.Service,
+				UpstreamURL:     targetURL,
+			})
+		}
+		return
+	}
+
 	// get response and update metrics
 	rp, ok := h.(*httputil.ReverseProxy)
 	if !ok {
@@ -190,10 +423,21 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
+	if t.Shift != nil {
+		t.Shift.Observe(rpt.resp == nil || rpt.resp.StatusCode >= 500)
+	}
 	if rpt.resp == nil {
+		client.SetError(rpt.err)
 		return
 	}
+	client.SetStatus(rpt.resp.StatusCode)
+	span.SetStatus(rpt.resp.StatusCode)
 	metrics.DefaultRegistry.GetTimer(key(rpt.resp.StatusCode)).Update(dur)
+	if t.Proto == "grpc" {
+		if code := grpcStatus(rpt.resp); code != "" {
+			metrics.DefaultRegistry.GetTimer("grpc.status." + code).Update(dur)
+		}
+	}
 
 	// write access log
 	if p.Logger != nil {
@@ -203,13 +447,82 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Request:         r,
 			Response:        rpt.resp,
 			RequestURL:      requestURL,
-			UpstreamAddr:    targetURL.Host,
+			UpstreamAddr:    upstreamAddr,
 			UpstreamService: t.Service,
 			UpstreamURL:     targetURL,
 		})
 	}
 }
 
+// updateWSConns changes the number of open websocket sessions by delta
+// and updates the WSConns gauge.
+func (p *HTTPProxy) updateWSConns(delta int64) {
+	n := p.wsActive.Add(delta)
+	if p.WSConns != nil {
+		p.WSConns.Update(n)
+	}
+}
+
+// writeError sends the error page for the status with the response
+// headers of the route. t is nil if there is no route for the request.
+func (p *HTTPProxy) writeError(w http.ResponseWriter, r *http.Request, u *url.URL, t *route.Target, status int) {
+	var set, id string
+	if t != nil {
+		set = t.ErrorPages
+		addResponseHeaders(w.Header(), t, r.Header.Get("Origin"), headerVars(r, u, p.Config))
+	}
+	if p.Config.RequestID != "" {
+		id = r.Header.Get(p.Config.RequestID)
+	}
+	trace.FromContext(r.Context()).SetStatus(status)
+	p.ErrorPages.write(w, r, u, set, status, id)
+}
+
+// logRejected updates the status metric and writes the access log for a
+// request which was rejected or answered by the proxy without contacting
+// the target.
+func (p *HTTPProxy) logRejected(r *http.Request, requestURL *url.URL, t *route.Target, status int, now time.Time) {
+	metrics.DefaultRegistry.GetTimer(key(status)).Update(0)
+	trace.FromContext(r.Context()).SetStatus(status)
+	if p.Logger == nil {
+		return
+	}
+	p.Logger.Log(&logger.Event{
+		Start:           now,
+		End:             now,
+		Request:         r,
+		Response:        &http.Response{StatusCode: status},
+		RequestURL:      requestURL,
+		UpstreamService: t.Service,
+	})
+}
+
+// rateLimitKey returns the key for rate limiting the request. The key is
+// either the value of a header for 'header:<name>' or the client ip. If
+// the header is missing the client ip is used.
+func rateLimitKey(r *http.Request, key string) string {
+	if strings.HasPrefix(key, "header:") {
+		if v := r.Header.Get(key[len("header:"):]); v != "" {
+			return "header:" + v
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// grpcStatus returns the gRPC status code of the response. The code is
+// sent in the trailer or, for responses without a body, in the header.
+// The trailer is only available after the body has been read.
+func grpcStatus(resp *http.Response) string {
+	if v := resp.Trailer.Get("Grpc-Status"); v != "" {
+		return v
+	}
+	return resp.Header.Get("Grpc-Status")
+}
+
 func key(code int) string {
 	b := []byte("http.status.")
 	b = strconv.AppendInt(b, int64(code), 10)
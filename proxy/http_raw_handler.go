@@ -1,68 +1,233 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/fabiolb/fabio/metrics"
 )
 
-// conn measures the number of open web socket connections
-var conn = metrics.DefaultRegistry.GetCounter("ws.conn")
-
 type dialFunc func(network, address string) (net.Conn, error)
 
+// rawProxy is an HTTP handler which forwards data between an incoming
+// and outgoing TCP connection including the original request. It
+// establishes a new outgoing connection per request and captures the
+// result of the session. It is not safe for multiple or concurrent use.
+type rawProxy struct {
+	target *url.URL
+	dial   dialFunc
+
+	// idleTimeout closes the connections when no data has been sent
+	// in either direction for this duration. Zero means no timeout.
+	idleTimeout time.Duration
+
+	// header modifies the header of the upstream response before it
+	// is sent to the client. The response is passed on unchanged if
+	// it is nil.
+	header func(http.Header)
+
+	// status is the status code of the upstream response or of the
+	// error response sent by the proxy.
+	status int
+
+	// bytesIn and bytesOut are the number of bytes received from and
+	// sent to the client after the request.
+	bytesIn, bytesOut int64
+}
+
 // newRawProxy returns an HTTP handler which forwards data between
 // an incoming and outgoing TCP connection including the original request.
 // This handler establishes a new outgoing connection per request.
-func newRawProxy(t *url.URL, dial dialFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn.Inc(1)
-		defer func() { conn.Inc(-1) }()
-
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "not a hijacker", http.StatusInternalServerError)
-			return
-		}
+func newRawProxy(t *url.URL, dial dialFunc, idleTimeout time.Duration) *rawProxy {
+	return &rawProxy{target: t, dial: dial, idleTimeout: idleTimeout}
+}
 
-		in, _, err := hj.Hijack()
-		if err != nil {
-			log.Printf("[ERROR] Hijack error for %s. %s", r.URL, err)
-			http.Error(w, "hijack error", http.StatusInternalServerError)
-			return
-		}
-		defer in.Close()
+func (p *rawProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		p.status = http.StatusInternalServerError
+		http.Error(w, "not a hijacker", p.status)
+		return
+	}
+
+	out, err := p.dial("tcp", p.target.Host)
+	if err != nil {
+		log.Printf("[ERROR] WS error for %s. %s", r.URL, err)
+		p.status = http.StatusBadGateway
+		http.Error(w, "error contacting backend server", p.status)
+		return
+	}
+	defer out.Close()
 
-		out, err := dial("tcp", t.Host)
+	err = r.Write(out)
+	if err != nil {
+		log.Printf("[ERROR] Error copying request for %s. %s", r.URL, err)
+		p.status = http.StatusBadGateway
+		http.Error(w, "error copying request", p.status)
+		return
+	}
+
+	// wait for the status line of the upstream response so
+	// that failed upgrades are reported to the client.
+	br := bufio.NewReader(out)
+	p.status, err = readStatus(br)
+	if err != nil {
+		log.Printf("[ERROR] WS error for %s. %s", r.URL, err)
+		p.status = http.StatusBadGateway
+		http.Error(w, "error reading response", p.status)
+		return
+	}
+
+	// the head of the response is parsed only when it is
+	// modified. The body is copied like the session data.
+	var src io.Reader = br
+	if p.header != nil {
+		resp, err := http.ReadResponse(br, r)
 		if err != nil {
 			log.Printf("[ERROR] WS error for %s. %s", r.URL, err)
-			http.Error(w, "error contacting backend server", http.StatusInternalServerError)
+			p.status = http.StatusBadGateway
+			http.Error(w, "error reading response", p.status)
 			return
 		}
-		defer out.Close()
+		p.header(resp.Header)
+		src = io.MultiReader(bytes.NewReader(responseHead(resp)), br)
+	}
 
-		err = r.Write(out)
-		if err != nil {
-			log.Printf("[ERROR] Error copying request for %s. %s", r.URL, err)
-			http.Error(w, "error copying request", http.StatusInternalServerError)
+	in, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("[ERROR] Hijack error for %s. %s", r.URL, err)
+		p.status = http.StatusInternalServerError
+		http.Error(w, "hijack error", p.status)
+		return
+	}
+	defer in.Close()
+
+	// track the connection for the shutdown since
+	// the http server no longer knows about it.
+	wsConns.add(in)
+	defer wsConns.remove(in)
+
+	start := time.Now()
+	last := start.UnixNano()
+	var dstIn, dstOut io.Writer = in, out
+	if p.idleTimeout > 0 {
+		dstIn = activityWriter{in, &last}
+		dstOut = activityWriter{out, &last}
+		done := make(chan struct{})
+		defer close(done)
+		go p.closeIdle(r, in, out, &last, done)
+	}
+
+	type result struct {
+		n   *int64
+		cnt int64
+		err error
+	}
+	resc := make(chan result, 2)
+	cp := func(dst io.Writer, src io.Reader, n *int64) {
+		cnt, err := io.Copy(dst, src)
+		resc <- result{n, cnt, err}
+	}
+
+	// the buffered readers may already contain data
+	// which was sent after the request and response.
+	go cp(dstOut, brw.Reader, &p.bytesIn)
+	go cp(dstIn, src, &p.bytesOut)
+
+	res := <-resc
+	*res.n = res.cnt
+	if res.err != nil && res.err != io.EOF {
+		log.Printf("[INFO] WS error for %s. %s", r.URL, res.err)
+	}
+
+	// close both connections to stop the other
+	// direction and wait for its byte count.
+	in.Close()
+	out.Close()
+	res = <-resc
+	*res.n = res.cnt
+
+	metrics.DefaultRegistry.GetCounter("ws.bytes.in").Inc(p.bytesIn)
+	metrics.DefaultRegistry.GetCounter("ws.bytes.out").Inc(p.bytesOut)
+	metrics.DefaultRegistry.GetTimer("ws.session").UpdateSince(start)
+}
+
+// closeIdle closes the connections when there was no activity for the
+// idle timeout. It returns when done is closed.
+func (p *rawProxy) closeIdle(r *http.Request, in, out net.Conn, last *int64, done chan struct{}) {
+	t := time.NewTimer(p.idleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(last)))
+			if idle < p.idleTimeout {
+				t.Reset(p.idleTimeout - idle)
+				continue
+			}
+			log.Printf("[INFO] WS idle timeout for %s", r.URL)
+			in.Close()
+			out.Close()
 			return
 		}
+	}
+}
 
-		errc := make(chan error, 2)
-		cp := func(dst io.Writer, src io.Reader) {
-			_, err := io.Copy(dst, src)
-			errc <- err
-		}
+// readStatus returns the status code from the status line of an HTTP
+// response without consuming it.
+func readStatus(br *bufio.Reader) (int, error) {
+	// HTTP/1.1 101
+	b, err := br.Peek(12)
+	if err != nil {
+		return 0, err
+	}
+	if string(b[:5]) != "HTTP/" || b[8] != ' ' {
+		return 0, errInvalidStatusLine
+	}
+	code, err := strconv.Atoi(string(b[9:12]))
+	if err != nil {
+		return 0, errInvalidStatusLine
+	}
+	return code, nil
+}
 
-		go cp(out, in)
-		go cp(in, out)
-		err = <-errc
-		if err != nil && err != io.EOF {
-			log.Printf("[INFO] WS error for %s. %s", r.URL, err)
-		}
-	})
+var errInvalidStatusLine = errors.New("invalid status line")
+
+// responseHead returns the status line and the header of the response.
+func responseHead(resp *http.Response) []byte {
+	h := resp.Header
+	if len(resp.TransferEncoding) > 0 {
+		// the body is still encoded
+		h = h.Clone()
+		h.Set("Transfer-Encoding", strings.Join(resp.TransferEncoding, ", "))
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// activityWriter records the time of the last write.
+type activityWriter struct {
+	w    io.Writer
+	last *int64
+}
+
+func (a activityWriter) Write(b []byte) (int, error) {
+	atomic.StoreInt64(a.last, time.Now().UnixNano())
+	return a.w.Write(b)
 }
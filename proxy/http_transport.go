@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/cert"
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+	"golang.org/x/net/http2"
+)
+
+// NewTransport creates an HTTP connection pool for upstream connections
+// which is configured with the timeouts from the proxy configuration.
+func NewTransport(cfg config.Proxy, tlscfg *tls.Config) *http.Transport {
+	return &http.Transport{
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		MaxIdleConnsPerHost:   cfg.MaxConn,
+		Dial: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: cfg.KeepAliveTimeout,
+		}).Dial,
+		TLSClientConfig: tlscfg,
+	}
+}
+
+// NewH2CTransport creates a connection pool for HTTP/2 upstream
+// connections without TLS (h2c) as used by gRPC services. All requests
+// to a target share a single connection. The response header timeout
+// is not supported by the HTTP/2 transport.
+func NewH2CTransport(cfg config.Proxy) *http2.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAliveTimeout,
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+	}
+}
+
+// maxHostTransports is the maximum number of connection pools for
+// targets with the 'sni=host' option which need a separate pool for
+// every server name.
+const maxHostTransports = 256
+
+// hostTransportIdleTimeout closes the idle connections of the pools for
+// targets with the 'sni=host' option if the proxy transport has no idle
+// timeout. Otherwise, connections which are returned to a pool after it
+// has been evicted from the cache would stay open.
+const hostTransportIdleTimeout = 90 * time.Second
+
+// transportKey identifies a connection pool with route specific
+// settings.
+type transportKey struct {
+	insecure              bool
+	dialTimeout           time.Duration
+	responseHeaderTimeout time.Duration
+	h2c                   bool
+	tlsCA                 string
+	tlsCert               string
+	tlsServerName         string
+	sni                   string
+	socket                string
+}
+
+// transport returns the connection pool for the target. Targets without
+// route specific timeouts, protocol or TLS settings which are not behind
+// a unix socket share the Transport and InsecureTransport connection
+// pools. For all other targets a connection pool is created on first use
+// and cached for targets with the same settings. host is the host of the
+// request which is sent as server name for targets with the 'sni=host'
+// option. Their connection pools are kept in a cache of limited size
+// since there is one for every server name.
+func (p *HTTPProxy) transport(t *route.Target, host string) http.RoundTripper {
+	base := p.Transport
+	if t.TLSSkipVerify {
+		base = p.InsecureTransport
+	}
+	h2c := t.Proto == "h2c" || t.Proto == "grpc"
+	// unix sockets are local and use plain HTTP
+	upstreamTLS := t.Socket == "" && (t.TLSCA != "" || t.TLSCert != "" || t.TLSServerName != "" || t.SNI != "")
+	if t.DialTimeout == 0 && t.ResponseHeaderTimeout == 0 && !h2c && !upstreamTLS && t.Socket == "" {
+		return base
+	}
+
+	sni, perHost := t.SNI, upstreamTLS && t.SNI == "host"
+	if perHost {
+		// connections with different server names
+		// need separate connection pools.
+		sni = strings.ToLower(stripPort(host))
+	}
+	k := transportKey{t.TLSSkipVerify, t.DialTimeout, t.ResponseHeaderTimeout, h2c, t.TLSCA, t.TLSCert, t.TLSServerName, sni, t.Socket}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if perHost {
+		if p.hostTransports == nil {
+			p.hostTransports = newTransportCache(maxHostTransports)
+		}
+		if tr := p.hostTransports.get(k); tr != nil {
+			return tr
+		}
+		tr := p.newRouteTransport(base, k, upstreamTLS)
+		if htr, ok := tr.(*http.Transport); ok && htr.IdleConnTimeout == 0 {
+			htr.IdleConnTimeout = hostTransportIdleTimeout
+		}
+		p.hostTransports.add(k, tr)
+		return tr
+	}
+
+	if tr := p.transports[k]; tr != nil {
+		return tr
+	}
+	if p.transports == nil {
+		p.transports = map[transportKey]http.RoundTripper{}
+	}
+	tr := p.newRouteTransport(base, k, upstreamTLS)
+	p.transports[k] = tr
+	return tr
+}
+
+// newRouteTransport creates the connection pool for targets with
+// the route specific settings of the key.
+func (p *HTTPProxy) newRouteTransport(base http.RoundTripper, k transportKey, upstreamTLS bool) http.RoundTripper {
+	cfg := p.Config
+	if k.dialTimeout > 0 {
+		cfg.DialTimeout = k.dialTimeout
+	}
+	if k.responseHeaderTimeout > 0 {
+		cfg.ResponseHeaderTimeout = k.responseHeaderTimeout
+	}
+
+	switch {
+	case k.h2c:
+		h2tr := NewH2CTransport(cfg)
+		if k.socket != "" {
+			dial := dialUnix(cfg, k.socket)
+			h2tr.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(network, addr)
+			}
+		}
+		return h2tr
+	case upstreamTLS:
+		htr := newTransport(base, cfg, k)
+		htr.DialTLS, htr.DialTLSContext = dialTLS(cfg, p.UpstreamTLS, k), nil
+		return htr
+	default:
+		htr := newTransport(base, cfg, k)
+		if k.socket != "" {
+			htr.Dial, htr.DialContext = dialUnix(cfg, k.socket), nil
+		}
+		return htr
+	}
+}
+
+// transportCache contains a limited number of connection pools. When
+// the cache is full the least recently used pool is removed and its
+// idle connections are closed.
+type transportCache struct {
+	size  int
+	items map[transportKey]*list.Element
+	lru   *list.List
+}
+
+type transportCacheItem struct {
+	key transportKey
+	tr  http.RoundTripper
+}
+
+func newTransportCache(size int) *transportCache {
+	return &transportCache{
+		size:  size,
+		items: map[transportKey]*list.Element{},
+		lru:   list.New(),
+	}
+}
+
+// get returns the connection pool for the key or nil.
+func (c *transportCache) get(k transportKey) http.RoundTripper {
+	e := c.items[k]
+	if e == nil {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*transportCacheItem).tr
+}
+
+// add stores the connection pool for the key.
+func (c *transportCache) add(k transportKey, tr http.RoundTripper) {
+	for c.lru.Len() >= c.size {
+		e := c.lru.Back()
+		item := c.lru.Remove(e).(*transportCacheItem)
+		delete(c.items, item.key)
+		if ci, ok := item.tr.(interface{ CloseIdleConnections() }); ok {
+			ci.CloseIdleConnections()
+		}
+	}
+	c.items[k] = c.lru.PushFront(&transportCacheItem{k, tr})
+}
+
+// newTransport creates a connection pool with the route specific
+// timeouts. The other settings are copied from the base transport if it
+// is an *http.Transport so that customizations of the proxy transport
+// also apply to routes with their own connection pool.
+func newTransport(base http.RoundTripper, cfg config.Proxy, k transportKey) *http.Transport {
+	btr, ok := base.(*http.Transport)
+	if !ok {
+		var tlscfg *tls.Config
+		if k.insecure {
+			tlscfg = &tls.Config{InsecureSkipVerify: true}
+		}
+		return NewTransport(cfg, tlscfg)
+	}
+
+	tr := btr.Clone()
+	if k.responseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = k.responseHeaderTimeout
+	}
+	if k.dialTimeout > 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   k.dialTimeout,
+			KeepAlive: cfg.KeepAliveTimeout,
+		}).DialContext
+		tr.Dial = nil
+	}
+	if tr.TLSClientConfig == nil && k.insecure {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return tr
+}
+
+// dialTLS returns a function which opens TLS connections to upstream
+// servers with the CA bundle, client certificate and server names of the
+// route. The TLS configuration is built for every connection so that new
+// connections use the current certificates of the certificate sources.
+// The server name defaults to the 'tlsservername' option and the host of
+// the upstream server.
+func dialTLS(cfg config.Proxy, u *cert.Upstream, k transportKey) func(network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAliveTimeout,
+	}
+	return func(network, addr string) (net.Conn, error) {
+		name := k.sni
+		if name == "" {
+			name = k.tlsServerName
+		}
+		if name == "" {
+			name = stripPort(addr)
+		}
+		tlscfg, err := u.TLSConfig(cert.UpstreamConfig{
+			CA:                 k.tlsCA,
+			Cert:               k.tlsCert,
+			ServerName:         name,
+			VerifyName:         k.tlsServerName,
+			InsecureSkipVerify: k.insecure,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return tls.DialWithDialer(dialer, network, addr, tlscfg)
+	}
+}
+
+// dialUnix returns a function which connects to the unix socket at path
+// instead of the address of the request.
+func dialUnix(cfg config.Proxy, path string) func(network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	return func(network, addr string) (net.Conn, error) {
+		return dialer.Dial("unix", path)
+	}
+}
+
+// stripPort returns the host without the port.
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/route"
+)
+
+func TestTransportCopiesBaseSettings(t *testing.T) {
+	p := &HTTPProxy{
+		Transport: &http.Transport{DisableCompression: true, MaxIdleConnsPerHost: 7},
+	}
+	tr, ok := p.transport(&route.Target{ResponseHeaderTimeout: time.Second}, "").(*http.Transport)
+	if !ok {
+		t.Fatal("got no *http.Transport")
+	}
+	if tr == p.Transport {
+		t.Fatal("got base transport want route transport")
+	}
+	if !tr.DisableCompression || tr.MaxIdleConnsPerHost != 7 {
+		t.Fatalf("got %+v want settings of base transport", tr)
+	}
+	if got, want := tr.ResponseHeaderTimeout, time.Second; got != want {
+		t.Fatalf("got response header timeout %s want %s", got, want)
+	}
+}
+
+type idleCloser struct {
+	http.RoundTripper
+	closed bool
+}
+
+func (c *idleCloser) CloseIdleConnections() { c.closed = true }
+
+func TestTransportCache(t *testing.T) {
+	c := newTransportCache(2)
+	a, b, d := &idleCloser{}, &idleCloser{}, &idleCloser{}
+	c.add(transportKey{sni: "a"}, a)
+	c.add(transportKey{sni: "b"}, b)
+	c.get(transportKey{sni: "a"})
+	c.add(transportKey{sni: "d"}, d)
+
+	if got := c.get(transportKey{sni: "b"}); got != nil {
+		t.Fatal("got pool for b want none")
+	}
+	if !b.closed {
+		t.Fatal("idle connections of b not closed")
+	}
+	if a.closed || d.closed {
+		t.Fatal("got idle connections closed for a or d")
+	}
+	if got, want := c.get(transportKey{sni: "a"}), http.RoundTripper(a); got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestTransportSNIHost(t *testing.T) {
+	p := &HTTPProxy{Transport: &http.Transport{}}
+	tg := &route.Target{TLSCA: "up", SNI: "host"}
+
+	a := p.transport(tg, "a.com:443")
+	if got := p.transport(tg, "A.com"); got != a {
+		t.Fatal("got new pool for the same server name")
+	}
+	if got := p.transport(tg, "b.com"); got == a {
+		t.Fatal("got same pool for different server names")
+	}
+	if got, want := len(p.transports), 0; got != want {
+		t.Fatalf("got %d unbounded pools want %d", got, want)
+	}
+	if got, want := a.(*http.Transport).IdleConnTimeout, hostTransportIdleTimeout; got != want {
+		t.Fatalf("got idle timeout %s want %s", got, want)
+	}
+}
@@ -4,35 +4,81 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
-	proxyproto "github.com/armon/go-proxyproto"
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/proxy/proxyproto"
+	"github.com/fabiolb/fabio/upgrade"
 )
 
-func ListenTCP(laddr string, cfg *tls.Config) (net.Listener, error) {
+// Listen listens on the TCP address or on the unix socket for addresses
+// with a 'unix:' prefix, e.g. 'unix:/run/fabio.sock'.
+func Listen(l config.Listen, cfg *tls.Config) (net.Listener, error) {
+	if strings.HasPrefix(l.Addr, "unix:") {
+		return ListenUnix(l, cfg)
+	}
+	return ListenTCP(l, cfg)
+}
+
+func ListenTCP(l config.Listen, cfg *tls.Config) (net.Listener, error) {
+	laddr := l.Addr
 	addr, err := net.ResolveTCPAddr("tcp", laddr)
 	if err != nil {
 		return nil, fmt.Errorf("listen: Fail to resolve tcp addr. %s", laddr)
 	}
 
-	var ln net.Listener
-	ln, err = net.ListenTCP("tcp", addr)
+	// use the listener from the previous process after an upgrade
+	tl, err := upgrade.ListenTCP(laddr, addr)
 	if err != nil {
 		return nil, fmt.Errorf("listen: Fail to listen. %s", err)
 	}
 
 	// enable TCPKeepAlive support
-	ln = tcpKeepAliveListener{ln.(*net.TCPListener)}
+	return wrapListener(tcpKeepAliveListener{tl}, addr, l, cfg), nil
+}
+
+// ListenUnix listens on the unix socket of an address of the form
+// 'unix:<path>'. A stale socket file is replaced.
+func ListenUnix(l config.Listen, cfg *tls.Config) (net.Listener, error) {
+	laddr := l.Addr
+	addr, err := net.ResolveUnixAddr("unix", strings.TrimPrefix(laddr, "unix:"))
+	if err != nil {
+		return nil, fmt.Errorf("listen: Fail to resolve unix addr. %s", laddr)
+	}
 
+	// use the listener from the previous process after an upgrade
+	ul, err := upgrade.ListenUnix(laddr, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen: Fail to listen. %s", err)
+	}
+
+	return wrapListener(ul, addr, l, cfg), nil
+}
+
+// wrapListener adds PROXY protocol and TLS support to the listener.
+func wrapListener(ln net.Listener, addr net.Addr, l config.Listen, cfg *tls.Config) net.Listener {
 	// enable PROXY protocol support
-	ln = &proxyproto.Listener{Listener: ln}
+	if l.ProxyProto != "" {
+		ln = &proxyproto.Listener{
+			Listener: ln,
+			Required: l.ProxyProto == "required",
+			Trusted:  l.ProxyProtoTrust,
+		}
+	}
+
+	// the PROXY header of unix socket connections
+	// is read before the address is replaced.
+	if _, ok := addr.(*net.UnixAddr); ok {
+		ln = unixListener{ln}
+	}
 
 	// enable TLS
 	if cfg != nil {
 		ln = tls.NewListener(ln, cfg)
 	}
 
-	return &tcpListener{ln, addr, cfg}, nil
+	return &tcpListener{ln, addr, cfg}
 }
 
 type tcpListener struct {
@@ -75,3 +121,32 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	}
 	return tc, nil
 }
+
+// unixListener reports the loopback address as the remote address of
+// the accepted connections without a client address from a PROXY
+// header since unix sockets have no client address but the proxy needs
+// one for the forwarding headers.
+type unixListener struct {
+	net.Listener
+}
+
+func (ln unixListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{c}, nil
+}
+
+type unixConn struct {
+	net.Conn
+}
+
+var loopbackAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (c unixConn) RemoteAddr() net.Addr {
+	if addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr
+	}
+	return loopbackAddr
+}
@@ -1,14 +1,21 @@
 package proxy
 
 import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/proxy/tcp"
+	"github.com/fabiolb/fabio/proxy/tcp/tcptest"
 	"github.com/fabiolb/fabio/route"
 )
 
@@ -46,7 +53,7 @@ func TestGracefulShutdown(t *testing.T) {
 	go func() {
 		time.Sleep(delay)
 		close(trigger)
-		Shutdown(delay)
+		Shutdown(delay, delay)
 	}()
 
 	// give server some time to start up
@@ -81,3 +88,132 @@ func TestGracefulShutdown(t *testing.T) {
 	// note that the actual listeners have not returned yet
 	wg.Wait()
 }
+
+func TestShutdownDrain(t *testing.T) {
+	defer atomic.StoreInt32(&draining, 0)
+
+	// echo server which keeps the connection open
+	// until the client closes it.
+	addr := "127.0.0.1:57781"
+	h := tcp.HandlerFunc(func(in net.Conn) error {
+		defer in.Close()
+		_, err := io.Copy(in, in)
+		return err
+	})
+	go ListenAndServeTCP(config.Listen{Addr: addr}, h, nil)
+
+	dial := func() net.Conn {
+		for i := 0; i < 50; i++ {
+			c, err := net.Dial("tcp", addr)
+			if err == nil {
+				return c
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("cannot connect to ", addr)
+		return nil
+	}
+	echo := func(c net.Conn) error {
+		if _, err := c.Write([]byte("x")); err != nil {
+			return err
+		}
+		_, err := c.Read(make([]byte, 1))
+		return err
+	}
+
+	c1, c2 := dial(), dial()
+	defer c2.Close()
+	for _, c := range []net.Conn{c1, c2} {
+		if err := echo(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Shutdown(0, 500*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if !Draining() {
+		t.Fatal("got not draining want draining")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("got new connection want connection refused")
+	}
+
+	// open connections work until the drain timeout
+	c1.Close()
+	if err := echo(c2); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown completed before the drain timeout")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	if err := echo(c2); err == nil {
+		t.Fatal("got nil want error after drain timeout")
+	}
+}
+
+func TestListenProxyProto(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Real-Ip")))
+	}))
+	defer server.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	addr := "127.0.0.1:57783"
+	go func() {
+		h := &HTTPProxy{
+			Transport: http.DefaultTransport,
+			Lookup: func(r *http.Request) *route.Target {
+				tbl, _ := route.NewTable("route add svc / " + server.URL)
+				return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+			},
+		}
+		l := config.Listen{Addr: addr, ProxyProto: "required", ProxyProtoTrust: []*net.IPNet{loopback}}
+		if err := ListenAndServeHTTP(l, h, nil); err != nil {
+			t.Log("ListenAndServeHTTP: ", err)
+		}
+	}()
+	defer Close()
+
+	get := func(hdr string) (string, error) {
+		c, err := tcptest.NewRetryDialer().Dial("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte(hdr + "GET / HTTP/1.0\r\n\r\n")); err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	body, err := get("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := body, "1.2.3.4"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	if _, err := get(""); err == nil {
+		t.Fatal("got nil want error for connection without header")
+	}
+}
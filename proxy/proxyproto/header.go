@@ -0,0 +1,250 @@
+// Package proxyproto implements version 1 and 2 of the PROXY protocol
+// which load balancers use to pass the addresses of the client
+// connection to the server.
+//
+// See https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// v1Prefix starts a version 1 header.
+	v1Prefix = []byte("PROXY ")
+
+	// v2Signature starts a version 2 header.
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLen is the maximum length of a version 1 header
+// including the CRLF.
+const v1MaxLen = 107
+
+// ErrNoHeader is returned by Read if the data does not start
+// with a PROXY protocol header.
+var ErrNoHeader = errors.New("proxyproto: no header")
+
+// Header contains the addresses of a PROXY protocol header. Src and
+// Dst are nil if the header does not contain addresses, e.g. for the
+// health checks of a load balancer or for unsupported address families.
+type Header struct {
+	Version int
+	Src     *net.TCPAddr
+	Dst     *net.TCPAddr
+}
+
+// Read reads a version 1 or version 2 header. It returns ErrNoHeader
+// without consuming any data if the data does not start with a header.
+func Read(br *bufio.Reader) (*Header, error) {
+	switch ok, err := hasPrefix(br, v1Prefix); {
+	case err != nil:
+		return nil, err
+	case ok:
+		return readV1(br)
+	}
+	switch ok, err := hasPrefix(br, v2Signature); {
+	case err != nil:
+		return nil, err
+	case ok:
+		return readV2(br)
+	}
+	return nil, ErrNoHeader
+}
+
+// hasPrefix checks byte by byte whether the data starts with the
+// prefix so that it does not wait for more data than the client
+// sends if the data does not start with a header.
+func hasPrefix(br *bufio.Reader, prefix []byte) (bool, error) {
+	for i := 1; i <= len(prefix); i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(b, prefix[:i]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// WriteTo writes the header in the format of its version. Headers
+// without addresses are sent as 'UNKNOWN' for version 1 and as 'LOCAL'
+// for version 2. Addresses of different families are sent as IPv6
+// addresses.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var b []byte
+	switch h.Version {
+	case 1:
+		b = h.formatV1()
+	case 2:
+		b = h.formatV2()
+	default:
+		return 0, fmt.Errorf("proxyproto: invalid version %d", h.Version)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ips returns the source and destination ip addresses with the
+// same length or nil if the header has no addresses.
+func (h *Header) ips() (src, dst net.IP) {
+	if h.Src == nil || h.Dst == nil {
+		return nil, nil
+	}
+	if src, dst = h.Src.IP.To4(), h.Dst.IP.To4(); src != nil && dst != nil {
+		return src, dst
+	}
+	return h.Src.IP.To16(), h.Dst.IP.To16()
+}
+
+func (h *Header) formatV1() []byte {
+	src, dst := h.ips()
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if len(src) == net.IPv4len {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src, dst, h.Src.Port, h.Dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", formatV6(src), formatV6(dst), h.Src.Port, h.Dst.Port))
+}
+
+// formatV6 returns the IPv6 notation of the address which is
+// also used for IPv4-mapped addresses.
+func formatV6(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+func (h *Header) formatV2() []byte {
+	b := append([]byte{}, v2Signature...)
+	src, dst := h.ips()
+	if src == nil || dst == nil {
+		// LOCAL command without addresses
+		return append(b, 0x20, 0x00, 0x00, 0x00)
+	}
+	fam := byte(0x21)
+	if len(src) == net.IPv4len {
+		fam = 0x11
+	}
+	n := 2*len(src) + 4
+	b = append(b, 0x21, fam, byte(n>>8), byte(n))
+	b = append(b, src...)
+	b = append(b, dst...)
+	return append(b, byte(h.Src.Port>>8), byte(h.Src.Port), byte(h.Dst.Port>>8), byte(h.Dst.Port))
+}
+
+// readV1 reads a header of the form
+//
+//	PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n
+//	PROXY UNKNOWN ...\r\n
+func readV1(br *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) <= v1MaxLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if len(line) > v1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: invalid v1 header")
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+
+	var err error
+	if h.Src, err = parseV1Addr(parts[2], parts[4]); err != nil {
+		return nil, err
+	}
+	if h.Dst, err = parseV1Addr(parts[3], parts[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 address %q", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// readV2 reads a binary header which consists of the signature,
+// the version and command, the address family, the length of the
+// remaining header and the addresses followed by optional TLVs
+// which are skipped.
+func readV2(br *bufio.Reader) (*Header, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: invalid v2 version %d", hdr[12]>>4)
+	}
+	cmd, fam := hdr[12]&0x0f, hdr[13]
+	n := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	h := &Header{Version: 2}
+	var addrLen int
+	switch {
+	case cmd == 0x0: // LOCAL
+	case cmd != 0x1:
+		return nil, fmt.Errorf("proxyproto: invalid v2 command %d", cmd)
+	case fam == 0x11: // TCP over IPv4
+		addrLen = 12
+	case fam == 0x21: // TCP over IPv6
+		addrLen = 36
+	}
+	if n < addrLen {
+		return nil, errors.New("proxyproto: v2 header too short")
+	}
+
+	if addrLen > 0 {
+		b := make([]byte, addrLen)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		ipLen := (addrLen - 4) / 2
+		h.Src = &net.TCPAddr{
+			IP:   net.IP(b[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(b[2*ipLen:])),
+		}
+		h.Dst = &net.TCPAddr{
+			IP:   net.IP(b[ipLen : 2*ipLen]),
+			Port: int(binary.BigEndian.Uint16(b[2*ipLen+2:])),
+		}
+	}
+
+	// skip the TLVs and the addresses of unsupported families
+	if _, err := io.CopyN(ioutil.Discard, br, int64(n-addrLen)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
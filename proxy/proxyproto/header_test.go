@@ -0,0 +1,235 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	v2 := func(cmdFam string, addrs string, tlvs string) string {
+		n := len(addrs) + len(tlvs)
+		return string(v2Signature) + cmdFam + string([]byte{byte(n >> 8), byte(n)}) + addrs + tlvs
+	}
+	ipv4 := "\x01\x02\x03\x04" + "\x05\x06\x07\x08" + "\x04\xd2" + "\x00\x50"
+	ipv6 := "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" +
+		"\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x02" +
+		"\x04\xd2" + "\x01\xbb"
+
+	tests := []struct {
+		desc string
+		in   string
+		hdr  *Header
+		err  string
+		rest string
+	}{
+		{
+			desc: "no header",
+			in:   "GET / HTTP/1.1\r\n",
+			err:  ErrNoHeader.Error(),
+			rest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			desc: "no header with prefix",
+			in:   "PROXX",
+			err:  ErrNoHeader.Error(),
+			rest: "PROXX",
+		},
+		{
+			desc: "v1 tcp4",
+			in:   "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nGET",
+			hdr: &Header{
+				Version: 1,
+				Src:     &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234},
+				Dst:     &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 80},
+			},
+			rest: "GET",
+		},
+		{
+			desc: "v1 tcp6",
+			in:   "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n",
+			hdr: &Header{
+				Version: 1,
+				Src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+				Dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+		},
+		{
+			desc: "v1 unknown",
+			in:   "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET",
+			hdr:  &Header{Version: 1},
+			rest: "GET",
+		},
+		{
+			desc: "v1 invalid address",
+			in:   "PROXY TCP4 1.2.3 5.6.7.8 1234 80\r\n",
+			err:  `proxyproto: invalid v1 address "1.2.3"`,
+		},
+		{
+			desc: "v1 invalid port",
+			in:   "PROXY TCP4 1.2.3.4 5.6.7.8 1234 65536\r\n",
+			err:  `proxyproto: invalid v1 port "65536"`,
+		},
+		{
+			desc: "v1 missing fields",
+			in:   "PROXY TCP4 1.2.3.4 5.6.7.8 1234\r\n",
+			err:  `proxyproto: invalid v1 header "PROXY TCP4 1.2.3.4 5.6.7.8 1234\r\n"`,
+		},
+		{
+			desc: "v1 too long",
+			in:   "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+			err:  "proxyproto: invalid v1 header",
+		},
+		{
+			desc: "v2 tcp4",
+			in:   v2("\x21\x11", ipv4, "") + "GET",
+			hdr: &Header{
+				Version: 2,
+				Src:     &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+				Dst:     &net.TCPAddr{IP: net.IP{5, 6, 7, 8}, Port: 80},
+			},
+			rest: "GET",
+		},
+		{
+			desc: "v2 tcp6 with tlvs",
+			in:   v2("\x21\x21", ipv6, "\x01\x00\x02h2") + "GET",
+			hdr: &Header{
+				Version: 2,
+				Src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+				Dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+			rest: "GET",
+		},
+		{
+			desc: "v2 local",
+			in:   v2("\x20\x00", "", "") + "GET",
+			hdr:  &Header{Version: 2},
+			rest: "GET",
+		},
+		{
+			desc: "v2 unix is skipped",
+			in:   v2("\x21\x31", strings.Repeat("\x00", 216), "") + "GET",
+			hdr:  &Header{Version: 2},
+			rest: "GET",
+		},
+		{
+			desc: "v2 invalid version",
+			in:   v2("\x11\x11", ipv4, ""),
+			err:  "proxyproto: invalid v2 version 1",
+		},
+		{
+			desc: "v2 invalid command",
+			in:   v2("\x22\x11", ipv4, ""),
+			err:  "proxyproto: invalid v2 command 2",
+		},
+		{
+			desc: "v2 too short",
+			in:   v2("\x21\x11", ipv4[:8], ""),
+			err:  "proxyproto: v2 header too short",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.in))
+			hdr, err := Read(br)
+			if err != nil || tt.err != "" {
+				if got, want := errString(err), tt.err; !strings.HasPrefix(got, want) || want == "" {
+					t.Fatalf("got error %q want %q", got, want)
+				}
+			}
+			if got, want := hdr, tt.hdr; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got header %+v want %+v", got, want)
+			}
+			if tt.err != "" && tt.err != ErrNoHeader.Error() {
+				return
+			}
+			rest, _ := ioutil.ReadAll(br)
+			if got, want := string(rest), tt.rest; got != want {
+				t.Fatalf("got rest %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	addr := func(s string, port int) *net.TCPAddr { return &net.TCPAddr{IP: net.ParseIP(s), Port: port} }
+
+	tests := []struct {
+		desc     string
+		hdr      *Header
+		v1       string
+		src, dst *net.TCPAddr
+	}{
+		{
+			desc: "ipv4",
+			hdr:  &Header{Src: addr("1.2.3.4", 1234), Dst: addr("5.6.7.8", 80)},
+			v1:   "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n",
+			src:  addr("1.2.3.4", 1234),
+			dst:  addr("5.6.7.8", 80),
+		},
+		{
+			desc: "ipv6",
+			hdr:  &Header{Src: addr("2001:db8::1", 1234), Dst: addr("2001:db8::2", 443)},
+			v1:   "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n",
+			src:  addr("2001:db8::1", 1234),
+			dst:  addr("2001:db8::2", 443),
+		},
+		{
+			desc: "mixed",
+			hdr:  &Header{Src: addr("1.2.3.4", 1234), Dst: addr("2001:db8::2", 443)},
+			v1:   "PROXY TCP6 ::ffff:1.2.3.4 2001:db8::2 1234 443\r\n",
+			src:  addr("::ffff:1.2.3.4", 1234),
+			dst:  addr("2001:db8::2", 443),
+		},
+		{
+			desc: "no addresses",
+			hdr:  &Header{},
+			v1:   "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	addrEqual := func(a, b *net.TCPAddr) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a.IP.Equal(b.IP) && a.Port == b.Port
+	}
+
+	for _, tt := range tests {
+		for _, v := range []int{1, 2} {
+			t.Run(tt.desc+" v"+strconv.Itoa(v), func(t *testing.T) {
+				var b bytes.Buffer
+				h := *tt.hdr
+				h.Version = v
+				if _, err := h.WriteTo(&b); err != nil {
+					t.Fatal(err)
+				}
+				if v == 1 {
+					if got, want := b.String(), tt.v1; got != want {
+						t.Fatalf("got %q want %q", got, want)
+					}
+				}
+				got, err := Read(bufio.NewReader(&b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Version != v || !addrEqual(got.Src, tt.src) || !addrEqual(got.Dst, tt.dst) {
+					t.Fatalf("got %+v want src %v dst %v", got, tt.src, tt.dst)
+				}
+			})
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,196 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the maximum duration for reading the header
+// if the listener has no timeout.
+const DefaultTimeout = 10 * time.Second
+
+var (
+	errUntrusted = errors.New("proxyproto: header from untrusted peer")
+	errRequired  = errors.New("proxyproto: header required")
+)
+
+// Listener wraps a listener whose connections can start with a PROXY
+// protocol header. The remote address of the connections is the source
+// address from the header. Connections with a header from an untrusted
+// peer are closed.
+type Listener struct {
+	net.Listener
+
+	// Required closes connections without a header.
+	Required bool
+
+	// Trusted contains the networks of the peers which can send a
+	// header. No peer is trusted if it is empty. Peers on a unix
+	// socket are always trusted since the permissions of the
+	// socket file control the access.
+	Trusted []*net.IPNet
+
+	// Timeout is the maximum duration for reading the header.
+	// The default is DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Accept returns the next connection. The header is read on the first
+// call to Read or RemoteAddr of the connection so that slow clients do
+// not block the listener. A connection without data within the timeout
+// has no header since the client may wait for the server to send first.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Conn{Conn: c, br: bufio.NewReader(c), l: l, timeout: timeout}, nil
+}
+
+// trusted returns true if the peer can send a header.
+func (l *Listener) trusted(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		return true
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection which can start with a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	l       *Listener
+	timeout time.Duration
+
+	once sync.Once
+	hdr  *Header
+	err  error
+
+	// mu guards readDeadline which is the read deadline set by
+	// the user of the connection. It is restored after the header
+	// has been read with the header timeout.
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// readHeader reads the header once and closes the connection
+// if the header is invalid or not allowed.
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		deadline := time.Now().Add(c.timeout)
+		c.mu.Lock()
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.mu.Unlock()
+
+		c.Conn.SetReadDeadline(deadline)
+		c.hdr, c.err = c.checkHeader()
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+
+		if c.err != nil {
+			if c.err != io.EOF {
+				log.Printf("[WARN] Rejected connection from %s. %s", c.Conn.RemoteAddr(), c.err)
+			}
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *Conn) checkHeader() (*Header, error) {
+	var h *Header
+	_, err := c.br.Peek(1)
+	switch {
+	case isTimeout(err):
+		// the client waits for the server to send
+		// first, e.g. for SMTP or MySQL.
+		err = ErrNoHeader
+	case err == nil:
+		h, err = Read(c.br)
+	}
+
+	switch {
+	case err == ErrNoHeader && c.l.Required:
+		return nil, errRequired
+	case err == ErrNoHeader:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case !c.l.trusted(c.Conn.RemoteAddr()):
+		return nil, errUntrusted
+	}
+	return h, nil
+}
+
+// isTimeout returns true if err is a timeout error.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// Header returns the PROXY protocol header of the connection. It is nil
+// if the connection has no header.
+func (c *Conn) Header() *Header {
+	c.readHeader()
+	return c.hdr
+}
+
+// Read reads from the connection after the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the source address from the header or the
+// address of the peer if the header has no addresses.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.hdr != nil && c.hdr.Src != nil {
+		return c.hdr.Src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		desc     string
+		required bool
+		trusted  []*net.IPNet
+		in       string
+		addr     string
+		data     string
+		err      error
+	}{
+		{
+			desc: "no header",
+			in:   "GET",
+			addr: "127.0.0.1",
+			data: "GET",
+		},
+		{
+			desc:     "no header but required",
+			required: true,
+			in:       "GET",
+			err:      errRequired,
+		},
+		{
+			desc: "header without trusted peers",
+			in:   "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nGET",
+			err:  errUntrusted,
+		},
+		{
+			desc:     "header from trusted peer",
+			required: true,
+			trusted:  []*net.IPNet{private, loopback},
+			in:       "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nGET",
+			addr:     "1.2.3.4",
+			data:     "GET",
+		},
+		{
+			desc:    "header from untrusted peer",
+			trusted: []*net.IPNet{private},
+			in:      "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nGET",
+			err:     errUntrusted,
+		},
+		{
+			desc:    "no header from untrusted peer",
+			trusted: []*net.IPNet{private},
+			in:      "GET",
+			addr:    "127.0.0.1",
+			data:    "GET",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &Listener{Listener: ln, Required: tt.required, Trusted: tt.trusted, Timeout: time.Second}
+			defer l.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				c.Write([]byte(tt.in))
+				c.Close()
+			}()
+
+			c, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			data, err := ioutil.ReadAll(c)
+			if got, want := err, tt.err; got != want {
+				t.Fatalf("got error %v want %v", got, want)
+			}
+			if tt.err != nil {
+				return
+			}
+			if got, want := string(data), tt.data; got != want {
+				t.Fatalf("got data %q want %q", got, want)
+			}
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			if got, want := host, tt.addr; got != want {
+				t.Fatalf("got remote addr %s want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestListenerTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{Listener: ln, Timeout: 50 * time.Millisecond}
+	defer l.Close()
+
+	out, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	out.Write([]byte("PROXY TCP4"))
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("got nil want timeout error")
+	}
+}
+
+func TestListenerServerFirst(t *testing.T) {
+	for _, required := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &Listener{Listener: ln, Required: required, Timeout: 50 * time.Millisecond}
+		defer l.Close()
+
+		// the client sends nothing until the server has sent its greeting
+		out, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if required {
+			if _, err := c.Read(make([]byte, 1)); err != errRequired {
+				t.Fatalf("got %v want %v", err, errRequired)
+			}
+			continue
+		}
+		if got, want := host, "127.0.0.1"; got != want {
+			t.Fatalf("got remote addr %s want %s", got, want)
+		}
+		if _, err := c.Write([]byte("220 ")); err != nil {
+			t.Fatal(err)
+		}
+		out.Write([]byte("EHLO"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "EHLO"; got != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	}
+}
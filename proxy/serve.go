@@ -3,9 +3,11 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"log"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fabiolb/fabio/config"
@@ -19,58 +21,161 @@ type Server interface {
 }
 
 var (
-	// mu guards servers which contains the list
-	// of running proxy servers.
-	mu      sync.Mutex
-	servers []Server
+	// mu guards servers and adminServers which contain the
+	// running proxy and admin servers.
+	mu           sync.Mutex
+	servers      []Server
+	adminServers []Server
+
+	// draining is set to 1 when the shutdown has started.
+	draining int32
+
+	// drainLogInterval is the interval in which the number of
+	// remaining connections is logged during the shutdown.
+	drainLogInterval = 5 * time.Second
 )
 
 func Close() {
 	mu.Lock()
-	for _, srv := range servers {
+	for _, srv := range append(servers, adminServers...) {
 		srv.Close()
 	}
 	servers = []Server{}
+	adminServers = []Server{}
+	mu.Unlock()
+}
+
+// CloseAdmin stops the admin servers. It is used when a new process
+// has taken over the listeners.
+func CloseAdmin() {
+	mu.Lock()
+	for _, srv := range adminServers {
+		srv.Close()
+	}
+	adminServers = []Server{}
 	mu.Unlock()
 }
 
-func Shutdown(timeout time.Duration) {
+// Draining returns true when the shutdown has started.
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Shutdown drains the proxy servers and then stops the admin servers.
+// New connections are refused immediately. Active HTTP requests have
+// the wait period to complete and TCP, SNI and websocket connections
+// have the drain period to close before they are closed by the proxy.
+// The drain period is at least as long as the wait period.
+func Shutdown(wait, drain time.Duration) {
+	atomic.StoreInt32(&draining, 1)
+
 	mu.Lock()
 	srvs := make([]Server, len(servers))
 	copy(srvs, servers)
 	servers = []Server{}
+	admin := adminServers
+	adminServers = []Server{}
 	mu.Unlock()
 
+	if drain < wait {
+		drain = wait
+	}
+	log.Printf("[INFO] Draining connections for up to %s", drain)
+
+	done := make(chan struct{})
+	go logDrain(srvs, done)
+
 	var wg sync.WaitGroup
-	for _, srv := range srvs {
+	var expired int32
+	shutdown := func(srv interface{ Shutdown(context.Context) error }, timeout time.Duration) {
 		wg.Add(1)
-		go func(srv Server) {
+		go func() {
 			defer wg.Done()
 			ctx, cancel := context.WithTimeout(context.Background(), timeout)
 			defer cancel()
-			srv.Shutdown(ctx)
-		}(srv)
+			if srv.Shutdown(ctx) != nil {
+				atomic.StoreInt32(&expired, 1)
+			}
+		}()
+	}
+	for _, srv := range srvs {
+		if _, ok := srv.(*http.Server); ok {
+			shutdown(srv, wait)
+		} else {
+			shutdown(srv, drain)
+		}
 	}
+	shutdown(wsConns, drain)
 	wg.Wait()
+	close(done)
+
+	if atomic.LoadInt32(&expired) == 1 {
+		log.Print("[WARN] Closed the remaining connections after the grace period")
+	} else {
+		log.Print("[INFO] Drained all connections")
+	}
+
+	for _, srv := range admin {
+		srv.Close()
+	}
+}
+
+// logDrain logs the number of remaining TCP and websocket connections
+// until done is closed.
+func logDrain(srvs []Server, done chan struct{}) {
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n := wsConns.Active()
+			for _, srv := range srvs {
+				if s, ok := srv.(*tcp.Server); ok {
+					n += s.Active()
+				}
+			}
+			log.Printf("[INFO] Draining %d connections", n)
+		}
+	}
 }
 
 func ListenAndServeHTTP(l config.Listen, h http.Handler, cfg *tls.Config) error {
-	ln, err := ListenTCP(l.Addr, cfg)
+	ln, err := Listen(l, cfg)
+	if err != nil {
+		return err
+	}
+	return serve(ln, newHTTPServer(l, h, cfg))
+}
+
+// ListenAndServeAdmin starts an HTTP server for the admin UI and API.
+// It is stopped after the proxy servers have been drained so that the
+// health check can report the shutdown.
+func ListenAndServeAdmin(l config.Listen, h http.Handler, cfg *tls.Config) error {
+	ln, err := Listen(l, cfg)
 	if err != nil {
 		return err
 	}
-	srv := &http.Server{
+	srv := newHTTPServer(l, h, cfg)
+	mu.Lock()
+	adminServers = append(adminServers, srv)
+	mu.Unlock()
+	return srv.Serve(ln)
+}
+
+func newHTTPServer(l config.Listen, h http.Handler, cfg *tls.Config) *http.Server {
+	return &http.Server{
 		Addr:         l.Addr,
 		Handler:      h,
 		ReadTimeout:  l.ReadTimeout,
 		WriteTimeout: l.WriteTimeout,
 		TLSConfig:    cfg,
 	}
-	return serve(ln, srv)
 }
 
 func ListenAndServeTCP(l config.Listen, h tcp.Handler, cfg *tls.Config) error {
-	ln, err := ListenTCP(l.Addr, cfg)
+	ln, err := ListenTCP(l, cfg)
 	if err != nil {
 		return err
 	}
@@ -89,3 +194,67 @@ func serve(ln net.Listener, srv Server) error {
 	mu.Unlock()
 	return srv.Serve(ln)
 }
+
+// wsConns contains the hijacked websocket connections which are not
+// tracked by the http server.
+var wsConns = &connSet{}
+
+// connSet is a set of connections which can be drained.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (s *connSet) add(c net.Conn) {
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]bool{}
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+}
+
+func (s *connSet) remove(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// Active returns the number of connections in the set.
+func (s *connSet) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Shutdown waits until all connections have been removed from the
+// set or the context is done. Then it closes the remaining ones.
+func (s *connSet) Shutdown(ctx context.Context) error {
+	err := waitIdle(ctx, s.Active)
+	s.Close()
+	return err
+}
+
+// Close closes all connections in the set.
+func (s *connSet) Close() error {
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// waitIdle polls active until it returns zero or the context is done.
+func waitIdle(ctx context.Context, active func() int) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for active() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -80,10 +80,26 @@ func (s *Server) Serve(l net.Listener) error {
 		}
 		s.conns[c] = true
 		s.mu.Unlock()
-		go s.Handler.ServeTCP(c)
+		go s.serve(c)
 	}
 }
 
+func (s *Server) serve(c net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+	s.Handler.ServeTCP(c)
+}
+
+// Active returns the number of open connections.
+func (s *Server) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
 func (s *Server) closeListeners() error {
 	s.mu.Lock()
 	for _, l := range s.listeners {
@@ -109,12 +125,27 @@ func (s *Server) Close() error {
 	return s.closeConns()
 }
 
+// Shutdown closes the listeners and waits until all connections have
+// been closed by their handlers or the context is done. Then it closes
+// the remaining connections and returns the error of the context.
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.closeListeners()
+	var err error
 	if ctx != nil {
-		<-ctx.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	wait:
+		for s.Active() > 0 {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				break wait
+			case <-ticker.C:
+			}
+		}
 	}
-	return s.closeConns()
+	s.closeConns()
+	return err
 }
 
 // conn implements a connection which honors read and write timeouts.
@@ -142,6 +173,11 @@ func (c *conn) Close() error {
 	return c.c.Close()
 }
 
+// NetConn returns the underlying connection.
+func (c *conn) NetConn() net.Conn {
+	return c.c
+}
+
 func (c *conn) LocalAddr() net.Addr {
 	return c.c.LocalAddr()
 }
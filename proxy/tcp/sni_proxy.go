@@ -5,6 +5,8 @@ import (
 	"log"
 	"net"
 	"time"
+
+	"github.com/fabiolb/fabio/route"
 )
 
 // SNIProxy implements an SNI aware transparent TCP proxy which captures the
@@ -19,7 +21,7 @@ type SNIProxy struct {
 
 	// Lookup returns a target host for the given server name.
 	// The proxy will panic if this value is nil.
-	Lookup func(host string) string
+	Lookup func(host string) *route.Target
 }
 
 func (p *SNIProxy) ServeTCP(in net.Conn) error {
@@ -44,18 +46,27 @@ func (p *SNIProxy) ServeTCP(in net.Conn) error {
 		return nil
 	}
 
-	addr := p.Lookup(host)
-	if addr == "" {
+	t := p.Lookup(host)
+	if t == nil {
 		return nil
 	}
+	network, addr := "tcp", t.URL.Host
+	if t.Socket != "" {
+		network, addr = "unix", t.Socket
+	}
 
-	out, err := net.DialTimeout("tcp", addr, p.DialTimeout)
+	out, err := net.DialTimeout(network, addr, p.DialTimeout)
 	if err != nil {
 		log.Print("[WARN] tcp+sni: cannot connect to upstream ", addr)
 		return err
 	}
 	defer out.Close()
 
+	if err := writeProxyHeader(out, in, t); err != nil {
+		log.Print("[WARN] tcp+sni: cannot write PROXY header to upstream ", addr)
+		return err
+	}
+
 	// copy client hello
 	_, err = out.Write(data)
 	if err != nil {
@@ -1,10 +1,16 @@
 package tcp
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"time"
+
+	"github.com/fabiolb/fabio/cert"
+	"github.com/fabiolb/fabio/proxy/proxyproto"
+	"github.com/fabiolb/fabio/route"
 )
 
 // Proxy implements a generic TCP proxying handler.
@@ -15,7 +21,11 @@ type Proxy struct {
 
 	// Lookup returns a target host for the given server name.
 	// The proxy will panic if this value is nil.
-	Lookup func(host string) string
+	Lookup func(host string) *route.Target
+
+	// UpstreamTLS provides the CA bundles and client certificates
+	// for targets with the 'tlsca' and 'tlscert' route options.
+	UpstreamTLS *cert.Upstream
 }
 
 func (p *Proxy) ServeTCP(in net.Conn) error {
@@ -23,18 +33,37 @@ func (p *Proxy) ServeTCP(in net.Conn) error {
 
 	_, port, _ := net.SplitHostPort(in.LocalAddr().String())
 	port = ":" + port
-	addr := p.Lookup(port)
-	if addr == "" {
+	t := p.Lookup(port)
+	if t == nil {
 		return nil
 	}
+	network, addr := "tcp", t.URL.Host
+	if t.Socket != "" {
+		network, addr = "unix", t.Socket
+	}
 
-	out, err := net.DialTimeout("tcp", addr, p.DialTimeout)
+	out, err := net.DialTimeout(network, addr, p.DialTimeout)
 	if err != nil {
 		log.Print("[WARN] tcp: cannot connect to upstream ", addr)
 		return err
 	}
 	defer out.Close()
 
+	// the PROXY header precedes the TLS handshake
+	if err := writeProxyHeader(out, in, t); err != nil {
+		log.Print("[WARN] tcp: cannot write PROXY header to upstream ", addr)
+		return err
+	}
+
+	if t.Socket == "" && (t.SNI != "" || t.TLSCA != "" || t.TLSCert != "" || t.TLSServerName != "") {
+		out, err = p.handshakeTLS(out, in, t)
+		if err != nil {
+			log.Print("[WARN] tcp: cannot connect to upstream ", addr)
+			return err
+		}
+		defer out.Close()
+	}
+
 	errc := make(chan error, 2)
 	cp := func(dst io.Writer, src io.Reader) {
 		_, err := io.Copy(dst, src)
@@ -50,3 +79,83 @@ func (p *Proxy) ServeTCP(in net.Conn) error {
 	}
 	return nil
 }
+
+var errNoServerName = errors.New("tcp: sni=host requires a TLS connection with server name")
+
+// handshakeTLS starts a TLS session on the upstream connection with the
+// TLS settings of the route. 'sni=host' sends the server name of the
+// TLS connection from the client.
+func (p *Proxy) handshakeTLS(out, in net.Conn, t *route.Target) (net.Conn, error) {
+	name := t.SNI
+	if name == "host" {
+		c, ok := in.(*tls.Conn)
+		if !ok {
+			return nil, errNoServerName
+		}
+		if err := c.Handshake(); err != nil {
+			return nil, err
+		}
+		if name = c.ConnectionState().ServerName; name == "" {
+			return nil, errNoServerName
+		}
+	}
+	if name == "" {
+		name = t.TLSServerName
+	}
+	if name == "" {
+		name, _, _ = net.SplitHostPort(t.URL.Host)
+	}
+	cfg, err := p.UpstreamTLS.TLSConfig(cert.UpstreamConfig{
+		CA:                 t.TLSCA,
+		Cert:               t.TLSCert,
+		ServerName:         name,
+		VerifyName:         t.TLSServerName,
+		InsecureSkipVerify: t.TLSSkipVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := tls.Client(out, cfg)
+	if p.DialTimeout > 0 {
+		c.SetDeadline(time.Now().Add(p.DialTimeout))
+		defer c.SetDeadline(time.Time{})
+	}
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// writeProxyHeader sends a PROXY protocol header with the client and
+// destination address of the client connection to the upstream server
+// if the route has the 'pxyproto' option. The addresses are taken from
+// the PROXY header of the client connection if it has one.
+func writeProxyHeader(out, in net.Conn, t *route.Target) error {
+	if t.ProxyProto == 0 {
+		return nil
+	}
+	src, _ := in.RemoteAddr().(*net.TCPAddr)
+	dst, _ := in.LocalAddr().(*net.TCPAddr)
+	if h := clientHeader(in); h != nil && h.Dst != nil {
+		dst = h.Dst
+	}
+	h := &proxyproto.Header{Version: t.ProxyProto, Src: src, Dst: dst}
+	_, err := h.WriteTo(out)
+	return err
+}
+
+// clientHeader returns the PROXY protocol header of the client
+// connection or nil if it has none. It looks through the wrappers of
+// the server and the TLS listener.
+func clientHeader(c net.Conn) *proxyproto.Header {
+	for {
+		switch x := c.(type) {
+		case *proxyproto.Conn:
+			return x.Header()
+		case interface{ NetConn() net.Conn }:
+			c = x.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -15,6 +16,7 @@ import (
 	"github.com/fabiolb/fabio/cert"
 	"github.com/fabiolb/fabio/config"
 	"github.com/fabiolb/fabio/proxy/internal"
+	"github.com/fabiolb/fabio/proxy/proxyproto"
 	"github.com/fabiolb/fabio/proxy/tcp"
 	"github.com/fabiolb/fabio/proxy/tcp/tcptest"
 	"github.com/fabiolb/fabio/route"
@@ -41,10 +43,52 @@ func TestTCPProxy(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.Proxy{
-			Lookup: func(h string) string {
+			Lookup: func(h string) *route.Target {
 				tbl, _ := route.NewTable("route add srv :57778 tcp://" + srv.Addr)
-				t := tbl.LookupHost(h, route.Picker["rr"])
-				return t.URL.Host
+				return tbl.LookupHost(h, route.Picker["rr"])
+			},
+		}
+		l := config.Listen{Addr: proxyAddr}
+		if err := ListenAndServeTCP(l, h, nil); err != nil {
+			t.Log("ListenAndServeTCP: ", err)
+		}
+	}()
+	defer Close()
+
+	// connect to proxy
+	out, err := tcptest.NewRetryDialer().Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("net.Dial: %#v", err)
+	}
+	defer out.Close()
+
+	testRoundtrip(t, out)
+}
+
+// TestTCPProxyToUnixUpstream tests proxying a TCP connection
+// to an upstream server on a unix socket.
+func TestTCPProxyToUnixUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabio")
+	if err != nil {
+		t.Fatal("ioutil.TempDir", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "upstream.sock")
+
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	go (&tcp.Server{Handler: echoHandler}).Serve(ul)
+
+	// start proxy
+	proxyAddr := "127.0.0.1:57782"
+	go func() {
+		h := &tcp.Proxy{
+			Lookup: func(h string) *route.Target {
+				tbl, _ := route.NewTable("route add srv :57782 unix://" + sock)
+				return tbl.LookupHost(h, route.Picker["rr"])
 			},
 		}
 		l := config.Listen{Addr: proxyAddr}
@@ -101,7 +145,7 @@ func TestTCPProxyWithTLS(t *testing.T) {
 		}
 
 		h := &tcp.Proxy{
-			Lookup: func(string) string { return srv.Addr },
+			Lookup: func(string) *route.Target { return &route.Target{URL: mustParse("tcp://" + srv.Addr)} },
 		}
 
 		l := config.Listen{Addr: proxyAddr}
@@ -148,7 +192,7 @@ func TestTCPSNIProxy(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.SNIProxy{
-			Lookup: func(string) string { return srv.Addr },
+			Lookup: func(string) *route.Target { return &route.Target{URL: mustParse("tcp://" + srv.Addr)} },
 		}
 		l := config.Listen{Addr: proxyAddr}
 		if err := ListenAndServeTCP(l, h, nil); err != nil {
@@ -176,6 +220,160 @@ func TestTCPSNIProxy(t *testing.T) {
 	testRoundtrip(t, out)
 }
 
+// TestTCPProxyToTLSUpstream tests proxying an unencrypted TCP
+// connection to an upstream TCP server with TLS. The proxy opens
+// the TLS connection with the server name of the route.
+func TestTCPProxyToTLSUpstream(t *testing.T) {
+	srv := tcptest.NewTLSServer(echoHandler)
+	defer srv.Close()
+
+	upstream, cleanup := testUpstreamTLS(t)
+	defer cleanup()
+
+	// start proxy
+	proxyAddr := "127.0.0.1:57780"
+	go func() {
+		h := &tcp.Proxy{
+			Lookup: func(h string) *route.Target {
+				tbl, _ := route.NewTable("route add srv :57780 tcp://" + srv.Addr + ` opts "sni=example.com tlsca=up"`)
+				return tbl.LookupHost(h, route.Picker["rr"])
+			},
+			UpstreamTLS: upstream,
+		}
+		l := config.Listen{Addr: proxyAddr}
+		if err := ListenAndServeTCP(l, h, nil); err != nil {
+			t.Log("ListenAndServeTCP: ", err)
+		}
+	}()
+	defer Close()
+
+	// connect to proxy
+	out, err := tcptest.NewRetryDialer().Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("net.Dial: %#v", err)
+	}
+	defer out.Close()
+
+	testRoundtrip(t, out)
+}
+
+// TestTCPProxyWithProxyProto tests that the proxy sends a PROXY
+// protocol header with the client address to the upstream server.
+func TestTCPProxyWithProxyProto(t *testing.T) {
+	hdrc := make(chan *proxyproto.Header, 1)
+	srv := tcptest.NewServer(tcp.HandlerFunc(func(c net.Conn) error {
+		br := bufio.NewReader(c)
+		h, err := proxyproto.Read(br)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		hdrc <- h
+		return echoHandler(bufConn{c, br})
+	}))
+	defer srv.Close()
+
+	// start proxy
+	proxyAddr := "127.0.0.1:57784"
+	go func() {
+		h := &tcp.Proxy{
+			Lookup: func(h string) *route.Target {
+				tbl, _ := route.NewTable("route add srv :57784 tcp://" + srv.Addr + ` opts "pxyproto=v1"`)
+				return tbl.LookupHost(h, route.Picker["rr"])
+			},
+		}
+		l := config.Listen{Addr: proxyAddr}
+		if err := ListenAndServeTCP(l, h, nil); err != nil {
+			t.Log("ListenAndServeTCP: ", err)
+		}
+	}()
+	defer Close()
+
+	// connect to proxy
+	out, err := tcptest.NewRetryDialer().Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("net.Dial: %#v", err)
+	}
+	defer out.Close()
+
+	testRoundtrip(t, out)
+
+	h := <-hdrc
+	if got, want := h.Version, 1; got != want {
+		t.Fatalf("got version %d want %d", got, want)
+	}
+	if got, want := h.Src.String(), out.LocalAddr().String(); got != want {
+		t.Fatalf("got src %s want %s", got, want)
+	}
+	if got, want := h.Dst.String(), proxyAddr; got != want {
+		t.Fatalf("got dst %s want %s", got, want)
+	}
+}
+
+// TestTCPProxyForwardsProxyProto tests that the proxy passes the
+// addresses of the PROXY header from the client to the upstream server.
+func TestTCPProxyForwardsProxyProto(t *testing.T) {
+	hdrc := make(chan *proxyproto.Header, 1)
+	srv := tcptest.NewServer(tcp.HandlerFunc(func(c net.Conn) error {
+		br := bufio.NewReader(c)
+		h, err := proxyproto.Read(br)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		hdrc <- h
+		return echoHandler(bufConn{c, br})
+	}))
+	defer srv.Close()
+
+	// start proxy
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	proxyAddr := "127.0.0.1:57785"
+	go func() {
+		h := &tcp.Proxy{
+			Lookup: func(h string) *route.Target {
+				tbl, _ := route.NewTable("route add srv :57785 tcp://" + srv.Addr + ` opts "pxyproto=v1"`)
+				return tbl.LookupHost(h, route.Picker["rr"])
+			},
+		}
+		l := config.Listen{Addr: proxyAddr, ProxyProto: "required", ProxyProtoTrust: []*net.IPNet{loopback}}
+		if err := ListenAndServeTCP(l, h, nil); err != nil {
+			t.Log("ListenAndServeTCP: ", err)
+		}
+	}()
+	defer Close()
+
+	// connect to proxy
+	out, err := tcptest.NewRetryDialer().Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("net.Dial: %#v", err)
+	}
+	defer out.Close()
+
+	if _, err := out.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n")); err != nil {
+		t.Fatal("out.Write: ", err)
+	}
+	testRoundtrip(t, out)
+
+	h := <-hdrc
+	if got, want := h.Src.String(), "1.2.3.4:1234"; got != want {
+		t.Fatalf("got src %s want %s", got, want)
+	}
+	if got, want := h.Dst.String(), "5.6.7.8:443"; got != want {
+		t.Fatalf("got dst %s want %s", got, want)
+	}
+}
+
+// bufConn reads from a buffered reader of the connection.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 func testRoundtrip(t *testing.T, c net.Conn) {
 	// send data to server
 	_, err := c.Write([]byte("foo\n"))
@@ -1,15 +1,20 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/logger"
 	"github.com/fabiolb/fabio/route"
 
 	"golang.org/x/net/websocket"
@@ -77,6 +82,203 @@ func TestProxyWSUpstream(t *testing.T) {
 	t.Run("ws-ws via http proxy with gzip", func(t *testing.T) { testWSEcho(t, "ws://"+httpProxyURL+"/ws", h) })
 }
 
+func TestProxyWSSession(t *testing.T) {
+	wsServer := httptest.NewServer(websocket.Handler(wsEchoHandler))
+	defer wsServer.Close()
+
+	tbl, err := route.NewTable("route add ws /ws " + wsServer.URL + ` opts "wsmaxconns=1 wsidletimeout=200ms"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := make(chan string, 10)
+	l, err := logger.New(chanWriter(logs), "$response_status $response_body_size")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Config:    config.Proxy{NoRouteStatus: 404},
+		Transport: http.DefaultTransport,
+		Logger:    l,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+	url := "ws://" + proxy.URL[len("http://"):] + "/ws"
+
+	ws, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, err := ws.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second connection exceeds the limit
+	if _, err := websocket.Dial(url, "", "http://localhost/"); err == nil {
+		t.Fatal("got nil want error")
+	}
+	if got, want := <-logs, "503 0\n"; got != want {
+		t.Fatalf("got log %q want %q", got, want)
+	}
+
+	// the first connection is closed after the idle timeout
+	// and logged with the bytes sent to the client.
+	buf := make([]byte, 100)
+	ws.Read(buf)
+	if _, err := ws.Read(buf); err == nil {
+		t.Fatal("got nil want error after idle timeout")
+	}
+	select {
+	case got := <-logs:
+		if !strings.HasPrefix(got, "101 ") || got == "101 0\n" {
+			t.Fatalf("got log %q want '101 <bytes>'", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestProxyWSHeaderOptions(t *testing.T) {
+	wsServer := httptest.NewServer(websocket.Handler(wsEchoHandler))
+	defer wsServer.Close()
+
+	tbl, err := route.NewTable("route add ws /ws " + wsServer.URL + ` opts "resphdr.set.X-Route=ws"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	host := proxy.URL[len("http://"):]
+	c, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := "GET /ws HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Origin: http://localhost/\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusSwitchingProtocols; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := resp.Header.Get("X-Route"), "ws"; got != want {
+		t.Fatalf("got X-Route %q want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Fatalf("got Sec-WebSocket-Accept %q want %q", got, want)
+	}
+}
+
+func TestProxyWSConnGauge(t *testing.T) {
+	g := &wsGauge{n: -1}
+
+	wsServer := httptest.NewServer(websocket.Handler(wsEchoHandler))
+	defer wsServer.Close()
+
+	tbl, err := route.NewTable("route add ws /ws " + wsServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is logged after it has been closed
+	logs := make(chan string, 1)
+	l, err := logger.New(chanWriter(logs), "$response_status")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Logger:    l,
+		WSConns:   g,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"])
+		},
+	})
+	defer proxy.Close()
+
+	ws, err := websocket.Dial("ws://"+proxy.URL[len("http://"):]+"/ws", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.Read(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.value(), int64(1); got != want {
+		t.Fatalf("got %d open sessions want %d", got, want)
+	}
+
+	ws.Close()
+	select {
+	case <-logs:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	if got, want := g.value(), int64(0); got != want {
+		t.Fatalf("got %d open sessions want %d", got, want)
+	}
+}
+
+func TestProxyWSH2CUpstreamTLS(t *testing.T) {
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return &route.Target{URL: mustParse("https://127.0.0.1:1"), Proto: "h2c"}
+		},
+	})
+	defer proxy.Close()
+
+	req, err := http.NewRequest("GET", proxy.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadGateway; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+}
+
+type wsGauge struct{ n int64 }
+
+func (g *wsGauge) Update(n int64) { atomic.StoreInt64(&g.n, n) }
+func (g *wsGauge) value() int64   { return atomic.LoadInt64(&g.n) }
+
+// chanWriter sends every write to the channel.
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
 func testWSEcho(t *testing.T, url string, hdr http.Header) {
 	cfg, err := websocket.NewConfig(url, "http://localhost/")
 	if err != nil {
@@ -0,0 +1,154 @@
+// Package ratelimit implements a token bucket rate limiter
+// which maintains a separate bucket per key.
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is the maximum number of buckets of a limiter
+// if MaxKeys is not set.
+const DefaultMaxKeys = 10000
+
+// Limiter limits the rate of events per key with the token bucket
+// algorithm. Each bucket holds up to Burst tokens and is refilled with
+// Rate tokens per second. Every event consumes one token and events are
+// rejected when the bucket of their key is empty. A Limiter is safe to
+// be used by multiple go routines.
+//
+// The number of buckets is limited since clients can choose the keys.
+// When the limit is reached the least recently used bucket is removed.
+type Limiter struct {
+	// Rate is the number of tokens per second added to a bucket.
+	Rate float64
+
+	// Burst is the maximum number of tokens in a bucket.
+	Burst int
+
+	// MaxKeys is the maximum number of buckets. The default
+	// is DefaultMaxKeys.
+	MaxKeys int
+
+	// Time returns the current time. If Time is nil, time.Now is used.
+	Time func() time.Time
+
+	// mu guards buckets and lru which contains the buckets
+	// from the most to the least recently used.
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter for rate events per second with the given burst
+// size. If burst is smaller than one it is set to the rate rounded up.
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{Rate: rate, Burst: burst}
+}
+
+// Allow reports whether an event for the key may happen now and consumes
+// a token if it does. If the event is rejected Allow returns the duration
+// after which the next token becomes available.
+func (l *Limiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+	if l.Time != nil {
+		now = l.Time()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lru == nil {
+		l.buckets = map[string]*list.Element{}
+		l.lru = list.New()
+	}
+	l.sweep(now)
+
+	e := l.buckets[key]
+	if e == nil {
+		max := l.MaxKeys
+		if max <= 0 {
+			max = DefaultMaxKeys
+		}
+		if l.lru.Len() >= max {
+			l.remove(l.lru.Back())
+		}
+		e = l.lru.PushFront(&bucket{key: key, tokens: float64(l.Burst), last: now})
+		l.buckets[key] = e
+	} else {
+		l.lru.MoveToFront(e)
+	}
+	b := e.Value.(*bucket)
+
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.Rate <= 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// sweep removes the buckets which have been refilled completely since
+// they are indistinguishable from new ones. The least recently used
+// buckets are checked first so that the cost of Allow stays constant.
+func (l *Limiter) sweep(now time.Time) {
+	if l.Rate <= 0 {
+		return
+	}
+	refill := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*bucket).last) >= refill; e = l.lru.Back() {
+		l.remove(e)
+	}
+}
+
+func (l *Limiter) remove(e *list.Element) {
+	delete(l.buckets, e.Value.(*bucket).key)
+	l.lru.Remove(e)
+}
+
+// ParseRate parses a rate in the form of '<n>/<unit>' where unit is one
+// of 's', 'm' or 'h' and returns the rate in events per second. A rate
+// without unit is per second.
+func ParseRate(s string) (float64, error) {
+	n, unit := s, "s"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, unit = s[:i], s[i+1:]
+	}
+
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil || f <= 0 {
+		return 0, errors.New("ratelimit: invalid rate " + s)
+	}
+
+	switch unit {
+	case "s":
+		return f, nil
+	case "m":
+		return f / 60, nil
+	case "h":
+		return f / 3600, nil
+	default:
+		return 0, errors.New("ratelimit: invalid rate unit " + s)
+	}
+}
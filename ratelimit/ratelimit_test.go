@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(2, 3)
+	l.Time = func() time.Time { return now }
+
+	allow := func(key string, want bool) {
+		t.Helper()
+		if got, _ := l.Allow(key); got != want {
+			t.Fatalf("%s at %s: got %v want %v", key, now.Sub(time.Unix(0, 0)), got, want)
+		}
+	}
+
+	// burst
+	allow("a", true)
+	allow("a", true)
+	allow("a", true)
+	allow("a", false)
+
+	// separate bucket per key
+	allow("b", true)
+
+	// retry after
+	if _, d := l.Allow("a"); d != 500*time.Millisecond {
+		t.Fatalf("got retry after %s want 500ms", d)
+	}
+
+	// refill
+	now = now.Add(500 * time.Millisecond)
+	allow("a", true)
+	allow("a", false)
+
+	now = now.Add(10 * time.Second)
+	allow("a", true)
+	allow("a", true)
+	allow("a", true)
+	allow("a", false)
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(1, 1)
+	l.Time = func() time.Time { return now }
+
+	l.Allow("a")
+	l.Allow("b")
+	now = now.Add(2 * time.Second)
+	l.Allow("c")
+
+	if got, want := len(l.buckets), 1; got != want {
+		t.Fatalf("got %d buckets want %d", got, want)
+	}
+}
+
+func TestLimiterMaxKeys(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(1.0/3600, 1)
+	l.MaxKeys = 2
+	l.Time = func() time.Time { return now }
+
+	l.Allow("a")
+	l.Allow("b")
+	l.Allow("a")
+	l.Allow("c")
+
+	if got, want := len(l.buckets), 2; got != want {
+		t.Fatalf("got %d buckets want %d", got, want)
+	}
+	// the least recently used bucket was removed
+	if l.buckets["b"] != nil {
+		t.Fatal("got bucket for b want none")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("got a allowed want rejected")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		rate float64
+		err  bool
+	}{
+		{"100", 100, false},
+		{"100/s", 100, false},
+		{"60/m", 1, false},
+		{"3600/h", 1, false},
+		{"0.5/s", 0.5, false},
+		{"", 0, true},
+		{"0/s", 0, true},
+		{"-1/s", 0, true},
+		{"abc/s", 0, true},
+		{"10/d", 0, true},
+	}
+
+	for _, tt := range tests {
+		rate, err := ParseRate(tt.in)
+		if got, want := err != nil, tt.err; got != want {
+			t.Errorf("%q: got error %v want %v", tt.in, err, want)
+		}
+		if got, want := rate, tt.rate; got != want {
+			t.Errorf("%q: got rate %v want %v", tt.in, got, want)
+		}
+	}
+}
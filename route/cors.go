@@ -0,0 +1,94 @@
+package route
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+)
+
+// CORS contains the Cross-Origin Resource Sharing configuration of a
+// route.
+type CORS struct {
+	// Origins contains the allowed origins. An origin can contain '*'
+	// as wildcard, e.g. 'https://*.example.com'. A single '*' allows all
+	// origins.
+	Origins []string
+
+	// Methods contains the allowed methods for preflight requests.
+	Methods []string
+
+	// Headers contains the allowed request headers for preflight
+	// requests. If it is empty the requested headers are allowed.
+	Headers []string
+
+	// ExposeHeaders contains the response headers which the browser
+	// exposes to the client.
+	ExposeHeaders []string
+
+	// Credentials allows requests with credentials.
+	Credentials bool
+
+	// MaxAge is the duration for which the result of a preflight
+	// request can be cached.
+	MaxAge time.Duration
+}
+
+// AllowOrigin returns true if the origin matches one of the
+// allowed origins.
+func (c *CORS) AllowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range c.Origins {
+		if glob.Glob(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowAll returns true if all origins are allowed.
+func (c *CORS) AllowAll() bool {
+	for _, o := range c.Origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCORS creates the CORS configuration from the 'cors.*' route
+// options. It returns nil if 'cors.origins' is not set.
+func parseCORS(opts map[string]string) *CORS {
+	if opts["cors.origins"] == "" {
+		return nil
+	}
+
+	list := func(s string) []string {
+		var a []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				a = append(a, v)
+			}
+		}
+		return a
+	}
+
+	c := &CORS{
+		Origins:       list(opts["cors.origins"]),
+		Methods:       list(strings.ToUpper(opts["cors.methods"])),
+		Headers:       list(opts["cors.headers"]),
+		ExposeHeaders: list(opts["cors.expose"]),
+		Credentials:   opts["cors.credentials"] == "true",
+		MaxAge:        parseDurationOpt(opts, "cors.maxage"),
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD", "POST"}
+	}
+	if c.Credentials && c.AllowAll() {
+		log.Print("[WARN] route: cors.origins=* with cors.credentials=true echoes the request origin")
+	}
+	return c
+}
@@ -0,0 +1,77 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCORS(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts map[string]string
+		cors *CORS
+	}{
+		{"no opts", nil, nil},
+		{"no origins", map[string]string{"cors.methods": "GET"}, nil},
+		{
+			"defaults",
+			map[string]string{"cors.origins": "*"},
+			&CORS{Origins: []string{"*"}, Methods: []string{"GET", "HEAD", "POST"}},
+		},
+		{
+			"all options",
+			map[string]string{
+				"cors.origins":     "https://a.com, https://*.b.com",
+				"cors.methods":     "get,put",
+				"cors.headers":     "X-A,X-B",
+				"cors.expose":      "X-C",
+				"cors.credentials": "true",
+				"cors.maxage":      "10m",
+			},
+			&CORS{
+				Origins:       []string{"https://a.com", "https://*.b.com"},
+				Methods:       []string{"GET", "PUT"},
+				Headers:       []string{"X-A", "X-B"},
+				ExposeHeaders: []string{"X-C"},
+				Credentials:   true,
+				MaxAge:        10 * time.Minute,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := parseCORS(tt.opts), tt.cors; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %#v want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestCORSAllowOrigin(t *testing.T) {
+	c := &CORS{Origins: []string{"https://a.com", "https://*.b.com"}}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", false},
+		{"https://a.com", true},
+		{"http://a.com", false},
+		{"https://x.a.com", false},
+		{"https://x.b.com", true},
+		{"https://x.y.b.com", true},
+		{"https://b.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := c.AllowOrigin(tt.origin); got != tt.want {
+			t.Errorf("%q: got %v want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	if (&CORS{Origins: []string{"*"}}).AllowOrigin("") {
+		t.Error("empty origin allowed")
+	}
+}
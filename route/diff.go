@@ -0,0 +1,77 @@
+package route
+
+import (
+	"math"
+	"sort"
+)
+
+// TargetChange describes a target which differs between
+// two routing tables.
+type TargetChange struct {
+	Service   string  `json:"service"`
+	Src       string  `json:"src"`
+	Dst       string  `json:"dst"`
+	Weight    float64 `json:"weight"`
+	OldWeight float64 `json:"oldWeight"`
+}
+
+// TableDiff contains the targets which have been added, removed
+// or whose weight has changed between two routing tables.
+type TableDiff struct {
+	Added      []TargetChange `json:"added"`
+	Removed    []TargetChange `json:"removed"`
+	Reweighted []TargetChange `json:"reweighted"`
+}
+
+// Diff returns the targets which differ between the routing tables.
+// Targets are identified by service, source and destination and the
+// changes are sorted by source, service and destination.
+func Diff(from, to Table) TableDiff {
+	type key struct{ service, src, dst string }
+
+	weights := func(t Table) map[key]float64 {
+		m := map[key]float64{}
+		for _, routes := range t {
+			for _, r := range routes {
+				for _, tg := range r.Targets {
+					m[key{tg.Service, r.Host + r.Path, tg.URL.String()}] = tg.Weight
+				}
+			}
+		}
+		return m
+	}
+
+	a, b := weights(from), weights(to)
+	d := TableDiff{
+		Added:      []TargetChange{},
+		Removed:    []TargetChange{},
+		Reweighted: []TargetChange{},
+	}
+	for k, w := range b {
+		old, ok := a[k]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, TargetChange{Service: k.service, Src: k.src, Dst: k.dst, Weight: w})
+		case math.Abs(old-w) > 1e-9:
+			d.Reweighted = append(d.Reweighted, TargetChange{Service: k.service, Src: k.src, Dst: k.dst, Weight: w, OldWeight: old})
+		}
+	}
+	for k, w := range a {
+		if _, ok := b[k]; !ok {
+			d.Removed = append(d.Removed, TargetChange{Service: k.service, Src: k.src, Dst: k.dst, OldWeight: w})
+		}
+	}
+
+	for _, c := range [][]TargetChange{d.Added, d.Removed, d.Reweighted} {
+		sort.Slice(c, func(i, j int) bool {
+			if c[i].Src != c[j].Src {
+				return c[i].Src < c[j].Src
+			}
+			if c[i].Service != c[j].Service {
+				return c[i].Service < c[j].Service
+			}
+			return c[i].Dst < c[j].Dst
+		})
+	}
+	return d
+}
@@ -0,0 +1,47 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	from, err := NewTable(`
+	route add svc-a / http://1.2.3.4/
+	route add svc-a / http://1.2.3.5/
+	route add svc-b /b http://1.2.3.6/
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewTable(`
+	route add svc-a / http://1.2.3.4/
+	route add svc-a / http://1.2.3.5/
+	route add svc-a / http://1.2.3.7/
+	route add svc-b /b http://1.2.3.6/ weight 0.5
+	route add svc-c /c http://1.2.3.8/
+	route del svc-a / http://1.2.3.5/
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := Diff(from, to)
+	want := TableDiff{
+		Added: []TargetChange{
+			{Service: "svc-a", Src: "/", Dst: "http://1.2.3.7/", Weight: 0.5},
+			{Service: "svc-c", Src: "/c", Dst: "http://1.2.3.8/", Weight: 1},
+		},
+		Removed: []TargetChange{
+			{Service: "svc-a", Src: "/", Dst: "http://1.2.3.5/", OldWeight: 0.5},
+		},
+		Reweighted: []TargetChange{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+
+	if got := Diff(to, to); len(got.Added)+len(got.Removed)+len(got.Reweighted) != 0 {
+		t.Fatalf("got %+v want no changes", got)
+	}
+}
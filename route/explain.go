@@ -0,0 +1,97 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Explanation describes how the routing table selects the route
+// for a request.
+type Explanation struct {
+	// Host is the normalized host name of the request.
+	Host string `json:"host"`
+
+	// Path is the path of the request.
+	Path string `json:"path"`
+
+	// Hosts contains the matching host patterns in the order in which
+	// they were evaluated. The last entry is the fallback for routes
+	// without a host.
+	Hosts []HostExplanation `json:"hosts"`
+
+	// Route is the source of the selected route. It is empty if
+	// no route matches.
+	Route string `json:"route,omitempty"`
+
+	// Targets contains the targets of the selected route from
+	// which the picker chooses.
+	Targets []TargetWeight `json:"targets,omitempty"`
+}
+
+// HostExplanation contains the routes which were evaluated
+// for a host pattern.
+type HostExplanation struct {
+	Pattern string             `json:"pattern"`
+	Routes  []RouteExplanation `json:"routes"`
+}
+
+// RouteExplanation describes why a route matched or not.
+type RouteExplanation struct {
+	Src    string `json:"src"`
+	Prio   int    `json:"prio,omitempty"`
+	Match  bool   `json:"match"`
+	Reason string `json:"reason"`
+}
+
+// TargetWeight is a target of a route with its weight.
+type TargetWeight struct {
+	Service string  `json:"service"`
+	Dst     string  `json:"dst"`
+	Weight  float64 `json:"weight"`
+}
+
+// Explain evaluates the routes for the request in the same way as
+// Lookup and returns which hosts and routes were evaluated, why they
+// matched or not and the targets of the selected route.
+func (t Table) Explain(req *http.Request, matcherName string) *Explanation {
+	match := Matcher[matcherName]
+	if match == nil {
+		match = prefixMatcher
+		matcherName = "prefix"
+	}
+
+	e := &Explanation{Host: normalizeHost(req), Path: req.URL.Path}
+	hosts := append(t.matchingHosts(req, nil), "")
+	for _, h := range hosts {
+		he := HostExplanation{Pattern: h, Routes: []RouteExplanation{}}
+		var selected *Route
+		for _, r := range t[h] {
+			re := RouteExplanation{Src: r.Host + r.Path, Prio: r.Prio}
+			switch {
+			case !match(e.Path, r):
+				re.Reason = fmt.Sprintf("%s matcher: path %q does not match %q", matcherName, e.Path, r.Path)
+			case len(r.Targets) == 0:
+				re.Match = true
+				re.Reason = "route has no targets"
+			default:
+				re.Match = true
+				re.Reason = fmt.Sprintf("%s matcher: path %q matches %q", matcherName, e.Path, r.Path)
+				selected = r
+			}
+			he.Routes = append(he.Routes, re)
+			if re.Match {
+				break
+			}
+		}
+		e.Hosts = append(e.Hosts, he)
+
+		if selected != nil {
+			e.Route = selected.Host + selected.Path
+			for _, tg := range selected.Targets {
+				e.Targets = append(e.Targets, TargetWeight{Service: tg.Service, Dst: tg.URL.String(), Weight: tg.Weight})
+			}
+			break
+		}
+	}
+	return e
+}
@@ -0,0 +1,50 @@
+package route
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTableExplain(t *testing.T) {
+	s := `
+	route add svc / http://foo.com:800
+	route add svc abc.com/ http://foo.com:1000
+	route add svc abc.com/foo http://foo.com:1500
+	route add svc abc.com/foo http://foo.com:1600 weight 0.25
+	route add svc *.com/bar http://foo.com:2000
+	`
+
+	tbl, err := NewTable(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := tbl.Explain(&http.Request{Host: "abc.com:80", URL: mustParse("/foo/bar")}, "prefix")
+	want := &Explanation{
+		Host: "abc.com",
+		Path: "/foo/bar",
+		Hosts: []HostExplanation{
+			{Pattern: "*.com", Routes: []RouteExplanation{
+				{Src: "*.com/bar", Reason: `prefix matcher: path "/foo/bar" does not match "/bar"`},
+			}},
+			{Pattern: "abc.com", Routes: []RouteExplanation{
+				{Src: "abc.com/foo", Match: true, Reason: `prefix matcher: path "/foo/bar" matches "/foo"`},
+			}},
+		},
+		Route: "abc.com/foo",
+		Targets: []TargetWeight{
+			{Service: "svc", Dst: "http://foo.com:1500", Weight: 0.75},
+			{Service: "svc", Dst: "http://foo.com:1600", Weight: 0.25},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+
+	// falls back to routes without host
+	got = tbl.Explain(&http.Request{Host: "def.org", URL: mustParse("/")}, "glob")
+	if got.Route != "/" || len(got.Hosts) != 1 || got.Hosts[0].Pattern != "" {
+		t.Fatalf("got %+v want fallback route", got)
+	}
+}
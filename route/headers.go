@@ -0,0 +1,96 @@
+package route
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// HeaderOp describes a modification of a single HTTP header
+// which is applied to the request before it is forwarded to
+// the upstream server or to the response before it is returned
+// to the client.
+type HeaderOp struct {
+	// Action is one of "del", "set" or "add".
+	Action string
+
+	// Name is the canonical name of the header.
+	Name string
+
+	// Value is the header value for "set" and "add". It may contain
+	// variables like $remote_host which are expanded by the proxy.
+	Value string
+}
+
+// header actions in the order in which they are applied.
+var headerActions = []string{"del", "set", "add"}
+
+// parseHeaderOps extracts the header modifications for the given
+// prefix, e.g. 'reqhdr' or 'resphdr', from the route options.
+//
+//   <prefix>.del=Name1,Name2
+//   <prefix>.set.<Name>=<value>
+//   <prefix>.add.<Name>=<value>
+//
+// Values are unescaped with url.PathUnescape so that spaces and other
+// characters which are not allowed in the options can be encoded,
+// e.g. 'max-age=31536000;%20includeSubDomains'. The operations are
+// returned in the order in which they should be applied: del, set, add
+// and within each action by header name.
+func parseHeaderOps(prefix string, opts map[string]string) []HeaderOp {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	var ops []HeaderOp
+	for k, v := range opts {
+		if !strings.HasPrefix(k, prefix+".") {
+			continue
+		}
+		action, name := k[len(prefix)+1:], ""
+		if n := strings.IndexByte(action, '.'); n >= 0 {
+			action, name = action[:n], action[n+1:]
+		}
+
+		switch {
+		case action == "del" && name == "":
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					ops = append(ops, HeaderOp{Action: "del", Name: http.CanonicalHeaderKey(s)})
+				}
+			}
+
+		case (action == "set" || action == "add") && name != "":
+			val, err := url.PathUnescape(v)
+			if err != nil {
+				log.Printf("[WARN] route: Ignoring invalid header value for %s. %s", k, err)
+				continue
+			}
+			ops = append(ops, HeaderOp{Action: action, Name: http.CanonicalHeaderKey(name), Value: val})
+
+		default:
+			log.Printf("[WARN] route: Ignoring invalid header option %s", k)
+		}
+	}
+
+	rank := func(action string) int {
+		for i, a := range headerActions {
+			if a == action {
+				return i
+			}
+		}
+		return len(headerActions)
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		if ops[i].Action != ops[j].Action {
+			return rank(ops[i].Action) < rank(ops[j].Action)
+		}
+		if ops[i].Name != ops[j].Name {
+			return ops[i].Name < ops[j].Name
+		}
+		return ops[i].Value < ops[j].Value
+	})
+	return ops
+}
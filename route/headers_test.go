@@ -0,0 +1,70 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaderOps(t *testing.T) {
+	tests := []struct {
+		desc   string
+		prefix string
+		opts   map[string]string
+		ops    []HeaderOp
+	}{
+		{"no opts", "reqhdr", nil, nil},
+		{"other opts", "reqhdr", map[string]string{"strip": "/foo"}, nil},
+		{
+			"del",
+			"resphdr",
+			map[string]string{"resphdr.del": "server,x-powered-by"},
+			[]HeaderOp{
+				{Action: "del", Name: "Server"},
+				{Action: "del", Name: "X-Powered-By"},
+			},
+		},
+		{
+			"set with escaped value",
+			"resphdr",
+			map[string]string{"resphdr.set.strict-transport-security": "max-age=31536000;%20includeSubDomains"},
+			[]HeaderOp{
+				{Action: "set", Name: "Strict-Transport-Security", Value: "max-age=31536000; includeSubDomains"},
+			},
+		},
+		{
+			"ordered by action and name",
+			"reqhdr",
+			map[string]string{
+				"reqhdr.add.X-B":    "$remote_host",
+				"reqhdr.set.X-C":    "c",
+				"reqhdr.set.X-A":    "a",
+				"reqhdr.del":        "X-D",
+				"resphdr.set.X-Foo": "bar",
+			},
+			[]HeaderOp{
+				{Action: "del", Name: "X-D"},
+				{Action: "set", Name: "X-A", Value: "a"},
+				{Action: "set", Name: "X-C", Value: "c"},
+				{Action: "add", Name: "X-B", Value: "$remote_host"},
+			},
+		},
+		{
+			"invalid options are ignored",
+			"reqhdr",
+			map[string]string{
+				"reqhdr.set":       "a",
+				"reqhdr.foo.X-A":   "a",
+				"reqhdr.set.X-Bad": "%zz",
+			},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := parseHeaderOps(tt.prefix, tt.opts), tt.ops; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %#v want %#v", got, want)
+			}
+		})
+	}
+}
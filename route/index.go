@@ -0,0 +1,169 @@
+package route
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+)
+
+// index speeds up the lookup of routes in large routing tables. It
+// provides the same results as globbing over all host patterns and
+// scanning the routes of a host in order.
+//
+// Host patterns without a wildcard are matched with a map lookup and
+// patterns of the form '*<suffix>' through a map of suffixes. Only the
+// remaining patterns are globbed. For each host the routes are stored
+// in a radix tree by path which finds the longest matching path prefix.
+// This is the same route the prefix matcher finds first since routes
+// are sorted from most to least specific. Hosts with route priorities
+// have no tree since the order of their routes is different.
+type index struct {
+	// exact contains the host patterns without a wildcard.
+	exact map[string]bool
+
+	// suffix maps the suffix of '*<suffix>' patterns to the pattern.
+	suffix map[string]string
+
+	// globs contains all other host patterns.
+	globs []string
+
+	// paths contains the path tree for each host pattern
+	// whose routes have no priority.
+	paths map[string]*pathTree
+}
+
+func newIndex(hosts map[string]Routes) *index {
+	idx := &index{
+		exact:  map[string]bool{},
+		suffix: map[string]string{},
+		paths:  map[string]*pathTree{},
+	}
+	for host, routes := range hosts {
+		switch n := strings.Count(host, glob.GLOB); {
+		case n == 0:
+			idx.exact[host] = true
+		case n == 1 && strings.HasPrefix(host, glob.GLOB):
+			idx.suffix[host[1:]] = host
+		default:
+			idx.globs = append(idx.globs, host)
+		}
+
+		if hasPrio(routes) {
+			continue
+		}
+		tree := new(pathTree)
+		for _, r := range routes {
+			tree.insert(r.Path, r)
+		}
+		idx.paths[host] = tree
+	}
+	return idx
+}
+
+// hasPrio returns true if one of the routes has a priority.
+func hasPrio(routes Routes) bool {
+	for _, r := range routes {
+		if r.Prio != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingHosts returns the host patterns which match the host.
+func (idx *index) matchingHosts(host string) (hosts []string) {
+	if idx.exact[host] {
+		hosts = append(hosts, host)
+	}
+	for i := 0; i <= len(host); i++ {
+		if pattern, ok := idx.suffix[host[i:]]; ok {
+			hosts = append(hosts, pattern)
+		}
+	}
+	for _, pattern := range idx.globs {
+		if glob.Glob(pattern, host) {
+			hosts = append(hosts, pattern)
+		}
+	}
+	return hosts
+}
+
+// pathTree is a radix tree which stores routes by path.
+type pathTree struct {
+	root pathNode
+}
+
+type pathNode struct {
+	// prefix is the part of the path this node adds
+	// to the path of its parent.
+	prefix string
+
+	// route is the route for the path up to this node
+	// or nil if there is none.
+	route *Route
+
+	// children are the child nodes sorted by the
+	// first byte of their prefix.
+	children []*pathNode
+}
+
+// insert stores the route for the path.
+func (t *pathTree) insert(path string, r *Route) {
+	n := &t.root
+	for {
+		if path == "" {
+			n.route = r
+			return
+		}
+
+		i := sort.Search(len(n.children), func(i int) bool { return n.children[i].prefix[0] >= path[0] })
+		if i == len(n.children) || n.children[i].prefix[0] != path[0] {
+			child := &pathNode{prefix: path, route: r}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = child
+			return
+		}
+
+		child := n.children[i]
+		l := commonPrefixLen(child.prefix, path)
+		if l < len(child.prefix) {
+			// split the child at the common prefix
+			split := &pathNode{prefix: child.prefix[:l], children: []*pathNode{child}}
+			child.prefix = child.prefix[l:]
+			n.children[i] = split
+			child = split
+		}
+		n, path = child, path[l:]
+	}
+}
+
+// longestPrefix returns the route with the longest path
+// which is a prefix of path or nil if there is none.
+func (t *pathTree) longestPrefix(path string) *Route {
+	n, r := &t.root, t.root.route
+	for path != "" {
+		i := sort.Search(len(n.children), func(i int) bool { return n.children[i].prefix[0] >= path[0] })
+		if i == len(n.children) {
+			break
+		}
+		child := n.children[i]
+		if !strings.HasPrefix(path, child.prefix) {
+			break
+		}
+		n, path = child, path[len(child.prefix):]
+		if n.route != nil {
+			r = n.route
+		}
+	}
+	return r
+}
+
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
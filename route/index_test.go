@@ -0,0 +1,107 @@
+package route
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ryanuber/go-glob"
+)
+
+func TestPathTree(t *testing.T) {
+	var tree pathTree
+	for _, p := range []string{"/", "/foo", "/foo/", "/foo/bar", "/fob", "/bar/", ""} {
+		tree.insert(p, &Route{Path: p})
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{"", ""},
+		{"/", "/"},
+		{"/baz", "/"},
+		{"/fo", "/"},
+		{"/foo", "/foo"},
+		{"/foox", "/foo"},
+		{"/foo/", "/foo/"},
+		{"/foo/ba", "/foo/"},
+		{"/foo/bar", "/foo/bar"},
+		{"/foo/bar/baz", "/foo/bar"},
+		{"/fob/x", "/fob"},
+		{"/bar", "/"},
+		{"/bar/x", "/bar/"},
+	}
+
+	for _, tt := range tests {
+		r := tree.longestPrefix(tt.path)
+		if r == nil {
+			t.Errorf("%q: got nil want %q", tt.path, tt.want)
+			continue
+		}
+		if got, want := r.Path, tt.want; got != want {
+			t.Errorf("%q: got %q want %q", tt.path, got, want)
+		}
+	}
+
+	var empty pathTree
+	if r := empty.longestPrefix("/foo"); r != nil {
+		t.Errorf("got %q want nil", r.Path)
+	}
+}
+
+func TestIndexMatchingHosts(t *testing.T) {
+	patterns := []string{"", "*", "abc.com", "*.abc.com", "*abc.com", "a*.com", "*.def.*", "x.abc.com"}
+	hosts := map[string]Routes{}
+	for _, p := range patterns {
+		hosts[p] = nil
+	}
+	idx := newIndex(hosts)
+
+	for _, host := range []string{"", "abc.com", "x.abc.com", "y.abc.com", "xabc.com", "a.com", "x.def.org", "def.com"} {
+		var want []string
+		for _, p := range patterns {
+			if glob.Glob(p, host) {
+				want = append(want, p)
+			}
+		}
+		sort.Strings(want)
+		got := idx.matchingHosts(host)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q want %q", host, got, want)
+		}
+	}
+}
+
+func TestTableLookupIndex(t *testing.T) {
+	s := `
+	route add svc / http://foo.com:800
+	route add svc /foo http://foo.com:900
+	route add svc abc.com/ http://foo.com:1000
+	route add svc abc.com/foo http://foo.com:1500
+	route add svc abc.com/foo/ http://foo.com:2000
+	route add svc abc.com/foo/bar http://foo.com:2500
+	route add svc *.abc.com/ http://foo.com:4000
+	route add svc *.abc.com/foo/ http://foo.com:5000
+	route add svc x.*.com/bar http://foo.com:6000
+	`
+
+	tbl, err := NewTable(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTable(tbl)
+	defer SetTable(make(Table))
+
+	for _, host := range []string{"abc.com", "x.abc.com", "x.def.com", "def.com", "abc.com:80"} {
+		for _, path := range []string{"/", "/bar", "/foo", "/foo/", "/foo/bar/baz", "/foo/baz"} {
+			req := &http.Request{Host: host, URL: mustParse(path)}
+			want := tbl.Lookup(req, "", rrPicker, prefixMatcher)
+			got := Lookup(req, "", rrPicker, "prefix")
+			if got != want {
+				t.Errorf("%s%s: got %v want %v", host, path, got, want)
+			}
+		}
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	reRouteAdd    = regexp.MustCompile(`^route\s+add`)
 	reRouteDel    = regexp.MustCompile(`^route\s+del`)
 	reRouteWeight = regexp.MustCompile(`^route\s+weight`)
+	reRouteShift  = regexp.MustCompile(`^route\s+shift`)
 	reComment     = regexp.MustCompile(`^(#|//)`)
 	reBlankLine   = regexp.MustCompile(`^\s*$`)
 )
@@ -26,7 +28,72 @@ route add <svc> <src> <dst>[ weight <w>][ tags "<t1>,<t2>,..."][ opts "k1=v1 k2=
 	  strip=/path        : forward '/path/to/file' as '/to/file'
 	  proto=tcp          : upstream service is TCP, dst is ':port'
 	  proto=https        : upstream service is HTTPS
+	  proto=h2c          : upstream service is HTTP/2 without TLS
+	  proto=grpc         : upstream service is gRPC without TLS
 	  tlsskipverify=true : disable TLS cert validation for HTTPS upstream
+	  tlsca=name         : verify HTTPS upstream with the upstreamca of cert source 'name'
+	  tlscert=name       : present the cert of cert source 'name' to HTTPS upstream
+	  tlsservername=a.b  : verify the cert of HTTPS upstream for server name a.b
+	  sni=a.b            : send server name a.b to HTTPS upstream (default: tlsservername)
+	  sni=host           : send the host of the request as server name
+	  pxyproto=v1        : send a PROXY protocol v1 header to TCP upstream
+	  pxyproto=v2        : send a PROXY protocol v2 header to TCP upstream
+	  dialtimeout=5s     : override proxy.dialtimeout for this route
+	  responsetimeout=5s : override proxy.responseheadertimeout for this route
+	  timeout=5m         : abort requests which take longer than 5m with 504
+	  ratelimit=100/s    : allow 100 requests per second (also /m and /h)
+	  burst=200          : allow bursts of up to 200 requests
+	  key=clientip       : rate limit per client ip (default) or
+	  key=header:X-Key   : rate limit per value of the X-Key header
+	  maxconns=10        : allow at most 10 concurrent requests
+	  maxqueue=100       : queue up to 100 requests over maxconns (default: 0)
+	  queuetimeout=5s    : reject queued requests after 5s (default: 30s)
+	  wsmaxconns=100     : allow at most 100 concurrent websocket connections
+	  wsidletimeout=5m   : override proxy.ws.idletimeout for this route
+	  maxbody=10MB       : override proxy.maxbody for this route
+	  cors.origins=a,b   : enable CORS for origins a and b (wildcards allowed)
+	  cors.methods=a,b   : allowed methods (default: GET,HEAD,POST)
+	  cors.headers=a,b   : allowed request headers (default: all requested)
+	  cors.expose=a,b    : response headers exposed to the client
+	  cors.credentials=true : allow requests with credentials
+	  cors.maxage=10m    : cache duration for preflight responses
+	  reqhdr.del=A,B     : remove request headers A and B
+	  reqhdr.set.A=v     : set request header A to v
+	  reqhdr.add.A=v     : add v to request header A
+	  resphdr.del=A,B    : remove response headers A and B
+	  resphdr.set.A=v    : set response header A to v
+	  resphdr.add.A=v    : add v to response header A
+	  prio=10            : evaluate before routes of lower priority (default: 0)
+	  errorpages=name    : use the error pages from proxy.errorpages/name
+
+	Header values are URL path unescaped (use %20 for a space) and
+	can reference $remote_addr, $remote_host, $remote_port,
+	$request_host, $request_id, $request_method, $request_scheme,
+	$request_uri and ${header.<name>} of the incoming request.
+
+	The response header options and the CORS headers also apply to
+	websocket upgrades and to the responses of fabio itself, e.g. the
+	error responses for rate limits and unreachable upstream services.
+
+	TCP routes with the tlsca, tlscert, tlsservername or sni option
+	open a TLS connection to the upstream service. For TCP routes
+	'sni=host' sends the server name from the client connection.
+
+	TCP and SNI routes with the pxyproto option send the client and
+	the destination address of the client connection in a PROXY
+	protocol header before any other data, including the TLS handshake.
+
+	HTTP and TCP routes can forward to a unix domain socket with a
+	dst of the form 'unix:///path/to.sock'. Requests to unix sockets
+	use plain HTTP or h2c and the TLS options are ignored.
+
+	Routes of a host are evaluated by priority and then from the most
+	to the least specific path. Hosts are evaluated by the highest
+	priority of their routes and then in alphabetical order. Routes
+	without a host are the catch-all and always evaluated after the
+	routes of all matching hosts whatever their priority. The routes
+	of a host with a priority are matched one by one instead of with
+	the path index which is slower for hosts with many routes.
 
 route del <svc>[ <src>[ <dst>]]
   - Remove route matching svc, src and/or dst
@@ -55,14 +122,53 @@ route weight service host/path weight w tags "tag1,tag2"
     sum(w) >= 1: only matching services will receive traffic
 
    Note that the total sum of traffic sent to all matching routes is w%.
+
+route shift <svc> <src> from <w1> to <w2> over <d> step <s>[ maxerrors <r>][ state <st>][ tags "<t1>,<t2>,..."]
+  - Shift the traffic for all services matching svc, src and tags
+    from w1% to w2% in steps every s over the duration d, e.g.
+
+      route shift svc-v2 example.com/ from 0.05 to 1.0 over 30m step 5m
+
+    The weights are between 0 and 1. The shift is aborted and the
+    targets are removed from the route when more than r% of the
+    requests during a step fail with a 5xx status code or a
+    connection error. 'state paused' stops the shift at its current
+    weight until the state is removed and 'state aborted' removes the
+    targets from the route. Otherwise, changing the command restarts
+    the shift.
+
+    The progress of a shift is kept in memory by every fabio instance.
+    A restart starts a running or paused shift again with the initial
+    weight and forgets a shift which was aborted because of errors
+    unless it was recorded with 'state aborted'.
+
+Instead of commands routes can be defined as a JSON or YAML list of
+route definitions. The fields correspond to the command arguments and
+'cmd' defaults to 'route add'. The list can also be the 'routes' field
+of an object.
+
+- service: svc
+  src: /prefix
+  dst: http://1.2.3.4:5000/
+  weight: 0.5
+  tags: [a, b]
+  opts: {strip: /prefix, maxconns: 10}
+- cmd: route del
+  service: svc
+  src: /prefix
 `
 
-// Parse loads a routing table from a set of route commands.
+// Parse loads a routing table from a set of route commands
+// or from a JSON or YAML document with route definitions.
 //
 // The commands are parsed in order and order matters.
 // Deleting a route that has not been created yet yields
 // a different result than the other way around.
 func Parse(in string) (defs []*RouteDef, err error) {
+	if isStructured(in) {
+		return parseStructured(in)
+	}
+
 	var def *RouteDef
 	for i, s := range strings.Split(in, "\n") {
 		def, err = nil, nil
@@ -76,6 +182,8 @@ func Parse(in string) (defs []*RouteDef, err error) {
 			def, err = parseRouteDel(s)
 		case reRouteWeight.MatchString(s):
 			def, err = parseRouteWeight(s)
+		case reRouteShift.MatchString(s):
+			def, err = parseRouteShift(s)
 		default:
 			err = errors.New("syntax error: 'route' expected")
 		}
@@ -163,6 +271,48 @@ func parseRouteWeight(s string) (*RouteDef, error) {
 	return nil, errors.New("syntax error: 'route weight' invalid")
 }
 
+// route shift <svc> <src> from <w> to <w> over <d> step <d>[ maxerrors <r>][ state <st>][ tags "<t1>,<t2>,..."]
+// 1: service 2: src 3: from 4: to 5: over 6: step 7: maxerrors expr 8: maxerrors val 9: state expr 10: state val
+// 11: tags expr 12: tags val
+var reShift = mustCompileWithFlexibleSpace(`^route shift (\S+) (\S+) from (\S+) to (\S+) over (\S+) step (\S+)( maxerrors (\S+))?( state (\S+))?( tags "([^"]*)")?$`)
+
+func parseRouteShift(s string) (*RouteDef, error) {
+	m := reShift.FindStringSubmatch(s)
+	if m == nil {
+		return nil, errors.New("syntax error: 'route shift' invalid")
+	}
+	from, err := parseShiftWeight(m[3])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseShiftWeight(m[4])
+	if err != nil {
+		return nil, err
+	}
+	sh := &ShiftDef{From: from, To: to, State: m[10]}
+	if sh.Over, err = time.ParseDuration(m[5]); err != nil || sh.Over <= 0 {
+		return nil, errors.New("syntax error: over duration invalid")
+	}
+	if sh.Step, err = time.ParseDuration(m[6]); err != nil || sh.Step <= 0 || sh.Step > sh.Over {
+		return nil, errors.New("syntax error: step duration invalid")
+	}
+	if m[8] != "" {
+		if sh.MaxErrors, err = strconv.ParseFloat(m[8], 64); err != nil || sh.MaxErrors <= 0 || sh.MaxErrors > 1 {
+			return nil, errors.New("syntax error: maxerrors value invalid")
+		}
+	}
+	if m[9] != "" && !validShiftState(sh.State) {
+		return nil, errors.New("syntax error: state invalid")
+	}
+	return &RouteDef{
+		Cmd:     RouteShiftCmd,
+		Service: m[1],
+		Src:     m[2],
+		Tags:    parseTags(m[12]),
+		Shift:   sh,
+	}, nil
+}
+
 func mustCompileWithFlexibleSpace(re string) *regexp.Regexp {
 	return regexp.MustCompile(strings.Replace(re, " ", "\\s+", -1))
 }
@@ -178,6 +328,25 @@ func parseWeight(s string) (float64, error) {
 	return f, nil
 }
 
+// parseShiftWeight parses a weight of a shift which must be between
+// 0 and 1.
+func parseShiftWeight(s string) (float64, error) {
+	f, err := parseWeight(s)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || f > 1 {
+		return 0, errors.New("syntax error: weight value out of range")
+	}
+	return f, nil
+}
+
+// validShiftState returns true for the values of the state option of
+// a shift.
+func validShiftState(s string) bool {
+	return s == ShiftPaused || s == ShiftAborted
+}
+
 func parseTags(s string) []string {
 	if s == "" {
 		return nil
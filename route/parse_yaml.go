@@ -0,0 +1,272 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// isStructured returns true if the first line which is not blank or
+// a comment starts a JSON or YAML document instead of a route command.
+func isStructured(in string) bool {
+	for _, s := range strings.Split(in, "\n") {
+		s = strings.TrimSpace(s)
+		if reComment.MatchString(s) || reBlankLine.MatchString(s) {
+			continue
+		}
+		return strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") || strings.HasPrefix(s, "-") || strings.HasPrefix(s, "routes:")
+	}
+	return false
+}
+
+// parseStructured parses a JSON or YAML document with route definitions.
+// The document is either a list of route definitions or an object with
+// the list in the 'routes' field. JSON documents are parsed as YAML since
+// YAML is a superset of JSON. Errors contain the line and column of the
+// offending value.
+func parseStructured(in string) (defs []*RouteDef, err error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(in), &doc); err != nil {
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	n := doc.Content[0]
+	if n.Kind == yaml.MappingNode {
+		var routes *yaml.Node
+		for i := 0; i < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Value != "routes" {
+				return nil, nodeError(k, "unknown field %q", k.Value)
+			}
+			routes = v
+		}
+		if routes == nil {
+			return nil, nodeError(n, "field 'routes' missing")
+		}
+		n = routes
+	}
+	if isNull(n) {
+		return nil, nil
+	}
+	if n.Kind != yaml.SequenceNode {
+		return nil, nodeError(n, "list of route definitions expected")
+	}
+
+	for _, item := range n.Content {
+		d, err := parseDefNode(item)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	return defs, nil
+}
+
+// parseDefNode parses and validates a single route definition.
+func parseDefNode(n *yaml.Node) (*RouteDef, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, nodeError(n, "route definition expected")
+	}
+
+	d := &RouteDef{Cmd: RouteAddCmd}
+	sh := &ShiftDef{}
+	fields := map[string]*yaml.Node{}
+	for i := 0; i < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if fields[k.Value] != nil {
+			return nil, nodeError(k, "duplicate field %q", k.Value)
+		}
+		fields[k.Value] = k
+
+		var err error
+		switch k.Value {
+		case "cmd":
+			var s string
+			if s, err = scalar(v); err == nil {
+				switch Cmd(s) {
+				case RouteAddCmd, RouteDelCmd, RouteWeightCmd, RouteShiftCmd:
+					d.Cmd = Cmd(s)
+				default:
+					err = nodeError(v, "invalid command %q", s)
+				}
+			}
+		case "service":
+			d.Service, err = scalar(v)
+		case "src":
+			d.Src, err = scalar(v)
+		case "dst":
+			d.Dst, err = scalar(v)
+		case "weight":
+			d.Weight, err = parseFloatNode(v)
+		case "from", "to", "maxerrors":
+			var f float64
+			if f, err = parseFloatNode(v); err == nil {
+				if k.Value != "maxerrors" && (f < 0 || f > 1) {
+					err = nodeError(v, "invalid weight %q", v.Value)
+				}
+				switch k.Value {
+				case "from":
+					sh.From = f
+				case "to":
+					sh.To = f
+				case "maxerrors":
+					if f <= 0 || f > 1 {
+						err = nodeError(v, "invalid maxerrors %q", v.Value)
+					}
+					sh.MaxErrors = f
+				}
+			}
+		case "over", "step":
+			var s string
+			if s, err = scalar(v); err == nil {
+				dur, perr := time.ParseDuration(s)
+				switch {
+				case perr != nil || dur <= 0:
+					err = nodeError(v, "invalid duration %q", s)
+				case k.Value == "over":
+					sh.Over = dur
+				default:
+					sh.Step = dur
+				}
+			}
+		case "state":
+			if sh.State, err = scalar(v); err == nil && !validShiftState(sh.State) {
+				err = nodeError(v, "invalid state %q", sh.State)
+			}
+		case "tags":
+			d.Tags, err = parseTagsNode(v)
+		case "opts":
+			d.Opts, err = parseOptsNode(v)
+		default:
+			err = nodeError(k, "unknown field %q", k.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// required and invalid fields per command
+	var required, invalid []string
+	shiftFields := []string{"from", "to", "over", "step", "maxerrors", "state"}
+	switch d.Cmd {
+	case RouteAddCmd:
+		required = []string{"service", "src", "dst"}
+		invalid = shiftFields
+	case RouteDelCmd:
+		if d.Service == "" && len(d.Tags) == 0 {
+			return nil, nodeError(n, "field 'service' or 'tags' missing")
+		}
+		if d.Dst != "" && d.Src == "" {
+			required = []string{"src"}
+		}
+		invalid = append([]string{"weight", "opts"}, shiftFields...)
+	case RouteWeightCmd:
+		if d.Service == "" && len(d.Tags) == 0 {
+			return nil, nodeError(n, "field 'service' or 'tags' missing")
+		}
+		required = []string{"src", "weight"}
+		invalid = append([]string{"dst", "opts"}, shiftFields...)
+	case RouteShiftCmd:
+		required = []string{"service", "src", "from", "to", "over", "step"}
+		invalid = []string{"dst", "weight", "opts"}
+		d.Shift = sh
+	}
+	for _, f := range required {
+		if fields[f] == nil {
+			return nil, nodeError(n, "field '%s' missing", f)
+		}
+	}
+	for _, f := range invalid {
+		if k := fields[f]; k != nil {
+			return nil, nodeError(k, "field '%s' not allowed for '%s'", f, d.Cmd)
+		}
+	}
+	if d.Shift != nil && d.Shift.Step > d.Shift.Over {
+		return nil, nodeError(fields["step"], "step longer than %s", d.Shift.Over)
+	}
+	return d, nil
+}
+
+func parseFloatNode(n *yaml.Node) (float64, error) {
+	s, err := scalar(n)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, nodeError(n, "invalid number %q", s)
+	}
+	return f, nil
+}
+
+func parseTagsNode(n *yaml.Node) ([]string, error) {
+	if isNull(n) {
+		return nil, nil
+	}
+	if n.Kind != yaml.SequenceNode {
+		return nil, nodeError(n, "list of tags expected")
+	}
+	var tags []string
+	for _, v := range n.Content {
+		s, err := scalar(v)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, s)
+	}
+	return tags, nil
+}
+
+func parseOptsNode(n *yaml.Node) (map[string]string, error) {
+	if isNull(n) {
+		return nil, nil
+	}
+	if n.Kind != yaml.MappingNode {
+		return nil, nodeError(n, "map of options expected")
+	}
+	opts := map[string]string{}
+	for i := 0; i < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		name, err := scalar(k)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := opts[name]; ok {
+			return nil, nodeError(k, "duplicate option %q", name)
+		}
+		if opts[name], err = scalar(v); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// scalar returns the value of a scalar node. null values
+// are returned as empty string.
+func scalar(n *yaml.Node) (string, error) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != yaml.ScalarNode {
+		return "", nodeError(n, "value expected")
+	}
+	if isNull(n) {
+		return "", nil
+	}
+	return n.Value, nil
+}
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null"
+}
+
+func nodeError(n *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d, column %d: %s", n.Line, n.Column, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,102 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStructured(t *testing.T) {
+	tests := []struct {
+		desc string
+		in   string
+		out  []*RouteDef
+		err  string
+	}{
+		{
+			desc: "JSON",
+			in:   `[{"service": "svc", "src": "/prefix", "dst": "http://1.2.3.4/", "weight": 0.5, "tags": ["a", "b"], "opts": {"strip": "/prefix", "maxconns": 10}}]`,
+			out:  []*RouteDef{{Cmd: RouteAddCmd, Service: "svc", Src: "/prefix", Dst: "http://1.2.3.4/", Weight: 0.5, Tags: []string{"a", "b"}, Opts: map[string]string{"strip": "/prefix", "maxconns": "10"}}},
+		},
+		{
+			desc: "JSONObject",
+			in:   `{"routes": [{"service": "svc", "src": "/prefix", "dst": "http://1.2.3.4/"}]}`,
+			out:  []*RouteDef{{Cmd: RouteAddCmd, Service: "svc", Src: "/prefix", Dst: "http://1.2.3.4/"}},
+		},
+		{
+			desc: "YAML",
+			in: `
+# comment
+- service: svc
+  src: /prefix
+  dst: http://1.2.3.4/
+  opts:
+    reqhdr.set.X-Foo: "a b"
+- cmd: route del
+  service: svc
+  src: /prefix
+- cmd: route weight
+  src: /prefix
+  weight: 0.2
+  tags: [a]
+`,
+			out: []*RouteDef{
+				{Cmd: RouteAddCmd, Service: "svc", Src: "/prefix", Dst: "http://1.2.3.4/", Opts: map[string]string{"reqhdr.set.X-Foo": "a b"}},
+				{Cmd: RouteDelCmd, Service: "svc", Src: "/prefix"},
+				{Cmd: RouteWeightCmd, Src: "/prefix", Weight: 0.2, Tags: []string{"a"}},
+			},
+		},
+		{
+			desc: "YAMLObject",
+			in:   "routes:\n  - service: svc\n    src: /prefix\n    dst: http://1.2.3.4/\n",
+			out:  []*RouteDef{{Cmd: RouteAddCmd, Service: "svc", Src: "/prefix", Dst: "http://1.2.3.4/"}},
+		},
+		{
+			desc: "Empty",
+			in:   "[]",
+		},
+
+		// error flows
+		{desc: "SyntaxError", in: "[{\"service\": }", err: "line 1: did not find expected ',' or ']'"},
+		{desc: "NoList", in: "{\"foo\": 1}", err: "line 1, column 2: unknown field \"foo\""},
+		{desc: "NoRoute", in: "- svc", err: "line 1, column 3: route definition expected"},
+		{desc: "UnknownField", in: "- service: svc\n  src: /\n  dst: http://1.2.3.4/\n  optz: {}", err: "line 4, column 3: unknown field \"optz\""},
+		{desc: "DuplicateField", in: "- service: svc\n  service: svc", err: "line 2, column 3: duplicate field \"service\""},
+		{desc: "MissingDst", in: "- service: svc\n  src: /", err: "line 1, column 3: field 'dst' missing"},
+		{desc: "InvalidCmd", in: "- cmd: route foo", err: "line 1, column 8: invalid command \"route foo\""},
+		{desc: "InvalidWeight", in: "- service: svc\n  src: /\n  dst: http://1.2.3.4/\n  weight: x", err: "line 4, column 11: invalid number \"x\""},
+		{desc: "InvalidTags", in: "- service: svc\n  src: /\n  dst: http://1.2.3.4/\n  tags: a,b", err: "line 4, column 9: list of tags expected"},
+		{desc: "InvalidOpt", in: "- service: svc\n  src: /\n  dst: http://1.2.3.4/\n  opts: {a: [b]}", err: "line 4, column 13: value expected"},
+		{desc: "DelNoService", in: "- cmd: route del\n  src: /", err: "line 1, column 3: field 'service' or 'tags' missing"},
+		{desc: "DelWeight", in: "- cmd: route del\n  service: svc\n  weight: 1", err: "line 3, column 3: field 'weight' not allowed for 'route del'"},
+		{desc: "WeightNoWeight", in: "- cmd: route weight\n  service: svc\n  src: /", err: "line 1, column 3: field 'weight' missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			defs, err := Parse(tt.in)
+			var errstr string
+			if err != nil {
+				errstr = err.Error()
+			}
+			if got, want := errstr, tt.err; got != want {
+				t.Fatalf("got error %q want %q", got, want)
+			}
+			if got, want := defs, tt.out; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %#v want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewTableFromMixedConfigs(t *testing.T) {
+	svccfg := "route add svc / http://1.2.3.4/\nroute add svc /foo http://1.2.3.5/"
+	mancfg := "- cmd: route del\n  service: svc\n  src: /foo"
+
+	tbl, err := NewTableFrom(nil, svccfg, mancfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tbl.String(), "route add svc / http://1.2.3.4/"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
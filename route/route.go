@@ -6,9 +6,15 @@ import (
 	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/connlimit"
 	"github.com/fabiolb/fabio/metrics"
+	"github.com/fabiolb/fabio/ratelimit"
 )
 
 // Route maps a path prefix to one or more target URLs.
@@ -29,6 +35,10 @@ type Route struct {
 	// Opts is the raw route options
 	Opts map[string]string
 
+	// Prio is the priority of the route from the 'prio' option.
+	// Routes with a higher priority are evaluated first.
+	Prio int
+
 	// Targets contains the list of URLs
 	Targets []*Target
 
@@ -38,6 +48,18 @@ type Route struct {
 	// total contains the total number of requests for this route.
 	// Used by the RRPicker
 	total uint64
+
+	// limiter is the rate limiter shared by all targets of this route.
+	// It is nil if the route is not rate limited.
+	limiter *ratelimit.Limiter
+
+	// connLimiter limits the concurrent requests to all targets of
+	// this route. It is nil if the route has no concurrency limit.
+	connLimiter *connlimit.Limiter
+
+	// wsLimiter limits the concurrent websocket connections to all
+	// targets of this route. It is nil if the route has no limit.
+	wsLimiter *connlimit.Limiter
 }
 
 func (r *Route) addTarget(service string, targetURL *url.URL, fixedWeight float64, tags []string) {
@@ -60,23 +82,248 @@ func (r *Route) addTarget(service string, targetURL *url.URL, fixedWeight float6
 
 	t := &Target{
 		Service:     service,
+		Route:       r.Host + r.Path,
 		Tags:        tags,
 		URL:         targetURL,
 		FixedWeight: fixedWeight,
 		Timer:       ServiceRegistry.GetTimer(name),
 		timerName:   name,
 	}
+	if targetURL.Scheme == "unix" {
+		t.Socket = targetURL.Path
+	}
 	if r.Opts != nil {
 		t.StripPath = r.Opts["strip"]
 		t.TLSSkipVerify = r.Opts["tlsskipverify"] == "true"
+		t.TLSCA = r.Opts["tlsca"]
+		t.TLSCert = r.Opts["tlscert"]
+		t.TLSServerName = r.Opts["tlsservername"]
+		t.SNI = r.Opts["sni"]
+		t.ErrorPages = r.Opts["errorpages"]
 		t.Host = r.Opts["host"]
+		if v := r.Opts["proto"]; v == "h2c" || v == "grpc" {
+			t.Proto = v
+		}
+		switch v := r.Opts["pxyproto"]; v {
+		case "":
+		case "v1":
+			t.ProxyProto = 1
+		case "v2":
+			t.ProxyProto = 2
+		default:
+			log.Printf("[WARN] route: Ignoring invalid value %q for option pxyproto", v)
+		}
 		t.AuthEnabled = r.Opts["auth"] == "true"
+		t.DialTimeout = parseDurationOpt(r.Opts, "dialtimeout")
+		t.ResponseHeaderTimeout = parseDurationOpt(r.Opts, "responsetimeout")
+		t.Timeout = parseDurationOpt(r.Opts, "timeout")
+		t.RateLimiter = r.rateLimiter()
+		if t.RateLimiter != nil {
+			t.RateLimitKey = r.Opts["key"]
+		}
+		t.ConnLimiter = r.concurrencyLimiter()
+		t.WSLimiter = r.websocketLimiter()
+		t.WSIdleTimeout = parseDurationOpt(r.Opts, "wsidletimeout")
+		if v := r.Opts["maxbody"]; v != "" {
+			n, err := config.ParseSize(v)
+			if err != nil {
+				log.Printf("[WARN] route: Ignoring invalid value %q for option maxbody", v)
+			}
+			t.MaxBody = n
+		}
+		t.CORS = parseCORS(r.Opts)
+		t.RequestHeaders = parseHeaderOps("reqhdr", r.Opts)
+		t.ResponseHeaders = parseHeaderOps("resphdr", r.Opts)
 	}
 
 	r.Targets = append(r.Targets, t)
 	r.weighTargets()
 }
 
+// parseDurationOpt returns the duration value of the route option
+// or zero if the option is not set or invalid.
+func parseDurationOpt(opts map[string]string, name string) time.Duration {
+	v, ok := opts[name]
+	if !ok {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("[WARN] route: Ignoring invalid value %q for option %s", v, name)
+		return 0
+	}
+	return d
+}
+
+// rateLimiter returns the rate limiter for the route as configured with
+// the 'ratelimit' and 'burst' options or nil if the route has no rate
+// limit. The limiter is created on first use and shared by all targets.
+func (r *Route) rateLimiter() *ratelimit.Limiter {
+	if r.limiter != nil || r.Opts["ratelimit"] == "" {
+		return r.limiter
+	}
+
+	rate, err := ratelimit.ParseRate(r.Opts["ratelimit"])
+	if err != nil {
+		log.Printf("[WARN] route: Ignoring rate limit for %s%s. %s", r.Host, r.Path, err)
+		return nil
+	}
+
+	var burst int
+	if v := r.Opts["burst"]; v != "" {
+		if burst, err = strconv.Atoi(v); err != nil || burst < 1 {
+			log.Printf("[WARN] route: Ignoring invalid value %q for option burst", v)
+			burst = 0
+		}
+	}
+
+	r.limiter = ratelimit.New(rate, burst)
+	return r.limiter
+}
+
+// validRateLimitKey returns true if the value of the 'key' option is
+// 'clientip' or 'header:<name>'.
+func validRateLimitKey(v string) bool {
+	return v == "clientip" || (strings.HasPrefix(v, "header:") && len(v) > len("header:"))
+}
+
+// concurrencyLimiter returns the limiter for concurrent requests to the
+// route as configured with the 'maxconns', 'maxqueue' and 'queuetimeout'
+// options or nil if the route has no limit. The limiter is created on
+// first use and shared by all targets. Queued requests wait at most
+// connlimit.DefaultQueueTimeout if 'queuetimeout' is not set. The number
+// of active and queued requests is reported as route metrics.
+func (r *Route) concurrencyLimiter() *connlimit.Limiter {
+	if r.connLimiter != nil || r.Opts["maxconns"] == "" {
+		return r.connLimiter
+	}
+
+	max, err := strconv.Atoi(r.Opts["maxconns"])
+	if err != nil || max < 1 {
+		log.Printf("[WARN] route: Ignoring invalid value %q for option maxconns", r.Opts["maxconns"])
+		return nil
+	}
+
+	var queue int
+	if v := r.Opts["maxqueue"]; v != "" {
+		if queue, err = strconv.Atoi(v); err != nil || queue < 0 {
+			log.Printf("[WARN] route: Ignoring invalid value %q for option maxqueue", v)
+			queue = 0
+		}
+	}
+
+	r.connLimiter = connlimit.New(max, queue, parseDurationOpt(r.Opts, "queuetimeout"))
+	active, queued := r.connLimitNames()
+	r.connLimiter.ActiveGauge = ServiceRegistry.GetGauge(active)
+	r.connLimiter.QueuedGauge = ServiceRegistry.GetGauge(queued)
+	return r.connLimiter
+}
+
+// connLimitNames returns the names of the gauges for the active
+// and the queued requests of the concurrency limiter.
+func (r *Route) connLimitNames() (active, queued string) {
+	name := metrics.RouteName(r.Host, r.Path)
+	return name + ".conns.active", name + ".conns.queued"
+}
+
+// websocketLimiter returns the limiter for websocket connections of the
+// route as configured with the 'wsmaxconns' option or nil if the route
+// has no limit. Connections over the limit are rejected immediately.
+// The limiter is created on first use and shared by all targets.
+func (r *Route) websocketLimiter() *connlimit.Limiter {
+	if r.wsLimiter != nil || r.Opts["wsmaxconns"] == "" {
+		return r.wsLimiter
+	}
+
+	max, err := strconv.Atoi(r.Opts["wsmaxconns"])
+	if err != nil || max < 1 {
+		log.Printf("[WARN] route: Ignoring invalid value %q for option wsmaxconns", r.Opts["wsmaxconns"])
+		return nil
+	}
+
+	r.wsLimiter = connlimit.New(max, 0, 0)
+	return r.wsLimiter
+}
+
+// reuse takes over the round-robin counter and the limiters
+// of the route with the same options from the previous table.
+// Targets with the same service, URL, tags and weight are
+// replaced with the targets of the previous route.
+func (r *Route) reuse(old *Route) {
+	r.total = atomic.LoadUint64(&old.total)
+	r.limiter, r.connLimiter, r.wsLimiter = old.limiter, old.connLimiter, old.wsLimiter
+	for _, t := range r.Targets {
+		t.RateLimiter, t.ConnLimiter, t.WSLimiter = r.limiter, r.connLimiter, r.wsLimiter
+	}
+
+	type key struct {
+		service, url  string
+		fixed, weight float64
+	}
+	targets := map[key][]*Target{}
+	for _, t := range old.Targets {
+		k := key{t.Service, t.URL.String(), t.FixedWeight, t.Weight}
+		targets[k] = append(targets[k], t)
+	}
+
+	reused := map[*Target]*Target{}
+	for i, t := range r.Targets {
+		for _, ot := range targets[key{t.Service, t.URL.String(), t.FixedWeight, t.Weight}] {
+			if ot.Shift == t.Shift && reflect.DeepEqual(ot.Tags, t.Tags) {
+				r.Targets[i], reused[t] = ot, ot
+				break
+			}
+		}
+	}
+	for i, t := range r.wTargets {
+		if ot := reused[t]; ot != nil {
+			r.wTargets[i] = ot
+		}
+	}
+}
+
+// equal returns true if both routes have the same options
+// and the same targets with the same weights.
+func (r *Route) equal(o *Route) bool {
+	if r.Host != o.Host || r.Path != o.Path || !equalOpts(r.Opts, o.Opts) || len(r.Targets) != len(o.Targets) {
+		return false
+	}
+	for i, t := range r.Targets {
+		ot := o.Targets[i]
+		if t.FixedWeight != ot.FixedWeight || t.Shift != ot.Shift || r.TargetConfig(t, true) != o.TargetConfig(ot, true) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalOpts returns true if both sets of route options are the
+// same. A nil map is equal to an empty map.
+func equalOpts(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// target returns the target for the next request or nil
+// if the route has no targets.
+func (r *Route) target(pick picker) *Target {
+	switch len(r.Targets) {
+	case 0:
+		return nil
+	case 1:
+		return r.Targets[0]
+	default:
+		return pick(r)
+	}
+}
+
 func (r *Route) filter(skip func(t *Target) bool) {
 	var clone []*Target
 	for _, t := range r.Targets {
@@ -89,6 +336,19 @@ func (r *Route) filter(skip func(t *Target) bool) {
 	r.weighTargets()
 }
 
+// setShift attaches the shift to the targets matching service and tags.
+func (r *Route) setShift(service string, tags []string, s *Shift) {
+	for _, t := range r.Targets {
+		if service != "" && t.Service != service {
+			continue
+		}
+		if len(tags) > 0 && !contains(t.Tags, tags) {
+			continue
+		}
+		t.Shift = s
+	}
+}
+
 func (r *Route) setWeight(service string, weight float64, tags []string) int {
 	loop := func(w float64) int {
 		n := 0
@@ -3,15 +3,17 @@ package route
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"testing"
 )
 
 var (
-	b5Routes   Table
-	b10Routes  Table
-	b100Routes Table
-	b500Routes Table
+	b5Routes    Table
+	b10Routes   Table
+	b100Routes  Table
+	b500Routes  Table
+	b5000Routes Table
 
 	once sync.Once
 )
@@ -23,6 +25,7 @@ func initRoutes() {
 	b10Routes = makeRoutes(1, 5, 2, 6)
 	b100Routes = makeRoutes(10, 5, 2, 24)
 	b500Routes = makeRoutes(10, 10, 5, 24)
+	b5000Routes = makeRoutes(100, 10, 5, 1)
 }
 
 func BenchmarkPrefixMatcherRndPicker5Routes(b *testing.B) {
@@ -79,6 +82,30 @@ func BenchmarkPrefixMatcherRRPicker500Routes(b *testing.B) {
 	b.RunParallel(func(b *testing.PB) { benchmarkGet(b500Routes, prefixMatcher, rrPicker, b) })
 }
 
+func BenchmarkPrefixMatcherRRPicker5000Routes(b *testing.B) {
+	once.Do(initRoutes)
+	b.ResetTimer()
+	b.SetParallelism(3)
+	b.RunParallel(func(b *testing.PB) { benchmarkGet(b5000Routes, prefixMatcher, rrPicker, b) })
+}
+
+// BenchmarkPrefixMatcherRRPicker5000RoutesIndex measures the lookup
+// with the index of the active table for comparison.
+func BenchmarkPrefixMatcherRRPicker5000RoutesIndex(b *testing.B) {
+	once.Do(initRoutes)
+	idx := newIndex(b5000Routes)
+	b.ResetTimer()
+	b.SetParallelism(3)
+	b.RunParallel(func(pb *testing.PB) {
+		reqs := makeRequests(b5000Routes)
+		k, n := len(reqs), 0
+		for pb.Next() {
+			b5000Routes.find(reqs[n%k], "", rrPicker, prefixMatcher, idx)
+			n++
+		}
+	})
+}
+
 // makeRoutes builds a set of routes for a set of domains
 // and target urls. For each domain all paths up to depth
 // are constructed and all host/path combinations have the
@@ -109,9 +136,10 @@ func makeRoutes(domains, paths, depth, urls int) Table {
 // additional path for benchmarking.
 func makeRequests(t Table) []*http.Request {
 	reqs := []*http.Request{}
-	for host, hr := range t {
-		for _, r := range hr {
-			req := &http.Request{Host: host, RequestURI: r.Path + "/some/additional/path"}
+	for _, host := range t.Hosts() {
+		for _, r := range t[host] {
+			uri := r.Path + "/some/additional/path"
+			req := &http.Request{Host: host, RequestURI: uri, URL: &url.URL{Path: uri}}
 			reqs = append(reqs, req)
 		}
 	}
@@ -1,11 +1,14 @@
 package route
 
+import "time"
+
 type Cmd string
 
 const (
 	RouteAddCmd    Cmd = "route add"
 	RouteDelCmd    Cmd = "route del"
 	RouteWeightCmd Cmd = "route weight"
+	RouteShiftCmd  Cmd = "route shift"
 )
 
 type RouteDef struct {
@@ -16,4 +19,30 @@ type RouteDef struct {
 	Weight  float64           `json:"weight"`
 	Tags    []string          `json:"tags,omitempty"`
 	Opts    map[string]string `json:"opts,omitempty"`
+	Shift   *ShiftDef         `json:"shift,omitempty"`
+}
+
+// ShiftDef describes the gradual change of the weight of a route
+// for the 'route shift' command.
+type ShiftDef struct {
+	// From is the weight at the start of the shift.
+	From float64 `json:"from"`
+
+	// To is the weight at the end of the shift.
+	To float64 `json:"to"`
+
+	// Over is the duration of the shift.
+	Over time.Duration `json:"over"`
+
+	// Step is the interval in which the weight is changed.
+	Step time.Duration `json:"step"`
+
+	// MaxErrors is the ratio of failed requests to the shifted
+	// targets within a step above which the shift is aborted.
+	// Zero disables the check.
+	MaxErrors float64 `json:"maxerrors,omitempty"`
+
+	// State is 'paused' or 'aborted' to pause or abort the shift.
+	// The shift runs if it is empty.
+	State string `json:"state,omitempty"`
 }
@@ -13,7 +13,20 @@ func (rt Routes) find(path string) *Route {
 	return nil
 }
 
-// sort by path in reverse order (most to least specific)
-func (rt Routes) Len() int           { return len(rt) }
-func (rt Routes) Swap(i, j int)      { rt[i], rt[j] = rt[j], rt[i] }
-func (rt Routes) Less(i, j int) bool { return rt[j].Path < rt[i].Path }
+// sort by priority and then by path in reverse order (most to least specific)
+func (rt Routes) Len() int      { return len(rt) }
+func (rt Routes) Swap(i, j int) { rt[i], rt[j] = rt[j], rt[i] }
+func (rt Routes) Less(i, j int) bool {
+	if rt[i].Prio != rt[j].Prio {
+		return rt[i].Prio > rt[j].Prio
+	}
+	return rt[j].Path < rt[i].Path
+}
+
+// prio returns the highest priority of the routes.
+func (rt Routes) prio() int {
+	if len(rt) == 0 {
+		return 0
+	}
+	return rt[0].Prio
+}
@@ -0,0 +1,270 @@
+package route
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The states of a traffic shift.
+const (
+	ShiftRunning = "running"
+	ShiftPaused  = "paused"
+	ShiftAborted = "aborted"
+	ShiftDone    = "done"
+)
+
+// Shifts stores the state of the traffic shifts of the active routing
+// table. The state survives table updates as long as the 'route shift'
+// command does not change except for pausing and resuming it.
+var Shifts = &ShiftRegistry{}
+
+// Shift is the state of a gradual weight change for the targets of a
+// service on a route. The weight starts at From and changes every Step
+// until it reaches To after Over. The state option of the command
+// pauses and aborts the shift. An aborted shift removes the targets
+// from the route.
+type Shift struct {
+	ID      string   `json:"id"`
+	Service string   `json:"service"`
+	Src     string   `json:"src"`
+	Tags    []string `json:"tags,omitempty"`
+	ShiftDef
+
+	mu        sync.Mutex
+	start     time.Time
+	state     string
+	pausedAt  time.Time
+	pausedFor time.Duration
+	step      int
+
+	// requests and errors count the requests to the
+	// targets of the shift during the current step.
+	requests uint64
+	errors   uint64
+}
+
+// ShiftStatus is the current state of a shift.
+type ShiftStatus struct {
+	*Shift
+	State  string    `json:"state"`
+	Start  time.Time `json:"start"`
+	Weight float64   `json:"weight"`
+}
+
+func shiftID(d *RouteDef) string {
+	id := d.Service + " " + d.Src
+	if len(d.Tags) > 0 {
+		id += " " + strings.Join(d.Tags, ",")
+	}
+	return id
+}
+
+// sameShift returns true if the commands describe the same shift.
+// Pausing and resuming a shift does not change it.
+func sameShift(a, b ShiftDef) bool {
+	if a.State == ShiftPaused {
+		a.State = ""
+	}
+	if b.State == ShiftPaused {
+		b.State = ""
+	}
+	return a == b
+}
+
+// newShift creates a shift for the command in the state from its
+// state option.
+func newShift(d *RouteDef, now time.Time) *Shift {
+	s := &Shift{
+		ID:       shiftID(d),
+		Service:  d.Service,
+		Src:      d.Src,
+		Tags:     d.Tags,
+		ShiftDef: *d.Shift,
+		start:    now,
+		state:    ShiftRunning,
+	}
+	switch d.Shift.State {
+	case ShiftPaused:
+		s.state, s.pausedAt = ShiftPaused, now
+	case ShiftAborted:
+		s.state = ShiftAborted
+	}
+	return s
+}
+
+// pause pauses a running shift or resumes a paused shift.
+func (s *Shift) pause(paused bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case paused && s.state == ShiftRunning:
+		s.state, s.pausedAt = ShiftPaused, now
+	case !paused && s.state == ShiftPaused:
+		s.state = ShiftRunning
+		s.pausedFor += now.Sub(s.pausedAt)
+	}
+}
+
+// Observe records the result of a request to a target of the shift.
+func (s *Shift) Observe(failed bool) {
+	atomic.AddUint64(&s.requests, 1)
+	if failed {
+		atomic.AddUint64(&s.errors, 1)
+	}
+}
+
+// steps returns the number of steps of the shift.
+func (s *Shift) steps() int {
+	return int((s.Over + s.Step - 1) / s.Step)
+}
+
+// currentStep returns the number of completed steps at the given time.
+// s.mu must be held.
+func (s *Shift) currentStep(now time.Time) int {
+	if s.state == ShiftPaused {
+		now = s.pausedAt
+	}
+	n := int(now.Sub(s.start.Add(s.pausedFor)) / s.Step)
+	if n > s.steps() {
+		n = s.steps()
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// weight returns the weight for the given step.
+func (s *Shift) weight(step int) float64 {
+	if step >= s.steps() {
+		return s.To
+	}
+	return s.From + (s.To-s.From)*float64(step)/float64(s.steps())
+}
+
+// status returns the state and the weight of the shift.
+func (s *Shift) status(now time.Time) (state string, weight float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.weight(s.currentStep(now))
+}
+
+// tick advances the shift to the current step and returns true if the
+// weight has changed. A shift is aborted when the ratio of failed
+// requests during a step exceeds MaxErrors.
+func (s *Shift) tick(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != ShiftRunning {
+		return false
+	}
+	step := s.currentStep(now)
+	if step == s.step {
+		return false
+	}
+	s.step = step
+
+	requests, errors := atomic.SwapUint64(&s.requests, 0), atomic.SwapUint64(&s.errors, 0)
+	if s.MaxErrors > 0 && requests > 0 && float64(errors)/float64(requests) > s.MaxErrors {
+		log.Printf("[WARN] route: Aborting shift %s. %d of %d requests failed", s.ID, errors, requests)
+		s.state = ShiftAborted
+		return true
+	}
+
+	if step >= s.steps() {
+		s.state = ShiftDone
+		log.Printf("[INFO] route: Shift %s done", s.ID)
+	}
+	return true
+}
+
+// ShiftRegistry manages the shifts of the active routing table.
+type ShiftRegistry struct {
+	// Time returns the current time. If Time is nil, time.Now is used.
+	Time func() time.Time
+
+	mu     sync.Mutex
+	shifts map[string]*Shift
+}
+
+func (r *ShiftRegistry) now() time.Time {
+	if r.Time != nil {
+		return r.Time()
+	}
+	return time.Now()
+}
+
+// lookup returns the shift for the command or nil if there is
+// none or the command has changed.
+func (r *ShiftRegistry) lookup(d *RouteDef) *Shift {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.shifts[shiftID(d)]
+	if s == nil || !sameShift(s.ShiftDef, *d.Shift) {
+		return nil
+	}
+	return s
+}
+
+// sync starts the shifts for new or changed commands, pauses
+// or resumes them according to their state option and removes
+// the ones which are no longer in the table. It returns true
+// if a shift was started.
+func (r *ShiftRegistry) sync(defs []*RouteDef) (started bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	shifts := map[string]*Shift{}
+	for _, d := range defs {
+		id := shiftID(d)
+		s := r.shifts[id]
+		if s == nil || !sameShift(s.ShiftDef, *d.Shift) {
+			s = newShift(d, now)
+			log.Printf("[INFO] route: Starting shift %s from %g to %g over %s", id, s.From, s.To, s.Over)
+			started = true
+		} else {
+			s.pause(d.Shift.State == ShiftPaused, now)
+		}
+		shifts[id] = s
+	}
+	r.shifts = shifts
+	return started
+}
+
+// Tick advances the shifts to the current time and returns true if the
+// routing table needs to be rebuilt because the weight of a shift has
+// changed.
+func (r *ShiftRegistry) Tick() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	changed := false
+	for _, s := range r.shifts {
+		if s.tick(now) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// List returns the status of all shifts sorted by id.
+func (r *ShiftRegistry) List() []ShiftStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	list := []ShiftStatus{}
+	for _, s := range r.shifts {
+		state, w := s.status(now)
+		list = append(list, ShiftStatus{Shift: s, State: state, Start: s.start, Weight: w})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,183 @@
+package route
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRouteShift(t *testing.T) {
+	tests := []struct {
+		in  string
+		out *RouteDef
+		err string
+	}{
+		{
+			in:  `route shift svc example.com/ from 0.05 to 1.0 over 30m step 5m`,
+			out: &RouteDef{Cmd: RouteShiftCmd, Service: "svc", Src: "example.com/", Shift: &ShiftDef{From: 0.05, To: 1, Over: 30 * time.Minute, Step: 5 * time.Minute}},
+		},
+		{
+			in:  `route shift svc / from 0 to 0.5 over 1h step 10m maxerrors 0.1 tags "a,b"`,
+			out: &RouteDef{Cmd: RouteShiftCmd, Service: "svc", Src: "/", Tags: []string{"a", "b"}, Shift: &ShiftDef{To: 0.5, Over: time.Hour, Step: 10 * time.Minute, MaxErrors: 0.1}},
+		},
+		{in: `route shift svc / from 0 to 1`, err: "line 1: syntax error: 'route shift' invalid"},
+		{in: `route shift svc / from 0 to 1 over 5m step 10m`, err: "line 1: syntax error: step duration invalid"},
+		{in: `route shift svc / from 0 to 1 over 0s step 0s`, err: "line 1: syntax error: over duration invalid"},
+		{in: `route shift svc / from 0 to 1 over 5m step 1m maxerrors 2`, err: "line 1: syntax error: maxerrors value invalid"},
+		{
+			in:  `route shift svc / from 0 to 1 over 5m step 1m state paused tags "a"`,
+			out: &RouteDef{Cmd: RouteShiftCmd, Service: "svc", Src: "/", Tags: []string{"a"}, Shift: &ShiftDef{To: 1, Over: 5 * time.Minute, Step: time.Minute, State: ShiftPaused}},
+		},
+		{in: `route shift svc / from 0 to 1 over 5m step 1m state done`, err: "line 1: syntax error: state invalid"},
+		{in: `route shift svc / from 0 to 2 over 5m step 1m`, err: "line 1: syntax error: weight value out of range"},
+		{in: `route shift svc / from -0.5 to 1 over 5m step 1m`, err: "line 1: syntax error: weight value out of range"},
+		{
+			in:  "- cmd: route shift\n  service: svc\n  src: /\n  from: 0\n  to: 1\n  over: 30m\n  step: 5m",
+			out: &RouteDef{Cmd: RouteShiftCmd, Service: "svc", Src: "/", Shift: &ShiftDef{To: 1, Over: 30 * time.Minute, Step: 5 * time.Minute}},
+		},
+		{in: "- cmd: route shift\n  service: svc\n  src: /\n  from: 0\n  to: 1\n  over: 5m\n  step: 10m", err: "line 7, column 3: step longer than 5m0s"},
+		{
+			in:  "- cmd: route shift\n  service: svc\n  src: /\n  from: 0\n  to: 1\n  over: 5m\n  step: 1m\n  state: aborted",
+			out: &RouteDef{Cmd: RouteShiftCmd, Service: "svc", Src: "/", Shift: &ShiftDef{To: 1, Over: 5 * time.Minute, Step: time.Minute, State: ShiftAborted}},
+		},
+		{in: "- cmd: route shift\n  service: svc\n  src: /\n  from: 0\n  to: 1\n  over: 5m\n  step: 1m\n  state: done", err: "line 8, column 10: invalid state \"done\""},
+		{in: "- cmd: route shift\n  service: svc\n  src: /\n  from: 0\n  to: 1.5\n  over: 5m\n  step: 1m", err: "line 5, column 7: invalid weight \"1.5\""},
+		{in: "- service: svc\n  src: /\n  dst: http://1.2.3.4/\n  step: 10m", err: "line 4, column 3: field 'step' not allowed for 'route add'"},
+	}
+
+	for i, tt := range tests {
+		defs, err := Parse(tt.in)
+		var errstr string
+		if err != nil {
+			errstr = err.Error()
+		}
+		if got, want := errstr, tt.err; got != want {
+			t.Errorf("%d: got error %q want %q", i, got, want)
+			continue
+		}
+		if tt.out == nil {
+			continue
+		}
+		if got, want := defs, []*RouteDef{tt.out}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: got %#v want %#v", i, got[0], want[0])
+		}
+	}
+}
+
+func TestRouteShift(t *testing.T) {
+	now := time.Unix(0, 0)
+	oldShifts := Shifts
+	Shifts = &ShiftRegistry{Time: func() time.Time { return now }}
+	defer func() { Shifts = oldShifts }()
+
+	cfg := `
+	route add svc-v1 / http://1.2.3.4/
+	route add svc-v2 / http://1.2.3.5/
+	route shift svc-v2 / from 0.1 to 0.5 over 4m step 1m maxerrors 0.5
+	`
+
+	// build returns the weight of the shifted target
+	// or -1 if it has been removed.
+	build := func() float64 {
+		t.Helper()
+		tbl, err := NewTableFrom(GetTable(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetTable(tbl)
+		for _, tg := range tbl.route("", "/").Targets {
+			if tg.Service == "svc-v2" {
+				return tg.Weight
+			}
+		}
+		return -1
+	}
+	defer SetTable(make(Table))
+
+	near := func(got, want float64) {
+		t.Helper()
+		if got < want-1e-6 || got > want+1e-6 {
+			t.Fatalf("got weight %v want %v", got, want)
+		}
+	}
+
+	// new shift starts with the initial weight
+	// and is attached when the table is built
+	near(build(), 0.1)
+	shift := Shifts.List()[0].Shift
+	if tg := GetTable().route("", "/").Targets[1]; tg.Shift != shift {
+		t.Fatal("shift not attached to target")
+	}
+	if Shifts.Tick() {
+		t.Fatal("got change without step")
+	}
+
+	// first step
+	now = now.Add(time.Minute)
+	if !Shifts.Tick() {
+		t.Fatal("got no change after step")
+	}
+	near(build(), 0.2)
+
+	// paused shift does not advance
+	cfg = strings.Replace(cfg, "maxerrors 0.5", "maxerrors 0.5 state paused", 1)
+	near(build(), 0.2)
+	now = now.Add(5 * time.Minute)
+	Shifts.Tick()
+	near(build(), 0.2)
+	if got, want := Shifts.List()[0].State, ShiftPaused; got != want {
+		t.Fatalf("got state %s want %s", got, want)
+	}
+
+	// resumed shift continues from where it stopped
+	cfg = strings.Replace(cfg, " state paused", "", 1)
+	near(build(), 0.2)
+	if got := Shifts.List()[0].Shift; got != shift {
+		t.Fatal("resume restarted the shift")
+	}
+	now = now.Add(time.Minute)
+	Shifts.Tick()
+	near(build(), 0.3)
+
+	// too many errors abort the shift
+	shift.Observe(true)
+	shift.Observe(true)
+	shift.Observe(false)
+	now = now.Add(time.Minute)
+	if !Shifts.Tick() {
+		t.Fatal("got no change after abort")
+	}
+	if got, want := Shifts.List()[0].State, ShiftAborted; got != want {
+		t.Fatalf("got state %s want %s", got, want)
+	}
+	near(build(), -1)
+
+	// changing the command restarts the shift
+	cfg = strings.Replace(cfg, "over 4m", "over 2m", 1)
+	near(build(), 0.1)
+	if got, want := Shifts.List()[0].State, ShiftRunning; got != want {
+		t.Fatalf("got state %s want %s", got, want)
+	}
+	Shifts.Tick()
+	now = now.Add(2 * time.Minute)
+	Shifts.Tick()
+	near(build(), 0.5)
+	if got, want := Shifts.List()[0].State, ShiftDone; got != want {
+		t.Fatalf("got state %s want %s", got, want)
+	}
+
+	// aborted state removes the targets
+	cfg = strings.Replace(cfg, "maxerrors 0.5", "maxerrors 0.5 state aborted", 1)
+	near(build(), -1)
+	if got, want := Shifts.List()[0].State, ShiftAborted; got != want {
+		t.Fatalf("got state %s want %s", got, want)
+	}
+
+	// removed shifts are forgotten
+	cfg = "route add svc-v1 / http://1.2.3.4/"
+	build()
+	if got := Shifts.List(); len(got) != 0 {
+		t.Fatalf("got %d shifts want 0", len(got))
+	}
+}
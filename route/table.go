@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,24 +19,32 @@ import (
 
 var errInvalidPrefix = errors.New("route: prefix must not be empty")
 var errInvalidTarget = errors.New("route: target must not be empty")
+var errInvalidSocket = errors.New("route: unix target must have a socket path")
 var errNoMatch = errors.New("route: no target match")
 
-// table stores the active routing table. Must never be nil.
+// table stores the active routing table and its lookup index.
+// Must never be nil.
 var table atomic.Value
 
+// activeTable is the active routing table with its lookup index.
+type activeTable struct {
+	t   Table
+	idx *index
+}
+
 // ServiceRegistry stores the metrics for the services.
 var ServiceRegistry metrics.Registry = metrics.NoopRegistry{}
 
 // init initializes the routing table.
 func init() {
-	table.Store(make(Table))
+	table.Store(&activeTable{t: make(Table), idx: newIndex(nil)})
 }
 
 // GetTable returns the active routing table. The function
 // is safe to be called from multiple goroutines and the
 // value is never nil.
 func GetTable() Table {
-	return table.Load().(Table)
+	return table.Load().(*activeTable).t
 }
 
 // mu guards table and registry in SetTable.
@@ -44,17 +53,40 @@ var mu sync.Mutex
 // SetTable sets the active routing table. A nil value
 // logs a warning and is ignored. The function is safe
 // to be called from multiple goroutines.
+//
+// SetTable builds the lookup index for the table which is
+// used by Lookup and LookupHost.
 func SetTable(t Table) {
 	if t == nil {
 		log.Print("[WARN] Ignoring nil routing table")
 		return
 	}
+	idx := newIndex(t)
 	mu.Lock()
-	table.Store(t)
+	table.Store(&activeTable{t: t, idx: idx})
 	syncRegistry(t)
 	mu.Unlock()
 }
 
+// Lookup finds the target for the request in the active routing
+// table like Table.Lookup. The path index of the table is used
+// for the "prefix" matcher.
+func Lookup(req *http.Request, trace string, pick picker, matcherName string) *Target {
+	a := table.Load().(*activeTable)
+	match, idx := Matcher[matcherName], a.idx
+	if matcherName != "prefix" {
+		idx = nil
+	}
+	return a.t.find(req, trace, pick, match, idx)
+}
+
+// LookupHost finds the target for the host in the active routing
+// table like Table.LookupHost.
+func LookupHost(host string, pick picker) *Target {
+	a := table.Load().(*activeTable)
+	return a.t.lookup(host, "/", "", pick, prefixMatcher, a.idx)
+}
+
 // syncRegistry unregisters all inactive timers.
 // It assumes that all timers of the table have
 // already been registered.
@@ -75,6 +107,11 @@ func syncRegistry(t Table) {
 			for _, tg := range r.Targets {
 				timers[tg.timerName] = true
 			}
+			if r.connLimiter != nil {
+				active, queued := r.connLimitNames()
+				timers[active] = true
+				timers[queued] = true
+			}
 		}
 	}
 
@@ -88,10 +125,40 @@ func syncRegistry(t Table) {
 }
 
 // Table contains a set of routes grouped by host.
-// The host routes are sorted from most to least specific
-// by sorting the routes in reverse order by path.
+// The host routes are sorted by priority and then from
+// most to least specific by sorting the routes in reverse
+// order by path.
 type Table map[string]Routes
 
+// Hosts returns the host patterns of the table in the order in which
+// they are evaluated: by priority, then in alphabetical order and the
+// routes without host last.
+func (t Table) Hosts() []string {
+	var hosts []string
+	for host := range t {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	t.sortHosts(hosts)
+	if t[""] != nil {
+		hosts = append(hosts, "")
+	}
+	return hosts
+}
+
+// sortHosts sorts the host patterns by the highest priority
+// of their routes and then in alphabetical order.
+func (t Table) sortHosts(hosts []string) {
+	sort.Slice(hosts, func(i, j int) bool {
+		pi, pj := t[hosts[i]].prio(), t[hosts[j]].prio()
+		if pi != pj {
+			return pi > pj
+		}
+		return hosts[i] < hosts[j]
+	})
+}
+
 // hostpath splits a 'host/path' prefix into 'host' and '/path' or it returns a
 // ':port' prefix as ':port' and '' since there is no path component for TCP
 // connections.
@@ -108,14 +175,59 @@ func hostpath(prefix string) (host string, path string) {
 	return p[0], "/" + p[1]
 }
 
+// NewTable creates a routing table from the config.
 func NewTable(s string) (t Table, err error) {
-	defs, err := Parse(s)
-	if err != nil {
-		return nil, err
+	return NewTableFrom(nil, s)
+}
+
+// NewTableFrom creates the next routing table from one or more configs
+// which are applied in order and takes over the runtime state from the
+// routes of the previous table. Routes whose options and targets have
+// not changed are kept as they are. Changed routes with the same options
+// keep their round-robin counter, their rate and concurrency limiters and
+// the targets which have not changed. The 'route shift' commands of the
+// table replace the ones in Shifts.
+//
+// prev can be nil for tables which do not become active, e.g. for a dry
+// run. Then no state is taken over and Shifts is not modified.
+//
+// Each config is parsed separately so that route commands and
+// JSON or YAML route definitions can be combined.
+func NewTableFrom(prev Table, cfgs ...string) (t Table, err error) {
+	var defs []*RouteDef
+	for _, s := range cfgs {
+		d, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, d...)
 	}
 
-	t = make(Table)
+	if t, err = buildTable(defs); err != nil || prev == nil {
+		return t, err
+	}
+
+	// start the new shifts and attach them to the targets
+	var shifts []*RouteDef
 	for _, d := range defs {
+		if d.Cmd == RouteShiftCmd {
+			shifts = append(shifts, d)
+		}
+	}
+	if Shifts.sync(shifts) {
+		if t, err = buildTable(defs); err != nil {
+			return nil, err
+		}
+	}
+	t.reuseRoutes(prev)
+	return t, nil
+}
+
+// buildTable creates a routing table from the route definitions.
+func buildTable(defs []*RouteDef) (Table, error) {
+	t := make(Table)
+	for _, d := range defs {
+		var err error
 		switch d.Cmd {
 		case RouteAddCmd:
 			err = t.addRoute(d)
@@ -123,6 +235,8 @@ func NewTable(s string) (t Table, err error) {
 			err = t.delRoute(d)
 		case RouteWeightCmd:
 			err = t.weighRoute(d)
+		case RouteShiftCmd:
+			err = t.shiftRoute(d)
 		default:
 			err = fmt.Errorf("route: invalid command: %s", d.Cmd)
 		}
@@ -133,6 +247,39 @@ func NewTable(s string) (t Table, err error) {
 	return t, nil
 }
 
+// newRoute creates a new route for host and path.
+func newRoute(host, path string, opts map[string]string) *Route {
+	r := &Route{Host: host, Path: path, Opts: opts}
+	if v := opts["prio"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("[WARN] route: Ignoring invalid value %q for option prio", v)
+		}
+		r.Prio = n
+	}
+	return r
+}
+
+// reuseRoutes replaces the routes which are identical to the ones in the
+// previous table with the routes from the previous table. Changed routes
+// with the same options take over the state of the previous route. Routes
+// of the previous table are never modified since they may still be in use.
+func (t Table) reuseRoutes(prev Table) {
+	for host, routes := range t {
+		for i, r := range routes {
+			old := prev.route(host, r.Path)
+			switch {
+			case old == nil || !equalOpts(old.Opts, r.Opts):
+				continue
+			case old.equal(r):
+				routes[i] = old
+			default:
+				r.reuse(old)
+			}
+		}
+	}
+}
+
 // addRoute adds a new route prefix -> target for the given service.
 func (t Table) addRoute(d *RouteDef) error {
 	host, path := hostpath(d.Src)
@@ -149,17 +296,23 @@ func (t Table) addRoute(d *RouteDef) error {
 	if err != nil {
 		return fmt.Errorf("route: invalid target. %s", err)
 	}
+	if targetURL.Scheme == "unix" && targetURL.Path == "" {
+		return errInvalidSocket
+	}
+	if v, ok := d.Opts["key"]; ok && !validRateLimitKey(v) {
+		return fmt.Errorf("route: invalid value %q for option key", v)
+	}
 
 	switch {
 	// add new host
 	case t[host] == nil:
-		r := &Route{Host: host, Path: path, Opts: d.Opts}
+		r := newRoute(host, path, d.Opts)
 		r.addTarget(d.Service, targetURL, d.Weight, d.Tags)
 		t[host] = Routes{r}
 
 	// add new route to existing host
 	case t[host].find(path) == nil:
-		r := &Route{Host: host, Path: path, Opts: d.Opts}
+		r := newRoute(host, path, d.Opts)
 		r.addTarget(d.Service, targetURL, d.Weight, d.Tags)
 		t[host] = append(t[host], r)
 		sort.Sort(t[host])
@@ -189,6 +342,41 @@ func (t Table) weighRoute(d *RouteDef) error {
 	return nil
 }
 
+// shiftRoute sets the weight of the targets of a traffic shift and
+// attaches the shift to them. Shifts which have not been started yet
+// use the initial weight. The targets of aborted shifts are removed.
+func (t Table) shiftRoute(d *RouteDef) error {
+	host, path := hostpath(d.Src)
+
+	if d.Src == "" {
+		return errInvalidPrefix
+	}
+
+	r := t.route(host, path)
+	if r == nil {
+		return errNoMatch
+	}
+
+	w, s := d.Shift.From, Shifts.lookup(d)
+	if s != nil {
+		var state string
+		state, w = s.status(Shifts.now())
+		if state == ShiftAborted {
+			r.filter(func(tg *Target) bool {
+				return (d.Service == "" || tg.Service == d.Service) && (len(d.Tags) == 0 || contains(tg.Tags, d.Tags))
+			})
+			t.removeEmpty()
+			return nil
+		}
+	}
+
+	if n := r.setWeight(d.Service, w, d.Tags); n == 0 {
+		return errNoMatch
+	}
+	r.setShift(d.Service, d.Tags, s)
+	return nil
+}
+
 // delRoute removes one or more routes depending on the arguments.
 // If service, prefix and target are provided then only this route
 // is removed. Are only service and prefix provided then all routes
@@ -240,6 +428,13 @@ func (t Table) delRoute(d *RouteDef) error {
 		})
 	}
 
+	t.removeEmpty()
+	return nil
+}
+
+// removeEmpty removes all routes without targets
+// and all hosts without routes.
+func (t Table) removeEmpty() {
 	// remove all routes without targets
 	for host, routes := range t {
 		var clone Routes
@@ -258,8 +453,6 @@ func (t Table) delRoute(d *RouteDef) error {
 			delete(t, host)
 		}
 	}
-
-	return nil
 }
 
 // route finds the route for host/path or returns nil if none exists.
@@ -285,15 +478,21 @@ func normalizeHost(req *http.Request) string {
 }
 
 // matchingHosts returns all keys (host name patterns) from the
-// routing table which match the normalized request hostname.
-func (t Table) matchingHosts(req *http.Request) (hosts []string) {
+// routing table which match the normalized request hostname
+// sorted by priority and name. idx is the lookup index of the
+// table or nil.
+func (t Table) matchingHosts(req *http.Request, idx *index) (hosts []string) {
 	host := normalizeHost(req)
-	for pattern := range t {
-		if glob.Glob(pattern, host) {
-			hosts = append(hosts, pattern)
+	if idx != nil {
+		hosts = idx.matchingHosts(host)
+	} else {
+		for pattern := range t {
+			if glob.Glob(pattern, host) {
+				hosts = append(hosts, pattern)
+			}
 		}
 	}
-	sort.Strings(hosts)
+	t.sortHosts(hosts)
 	return hosts
 }
 
@@ -301,7 +500,13 @@ func (t Table) matchingHosts(req *http.Request) (hosts []string) {
 // or nil if there is none. It first checks the routes for the host
 // and if none matches then it falls back to generic routes without
 // a host. This is useful for a catch-all '/' rule.
-func (t Table) Lookup(req *http.Request, trace string, pick picker, match matcher) (target *Target) {
+func (t Table) Lookup(req *http.Request, trace string, pick picker, match matcher) *Target {
+	return t.find(req, trace, pick, match, nil)
+}
+
+// find implements Lookup with the lookup index of the table. idx
+// can be nil and must only be set for the prefix matcher.
+func (t Table) find(req *http.Request, trace string, pick picker, match matcher, idx *index) (target *Target) {
 	path := req.URL.Path
 	if trace != "" {
 		if len(trace) > 16 {
@@ -312,10 +517,10 @@ func (t Table) Lookup(req *http.Request, trace string, pick picker, match matche
 
 	// find matching hosts for the request
 	// and add "no host" as the fallback option
-	hosts := t.matchingHosts(req)
+	hosts := t.matchingHosts(req, idx)
 	hosts = append(hosts, "")
 	for _, h := range hosts {
-		if target = t.lookup(h, path, trace, pick, match); target != nil {
+		if target = t.lookup(h, path, trace, pick, match, idx); target != nil {
 			break
 		}
 	}
@@ -328,24 +533,27 @@ func (t Table) Lookup(req *http.Request, trace string, pick picker, match matche
 }
 
 func (t Table) LookupHost(host string, pick picker) *Target {
-	return t.lookup(host, "/", "", pick, prefixMatcher)
+	return t.lookup(host, "/", "", pick, prefixMatcher, nil)
 }
 
-func (t Table) lookup(host, path, trace string, pick picker, match matcher) *Target {
-	for _, r := range t[host] {
-		if match(path, r) {
-			n := len(r.Targets)
-			if n == 0 {
+func (t Table) lookup(host, path, trace string, pick picker, match matcher, idx *index) *Target {
+	// the path index finds the same route as the prefix matcher
+	// but does not log the routes which do not match. Hosts with
+	// route priorities have no path index.
+	if idx != nil && trace == "" {
+		if tree := idx.paths[host]; tree != nil {
+			r := tree.longestPrefix(path)
+			if r == nil {
 				return nil
 			}
+			return r.target(pick)
+		}
+	}
 
-			var target *Target
-			if n == 1 {
-				target = r.Targets[0]
-			} else {
-				target = pick(r)
-			}
-			if trace != "" {
+	for _, r := range t[host] {
+		if match(path, r) {
+			target := r.target(pick)
+			if target != nil && trace != "" {
 				log.Printf("[TRACE] %s Match %s%s", trace, r.Host, r.Path)
 			}
 			return target
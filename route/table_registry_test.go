@@ -57,6 +57,11 @@ func (p *stubRegistry) GetCounter(name string) metrics.Counter {
 	return metrics.NoopCounter{}
 }
 
+func (p *stubRegistry) GetGauge(name string) metrics.Gauge {
+	p.names[name] = true
+	return metrics.NoopGauge{}
+}
+
 func (p *stubRegistry) GetTimer(name string) metrics.Timer {
 	p.names[name] = true
 	return metrics.NoopTimer{}
@@ -33,6 +33,15 @@ func TestTableParse(t *testing.T) {
 			},
 		},
 
+		{"1 service, 1 prefix, unix socket",
+			[]string{
+				`route add svc-a / unix:///run/a.sock`,
+			},
+			[]string{
+				`route add svc-a / unix:///run/a.sock weight 1.0000`,
+			},
+		},
+
 		{"1 service, 1 prefix, 3 instances",
 			[]string{
 				`route add svc-a / http://aaa.com:1111/`,
@@ -521,3 +530,170 @@ func TestTableLookup(t *testing.T) {
 		}
 	}
 }
+
+func TestNewTableFrom(t *testing.T) {
+	prev, err := NewTable(`
+	route add svc /a http://foo.com:1000
+	route add svc /b http://foo.com:2000 opts "ratelimit=10/s"
+	route add svc /c http://foo.com:3000 opts "maxconns=5"
+	route add svc /e http://foo.com:5000 weight 0.5
+	route add svc /e http://foo.com:5001 weight 0.5
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/b", "/c"} {
+		prev.route("", p).total = 5
+	}
+
+	tbl, err := NewTableFrom(prev, `
+	route add svc /a http://foo.com:1000
+	route add svc /b http://foo.com:2000 opts "ratelimit=10/s"
+	route add svc /b http://foo.com:2001 opts "ratelimit=10/s"
+	route add svc /c http://foo.com:3000 opts "maxconns=10"
+	route add svc /d http://foo.com:4000
+	route add svc /e http://foo.com:5000 weight 0.5
+	route add svc /e http://foo.com:5002 weight 0.5
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unchanged route is taken over
+	if got, want := tbl.route("", "/a"), prev.route("", "/a"); got != want {
+		t.Fatal("got new route for /a want previous route")
+	}
+
+	// changed targets keep the state
+	a, b := prev.route("", "/b"), tbl.route("", "/b")
+	if a == b {
+		t.Fatal("got previous route for /b want new route")
+	}
+	if got, want := b.total, uint64(5); got != want {
+		t.Fatalf("got total %d want %d", got, want)
+	}
+	if b.limiter == nil || b.limiter != a.limiter {
+		t.Fatal("got new rate limiter for /b want previous limiter")
+	}
+	for _, tg := range b.Targets {
+		if tg.RateLimiter != a.limiter {
+			t.Fatalf("got new rate limiter for target %s want previous limiter", tg.URL)
+		}
+	}
+	if got, want := len(a.Targets), 1; got != want {
+		t.Fatalf("previous route modified: got %d targets want %d", got, want)
+	}
+
+	// changed options reset the state
+	c := tbl.route("", "/c")
+	if got, want := c.total, uint64(0); got != want {
+		t.Fatalf("got total %d want %d", got, want)
+	}
+	if c.connLimiter == prev.route("", "/c").connLimiter {
+		t.Fatal("got previous concurrency limiter for /c want new limiter")
+	}
+	if got, want := c.connLimiter.Max, 10; got != want {
+		t.Fatalf("got max %d want %d", got, want)
+	}
+
+	// unchanged targets of a changed route are taken over
+	e, olde := tbl.route("", "/e"), prev.route("", "/e")
+	if got, want := e.Targets[0], olde.Targets[0]; got != want {
+		t.Fatalf("got new target %s want previous target", got.URL)
+	}
+	if got, want := e.Targets[1].URL.String(), "http://foo.com:5002"; got != want {
+		t.Fatalf("got target %s want %s", got, want)
+	}
+	for _, tg := range e.wTargets {
+		if tg != e.Targets[0] && tg != e.Targets[1] {
+			t.Fatalf("got unknown target %s in weighted targets", tg.URL)
+		}
+	}
+}
+
+func TestTableUnixTarget(t *testing.T) {
+	tbl, err := NewTable(`
+	route add svc /a unix:///run/a.sock
+	route add svc /b http://foo.com:2000
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tbl.route("", "/a").Targets[0].Socket, "/run/a.sock"; got != want {
+		t.Fatalf("got socket %q want %q", got, want)
+	}
+	if got, want := tbl.route("", "/b").Targets[0].Socket, ""; got != want {
+		t.Fatalf("got socket %q want %q", got, want)
+	}
+
+	if _, err := NewTable(`route add svc /a unix://`); err != errInvalidSocket {
+		t.Fatalf("got error %v want %v", err, errInvalidSocket)
+	}
+}
+
+func TestTableRateLimitKey(t *testing.T) {
+	for _, key := range []string{"clientip", "header:X-Api-Key"} {
+		if _, err := NewTable(`route add svc /a http://foo.com:2000 opts "ratelimit=10/s key=` + key + `"`); err != nil {
+			t.Fatalf("%s: got error %v want nil", key, err)
+		}
+	}
+	for _, key := range []string{"", "header:", "X-Api-Key", "clientIP"} {
+		_, err := NewTable(`route add svc /a http://foo.com:2000 opts "ratelimit=10/s key=` + key + `"`)
+		if want := `route: invalid value "` + key + `" for option key`; err == nil || err.Error() != want {
+			t.Fatalf("got error %v want %q", err, want)
+		}
+	}
+}
+
+func TestTableLookupPrio(t *testing.T) {
+	s := `
+	route add svc / http://foo.com:800
+	route add svc /foo/* http://foo.com:900
+	route add svc /foo/bar http://foo.com:1000 opts "prio=10"
+	route add svc /*/bar http://foo.com:1100 opts "prio=5"
+	route add svc *.abc.com/ http://foo.com:2000
+	route add svc x.abc.com/ http://foo.com:2500
+	route add svc *.com/ http://foo.com:3000 opts "prio=1"
+	`
+
+	tbl, err := NewTable(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := tbl.Hosts(), []string{"*.com", "*.abc.com", "x.abc.com", ""}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got hosts %v want %v", got, want)
+	}
+
+	var tests = []struct {
+		req   *http.Request
+		match matcher
+		dst   string
+	}{
+		// prio overrides the order of the paths
+		{&http.Request{Host: "abc.org", URL: mustParse("/foo/bar")}, globMatcher, "http://foo.com:1000"},
+		{&http.Request{Host: "abc.org", URL: mustParse("/baz/bar")}, globMatcher, "http://foo.com:1100"},
+		{&http.Request{Host: "abc.org", URL: mustParse("/foo/baz")}, globMatcher, "http://foo.com:900"},
+		{&http.Request{Host: "abc.org", URL: mustParse("/foo/bar")}, prefixMatcher, "http://foo.com:1000"},
+		{&http.Request{Host: "abc.org", URL: mustParse("/foo/")}, prefixMatcher, "http://foo.com:800"},
+
+		// prio overrides the order of the hosts
+		{&http.Request{Host: "x.abc.com", URL: mustParse("/")}, prefixMatcher, "http://foo.com:3000"},
+		{&http.Request{Host: "x.abc.org", URL: mustParse("/")}, prefixMatcher, "http://foo.com:800"},
+
+		// routes without host are evaluated last whatever their prio
+		{&http.Request{Host: "x.abc.com", URL: mustParse("/foo/bar")}, prefixMatcher, "http://foo.com:3000"},
+	}
+
+	for i, tt := range tests {
+		if got, want := tbl.Lookup(tt.req, "", rrPicker, tt.match).URL.String(), tt.dst; got != want {
+			t.Errorf("%d: got %v want %v", i, got, want)
+		}
+	}
+
+	// the lookup index evaluates the hosts in the same order
+	req := &http.Request{Host: "x.abc.com", URL: mustParse("/foo/bar")}
+	if got, want := tbl.find(req, "", rrPicker, prefixMatcher, newIndex(tbl)).URL.String(), "http://foo.com:3000"; got != want {
+		t.Errorf("got %v want %v with index", got, want)
+	}
+}
@@ -2,14 +2,21 @@ package route
 
 import (
 	"net/url"
+	"time"
 
+	"github.com/fabiolb/fabio/connlimit"
 	"github.com/fabiolb/fabio/metrics"
+	"github.com/fabiolb/fabio/ratelimit"
 )
 
 type Target struct {
 	// Service is the name of the service the targetURL points to
 	Service string
 
+	// Route is the host and path of the route of this target,
+	// e.g. 'example.com/foo'.
+	Route string
+
 	// Tags are the list of tags for this target
 	Tags []string
 
@@ -21,6 +28,34 @@ type Target struct {
 	// TLS connections.
 	TLSSkipVerify bool
 
+	// TLSCA is the name of the certificate source with the CA
+	// bundle which verifies the certificate of the upstream server.
+	TLSCA string
+
+	// TLSCert is the name of the certificate source with the client
+	// certificate which is presented to the upstream server.
+	TLSCert string
+
+	// TLSServerName is the name which the certificate of the
+	// upstream server must be valid for. The default is the
+	// server name from SNI.
+	TLSServerName string
+
+	// SNI is the server name which is sent to the upstream server
+	// in the TLS handshake. 'host' uses the host of the request.
+	// The default is TLSServerName or the host of the target URL.
+	SNI string
+
+	// Proto is the protocol for upstream connections which need a
+	// dedicated transport. It is 'h2c' for HTTP/2 without TLS and 'grpc'
+	// for gRPC over h2c. It is empty for HTTP/1.1 and HTTPS targets.
+	Proto string
+
+	// ProxyProto is the version of the PROXY protocol header with the
+	// client address which is sent to TCP upstream servers. It is zero
+	// if no header is sent.
+	ProxyProto int
+
 	// Host signifies what the proxy will set the Host header to.
 	// The proxy does not modify the Host header by default.
 	// When Host is set to 'dst' the proxy will use the host name
@@ -30,6 +65,10 @@ type Target struct {
 	// URL is the endpoint the service instance listens on
 	URL *url.URL
 
+	// Socket is the path of the unix domain socket for targets with
+	// a 'unix://' URL. It is empty for all other targets.
+	Socket string
+
 	// FixedWeight is the weight assigned to this target.
 	// If the value is 0 the targets weight is dynamic.
 	FixedWeight float64
@@ -46,4 +85,65 @@ type Target struct {
 	// AuthEnabled indicates whether the target has authentication/authorization
 	// enabled
 	AuthEnabled bool
+
+	// DialTimeout overrides the global dial timeout for
+	// connections to this target if it is not zero.
+	DialTimeout time.Duration
+
+	// ResponseHeaderTimeout overrides the global response header
+	// timeout for requests to this target if it is not zero.
+	ResponseHeaderTimeout time.Duration
+
+	// Timeout is the maximum duration of a request to this target
+	// including reading the response body. Zero means no timeout.
+	Timeout time.Duration
+
+	// RateLimiter limits the request rate for the route of this
+	// target. It is shared by all targets of the route and is nil
+	// if the route is not rate limited.
+	RateLimiter *ratelimit.Limiter
+
+	// RateLimitKey determines how requests are grouped for rate
+	// limiting. It is either 'clientip' or 'header:<name>'. An empty
+	// value is the same as 'clientip'.
+	RateLimitKey string
+
+	// ConnLimiter limits the number of concurrent requests for the
+	// route of this target. It is shared by all targets of the route
+	// and is nil if the route has no concurrency limit.
+	ConnLimiter *connlimit.Limiter
+
+	// WSLimiter limits the number of concurrent websocket connections
+	// for the route of this target. It is shared by all targets of the
+	// route and is nil if the route has no websocket connection limit.
+	WSLimiter *connlimit.Limiter
+
+	// WSIdleTimeout overrides the global idle timeout for websocket
+	// connections to this target if it is not zero.
+	WSIdleTimeout time.Duration
+
+	// MaxBody overrides the global maximum size of request bodies
+	// for this target if it is not zero.
+	MaxBody int64
+
+	// CORS contains the Cross-Origin Resource Sharing configuration
+	// for this target. It is nil if CORS is not enabled.
+	CORS *CORS
+
+	// RequestHeaders contains the header modifications which are
+	// applied to the request before it is sent to the target.
+	RequestHeaders []HeaderOp
+
+	// ResponseHeaders contains the header modifications which are
+	// applied to the response before it is returned to the client.
+	ResponseHeaders []HeaderOp
+
+	// ErrorPages is the name of the directory with the error page
+	// templates for this target. It is empty if the target uses the
+	// default error pages.
+	ErrorPages string
+
+	// Shift is the traffic shift which controls the weight of this
+	// target. It is nil if the target is not part of a shift.
+	Shift *Shift
 }
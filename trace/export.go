@@ -0,0 +1,281 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// encoder converts the spans into the request body for the collector.
+type encoder func(service string, spans []*Span) (body []byte, contentType string, err error)
+
+// exporter sends the spans in batches to the collector. Spans are
+// exported when the batch is full or when the interval has passed.
+// Spans are dropped when the queue is full so that a slow collector
+// does not delay the requests.
+type exporter struct {
+	url       string
+	service   string
+	encode    encoder
+	client    *http.Client
+	batchSize int
+
+	queue   chan *Span
+	flushc  chan chan struct{}
+	dropped int64
+}
+
+func newExporter(url, service string, enc encoder, batchSize int, interval time.Duration) *exporter {
+	if batchSize <= 0 {
+		batchSize = 512
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	e := &exporter{
+		url:       url,
+		service:   service,
+		encode:    enc,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		batchSize: batchSize,
+		queue:     make(chan *Span, 4*batchSize),
+		flushc:    make(chan chan struct{}),
+	}
+	go e.loop(interval)
+	return e
+}
+
+func (e *exporter) add(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// flush exports the queued spans and waits for the export.
+func (e *exporter) flush() {
+	done := make(chan struct{})
+	e.flushc <- done
+	<-done
+}
+
+func (e *exporter) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= e.batchSize {
+				e.send(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+
+		case done := <-e.flushc:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) >= e.batchSize {
+					e.send(batch)
+					batch = nil
+				}
+			}
+			e.send(batch)
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+func (e *exporter) send(spans []*Span) {
+	if n := atomic.SwapInt64(&e.dropped, 0); n > 0 {
+		log.Printf("[WARN] trace: Dropped %d spans since the queue was full", n)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	body, contentType, err := e.encode(e.service, spans)
+	if err != nil {
+		log.Printf("[ERROR] trace: Cannot encode %d spans. %s", len(spans), err)
+		return
+	}
+	resp, err := e.client.Post(e.url, contentType, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR] trace: Cannot export %d spans. %s", len(spans), err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[ERROR] trace: Cannot export %d spans. Collector returned %s", len(spans), resp.Status)
+	}
+}
+
+// OTLP/HTTP with JSON encoding. The ids are hex encoded and 64 bit
+// integers are sent as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	TraceState        string      `json:"traceState,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpString(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func encodeOTLP(service string, spans []*Span) ([]byte, string, error) {
+	ss := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		x := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if !s.ParentID.IsZero() {
+			x.ParentSpanID = s.ParentID.String()
+		}
+		// SPAN_KIND_SERVER = 2, SPAN_KIND_CLIENT = 3
+		switch s.Kind {
+		case KindServer:
+			x.Kind = 2
+		case KindClient:
+			x.Kind = 3
+		}
+		for _, a := range s.Attrs {
+			switch v := a.Value.(type) {
+			case int:
+				n := strconv.Itoa(v)
+				x.Attributes = append(x.Attributes, otlpAttr{Key: a.Key, Value: otlpValue{IntValue: &n}})
+			default:
+				x.Attributes = append(x.Attributes, otlpString(a.Key, fmt.Sprint(v)))
+			}
+		}
+		if s.Error != "" {
+			// STATUS_CODE_ERROR = 2
+			x.Status = &otlpStatus{Code: 2, Message: s.Error}
+		}
+		ss = append(ss, x)
+	}
+	req := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: []otlpAttr{otlpString("service.name", service)}},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "fabio"}, Spans: ss}},
+		}},
+	}
+	b, err := json.Marshal(req)
+	return b, "application/json", err
+}
+
+// Zipkin API v2 with JSON encoding. Timestamps and durations are in
+// microseconds.
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+func encodeZipkin(service string, spans []*Span) ([]byte, string, error) {
+	zs := make([]zipkinSpan, 0, len(spans))
+	for _, s := range spans {
+		x := zipkinSpan{
+			TraceID:       s.Context.TraceID.String(),
+			ID:            s.Context.SpanID.String(),
+			Name:          s.Name,
+			Timestamp:     s.Start.UnixNano() / 1000,
+			Duration:      s.End.Sub(s.Start).Nanoseconds() / 1000,
+			LocalEndpoint: zipkinEndpoint{ServiceName: service},
+		}
+		if !s.ParentID.IsZero() {
+			x.ParentID = s.ParentID.String()
+		}
+		if s.Kind == KindServer || s.Kind == KindClient {
+			x.Kind = s.Kind.String()
+		}
+		// zipkin rejects spans with a duration of zero
+		if x.Duration < 1 {
+			x.Duration = 1
+		}
+		if len(s.Attrs) > 0 || s.Error != "" {
+			x.Tags = map[string]string{}
+		}
+		for _, a := range s.Attrs {
+			x.Tags[a.Key] = fmt.Sprint(a.Value)
+		}
+		if s.Error != "" {
+			x.Tags["error"] = s.Error
+		}
+		zs = append(zs, x)
+	}
+	b, err := json.Marshal(zs)
+	return b, "application/json", err
+}
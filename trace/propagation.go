@@ -0,0 +1,173 @@
+package trace
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headers contains all trace headers which are replaced when the
+// trace context is sent to the upstream server.
+var headers = []string{
+	"Traceparent",
+	"Tracestate",
+	"B3",
+	"X-B3-Traceid",
+	"X-B3-Spanid",
+	"X-B3-Parentspanid",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// extract returns the trace context from the W3C 'traceparent' and
+// 'tracestate' headers, the single 'b3' header or the multiple
+// 'X-B3-*' headers in that order. decided is false if the headers
+// contain no sampling decision. ok is false if there is no valid
+// trace context.
+func extract(h http.Header) (sc SpanContext, decided, ok bool) {
+	if v := h.Get("Traceparent"); v != "" {
+		if sc, ok = parseTraceparent(v); ok {
+			sc.TraceState = strings.Join(h["Tracestate"], ",")
+			return sc, true, true
+		}
+	}
+	if v := h.Get("B3"); v != "" {
+		if sc, decided, ok = parseB3(v); ok {
+			return sc, decided, true
+		}
+	}
+	if v := h.Get("X-B3-Traceid"); v != "" {
+		if !parseTraceID(v, &sc.TraceID) || !parseSpanID(h.Get("X-B3-Spanid"), &sc.SpanID) {
+			return SpanContext{}, false, false
+		}
+		sampled, flags := h.Get("X-B3-Sampled"), h.Get("X-B3-Flags")
+		sc.Sampled = sampled == "1" || sampled == "true" || flags == "1"
+		return sc, sampled != "" || flags != "", true
+	}
+	return SpanContext{}, false, false
+}
+
+// parseTraceparent parses a 'traceparent' header value in the format
+// 'version-traceid-spanid-flags'. Values of future versions may have
+// additional fields.
+func parseTraceparent(v string) (sc SpanContext, ok bool) {
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, false
+	}
+	if strings.ToLower(v) != v {
+		return sc, false
+	}
+	version, err := hex.DecodeString(v[:2])
+	if err != nil || version[0] == 0xff {
+		return sc, false
+	}
+	if version[0] == 0 && len(v) != 55 {
+		return sc, false
+	}
+	if len(v) > 55 && v[55] != '-' {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(v[53:55])
+	if err != nil {
+		return sc, false
+	}
+	if !parseTraceID(v[3:35], &sc.TraceID) || !parseSpanID(v[36:52], &sc.SpanID) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// parseB3 parses a single 'b3' header value in the format
+// 'traceid-spanid[-sampled[-parentspanid]]'. Values with only a
+// sampling decision do not contain a trace context.
+func parseB3(v string) (sc SpanContext, decided, ok bool) {
+	p := strings.Split(v, "-")
+	if len(p) < 2 || len(p) > 4 {
+		return sc, false, false
+	}
+	if !parseTraceID(p[0], &sc.TraceID) || !parseSpanID(p[1], &sc.SpanID) {
+		return sc, false, false
+	}
+	if len(p) > 2 {
+		switch p[2] {
+		case "1", "d":
+			sc.Sampled = true
+		case "0":
+		default:
+			return sc, false, false
+		}
+		decided = true
+	}
+	return sc, decided, true
+}
+
+// parseTraceID parses a hex encoded trace id with 32 or 16 characters.
+// Short ids are padded with zeros on the left.
+func parseTraceID(s string, id *TraceID) bool {
+	if len(s) != 32 && len(s) != 16 {
+		return false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	var x TraceID
+	copy(x[16-len(b):], b)
+	if x.IsZero() {
+		return false
+	}
+	*id = x
+	return true
+}
+
+// parseSpanID parses a hex encoded span id with 16 characters.
+func parseSpanID(s string, id *SpanID) bool {
+	if len(s) != 16 {
+		return false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	var x SpanID
+	copy(x[:], b)
+	if x.IsZero() {
+		return false
+	}
+	*id = x
+	return true
+}
+
+// inject removes all trace headers and adds the headers for the trace
+// context in the given formats.
+func inject(h http.Header, sc SpanContext, parent SpanID, formats []string) {
+	for _, k := range headers {
+		h.Del(k)
+	}
+	for _, f := range formats {
+		switch f {
+		case "w3c":
+			var flags byte
+			if sc.Sampled {
+				flags = 1
+			}
+			h.Set("Traceparent", fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags))
+			if sc.TraceState != "" {
+				h.Set("Tracestate", sc.TraceState)
+			}
+		case "b3":
+			h.Set("X-B3-TraceId", sc.TraceID.String())
+			h.Set("X-B3-SpanId", sc.SpanID.String())
+			if !parent.IsZero() {
+				h.Set("X-B3-ParentSpanId", parent.String())
+			}
+			if sc.Sampled {
+				h.Set("X-B3-Sampled", "1")
+			} else {
+				h.Set("X-B3-Sampled", "0")
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package trace
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	var (
+		traceID = TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+		shortID = TraceID{8: 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+		spanID  = SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}
+	)
+
+	tests := []struct {
+		desc    string
+		h       http.Header
+		sc      SpanContext
+		decided bool
+		ok      bool
+	}{
+		{
+			desc: "no headers",
+			h:    http.Header{},
+		},
+		{
+			desc:    "traceparent sampled",
+			h:       http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc:    "traceparent not sampled with tracestate",
+			h:       http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}, "Tracestate": {"a=1", "b=2"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID, TraceState: "a=1,b=2"},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc:    "traceparent future version",
+			h:       http.Header{"Traceparent": {"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc: "traceparent upper case",
+			h:    http.Header{"Traceparent": {"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01"}},
+		},
+		{
+			desc: "traceparent zero trace id",
+			h:    http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}},
+		},
+		{
+			desc: "traceparent invalid version",
+			h:    http.Header{"Traceparent": {"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+		},
+		{
+			desc:    "invalid traceparent falls back to b3",
+			h:       http.Header{"Traceparent": {"00-xyz"}, "B3": {"4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc: "b3 without sampling decision",
+			h:    http.Header{"B3": {"a3ce929d0e0e4736-00f067aa0ba902b7"}},
+			sc:   SpanContext{TraceID: shortID, SpanID: spanID},
+			ok:   true,
+		},
+		{
+			desc:    "b3 with parent",
+			h:       http.Header{"B3": {"4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0-0000000000000001"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc: "b3 sampling only",
+			h:    http.Header{"B3": {"1"}},
+		},
+		{
+			desc:    "x-b3 headers",
+			h:       http.Header{"X-B3-Traceid": {"4bf92f3577b34da6a3ce929d0e0e4736"}, "X-B3-Spanid": {"00f067aa0ba902b7"}, "X-B3-Sampled": {"1"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc:    "x-b3 debug flag",
+			h:       http.Header{"X-B3-Traceid": {"4bf92f3577b34da6a3ce929d0e0e4736"}, "X-B3-Spanid": {"00f067aa0ba902b7"}, "X-B3-Flags": {"1"}},
+			sc:      SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true},
+			decided: true,
+			ok:      true,
+		},
+		{
+			desc: "x-b3 headers without span id",
+			h:    http.Header{"X-B3-Traceid": {"4bf92f3577b34da6a3ce929d0e0e4736"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sc, decided, ok := extract(tt.h)
+			if got, want := ok, tt.ok; got != want {
+				t.Fatalf("got ok %v want %v", got, want)
+			}
+			if got, want := decided, tt.decided; got != want {
+				t.Fatalf("got decided %v want %v", got, want)
+			}
+			if got, want := sc, tt.sc; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestInject(t *testing.T) {
+	sc := SpanContext{
+		TraceID:    TraceID{15: 1},
+		SpanID:     SpanID{7: 2},
+		Sampled:    true,
+		TraceState: "a=1",
+	}
+	parent := SpanID{7: 3}
+
+	tests := []struct {
+		desc    string
+		formats []string
+		h       http.Header
+	}{
+		{
+			desc: "no formats",
+		},
+		{
+			desc:    "w3c",
+			formats: []string{"w3c"},
+			h: http.Header{
+				"Traceparent": {"00-00000000000000000000000000000001-0000000000000002-01"},
+				"Tracestate":  {"a=1"},
+			},
+		},
+		{
+			desc:    "b3",
+			formats: []string{"b3"},
+			h: http.Header{
+				"X-B3-Traceid":      {"00000000000000000000000000000001"},
+				"X-B3-Spanid":       {"0000000000000002"},
+				"X-B3-Parentspanid": {"0000000000000003"},
+				"X-B3-Sampled":      {"1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := http.Header{
+				"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+				"B3":          {"1"},
+				"X-B3-Flags":  {"1"},
+			}
+			inject(h, sc, parent, tt.formats)
+			want := tt.h
+			if want == nil {
+				want = http.Header{}
+			}
+			if got := h; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+// Package trace implements distributed tracing for the proxy. Trace
+// contexts are propagated with the W3C Trace Context and B3 headers
+// and the spans are exported in batches to an OTLP/HTTP or Zipkin
+// collector.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsZero returns true if all bytes of the id are zero.
+func (id TraceID) IsZero() bool { return id == TraceID{} }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsZero returns true if all bytes of the id are zero.
+func (id SpanID) IsZero() bool { return id == SpanID{} }
+
+// SpanContext is the part of a span which is propagated to other
+// services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+
+	// Sampled is true if the spans of the trace are recorded.
+	Sampled bool
+
+	// TraceState is the vendor specific trace state from the
+	// 'tracestate' header which is passed on unchanged.
+	TraceState string
+}
+
+// Kind describes the role of a span in a request.
+type Kind int
+
+const (
+	// KindServer is the span of a request received by the proxy.
+	KindServer Kind = iota + 1
+
+	// KindClient is the span of a request sent to an upstream server.
+	KindClient
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindServer:
+		return "SERVER"
+	case KindClient:
+		return "CLIENT"
+	default:
+		return "INTERNAL"
+	}
+}
+
+// Attr is a span attribute. Value is either a string or an int.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span describes a single operation of a trace. All methods of a span
+// are safe to be called on a nil span which makes it possible to use
+// the same code with tracing disabled. A span must not be modified by
+// multiple go routines.
+type Span struct {
+	Name     string
+	Kind     Kind
+	Context  SpanContext
+	ParentID SpanID
+	Start    time.Time
+	End      time.Time
+	Attrs    []Attr
+
+	// Error describes why the operation failed. It is empty if the
+	// operation was successful.
+	Error string
+
+	tracer *Tracer
+}
+
+// SetAttr sets the value of an attribute. The value must be a string
+// or an int.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil || !s.Context.Sampled {
+		return
+	}
+	for i := range s.Attrs {
+		if s.Attrs[i].Key == key {
+			s.Attrs[i].Value = value
+			return
+		}
+	}
+	s.Attrs = append(s.Attrs, Attr{key, value})
+}
+
+// SetStatus records the HTTP status code of the response. Status codes
+// of 500 and above mark the span as failed.
+func (s *Span) SetStatus(code int) {
+	if s == nil {
+		return
+	}
+	s.SetAttr("http.status_code", code)
+	if code >= 500 {
+		s.Error = strconv.Itoa(code) + " " + http.StatusText(code)
+	}
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// StartChild starts a new span within the same trace.
+func (s *Span) StartChild(name string, kind Kind) *Span {
+	if s == nil {
+		return nil
+	}
+	sc := s.Context
+	sc.SpanID = newSpanID()
+	return &Span{
+		Name:     name,
+		Kind:     kind,
+		Context:  sc,
+		ParentID: s.Context.SpanID,
+		Start:    time.Now(),
+		tracer:   s.tracer,
+	}
+}
+
+// Inject replaces the trace headers in h with the headers for the
+// span in the formats from the propagation setting of the tracer.
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	inject(h, s.Context, s.ParentID, s.tracer.Propagation)
+}
+
+// Finish sets the end time of the span and queues it for the export
+// if it is sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.Context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.add(s)
+	}
+}
+
+// Tracer creates the spans for the requests and exports them. A nil
+// Tracer creates no spans.
+type Tracer struct {
+	// Service is the name of the service which creates the spans.
+	Service string
+
+	// SampleRate is the fraction of new traces which are sampled.
+	// Traces which were started by a client keep their sampling
+	// decision.
+	SampleRate float64
+
+	// Propagation contains the header formats which are sent to the
+	// upstream servers. Valid values are 'w3c' and 'b3'.
+	Propagation []string
+
+	exporter *exporter
+}
+
+// New creates a tracer which exports the spans to the collector of
+// the configuration. It returns nil if tracing is disabled.
+func New(cfg config.Tracing) (*Tracer, error) {
+	var enc encoder
+	switch cfg.Target {
+	case "":
+		return nil, nil
+	case "otlp":
+		enc = encodeOTLP
+	case "zipkin":
+		enc = encodeZipkin
+	default:
+		return nil, fmt.Errorf("trace: invalid target %q", cfg.Target)
+	}
+	t := &Tracer{
+		Service:     cfg.ServiceName,
+		SampleRate:  cfg.SampleRate,
+		Propagation: cfg.Propagation,
+	}
+	t.exporter = newExporter(cfg.Collector, t.Service, enc, cfg.BatchSize, cfg.Interval)
+	return t, nil
+}
+
+// StartServer starts the server span for a request. It continues the
+// trace from the trace headers of the request or starts a new one.
+func (t *Tracer) StartServer(name string, h http.Header) *Span {
+	if t == nil {
+		return nil
+	}
+	parent, decided, ok := extract(h)
+	s := &Span{
+		Name:   name,
+		Kind:   KindServer,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if ok {
+		s.Context = parent
+		s.ParentID = parent.SpanID
+	} else {
+		s.Context.TraceID = newTraceID()
+	}
+	s.Context.SpanID = newSpanID()
+	if !decided {
+		s.Context.Sampled = t.sample(s.Context.TraceID)
+	}
+	return s
+}
+
+// sample decides whether a new trace is sampled. The decision is based
+// on the random part of the trace id so that it can be reproduced.
+func (t *Tracer) sample(id TraceID) bool {
+	x := binary.BigEndian.Uint64(id[8:]) >> 11
+	return float64(x)/(1<<53) < t.SampleRate
+}
+
+// Flush exports all queued spans and waits until the export has
+// completed.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	t.exporter.flush()
+}
+
+type spanKey struct{}
+
+// NewContext returns a context which carries the span.
+func NewContext(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext returns the span of the context or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+func newTraceID() (id TraceID) {
+	for id.IsZero() {
+		random(id[:])
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for id.IsZero() {
+		random(id[:])
+	}
+	return id
+}
+
+func random(b []byte) {
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic("trace: cannot read random bytes: " + err.Error())
+	}
+}
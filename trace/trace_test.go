@@ -0,0 +1,192 @@
+package trace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// collector records the request bodies which are sent to it.
+type collector struct {
+	*httptest.Server
+	bodies chan []byte
+}
+
+func newCollector() *collector {
+	c := &collector{bodies: make(chan []byte, 10)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		c.bodies <- b
+	}))
+	return c
+}
+
+func newTracer(t *testing.T, target, url string) *Tracer {
+	tr, err := New(config.Tracing{
+		Target:      target,
+		Collector:   url,
+		ServiceName: "fabio",
+		SampleRate:  1,
+		Propagation: []string{"w3c"},
+		BatchSize:   10,
+		Interval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestNewDisabled(t *testing.T) {
+	tr, err := New(config.Tracing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr != nil {
+		t.Fatalf("got %v want nil", tr)
+	}
+
+	// a nil tracer and span must be usable
+	s := tr.StartServer("GET", http.Header{})
+	s.SetAttr("a", "b")
+	s.SetStatus(502)
+	s.StartChild("GET", KindClient).Inject(http.Header{})
+	s.Finish()
+	tr.Flush()
+}
+
+func TestStartServer(t *testing.T) {
+	tr := &Tracer{SampleRate: 1}
+
+	s := tr.StartServer("GET", http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}})
+	if got, want := s.Context.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736"; got != want {
+		t.Fatalf("got trace id %s want %s", got, want)
+	}
+	if got, want := s.ParentID.String(), "00f067aa0ba902b7"; got != want {
+		t.Fatalf("got parent id %s want %s", got, want)
+	}
+	if s.Context.SpanID == s.ParentID {
+		t.Fatal("span id not updated")
+	}
+	if s.Context.Sampled {
+		t.Fatal("got sampled want not sampled since the client decided")
+	}
+
+	s = tr.StartServer("GET", http.Header{})
+	if s.Context.TraceID.IsZero() || !s.ParentID.IsZero() {
+		t.Fatalf("got %v want new trace without parent", s.Context)
+	}
+	if !s.Context.Sampled {
+		t.Fatal("got not sampled want sampled")
+	}
+
+	tr.SampleRate = 0
+	if s := tr.StartServer("GET", http.Header{}); s.Context.Sampled {
+		t.Fatal("got sampled want not sampled")
+	}
+}
+
+func TestExportOTLP(t *testing.T) {
+	c := newCollector()
+	defer c.Close()
+	tr := newTracer(t, "otlp", c.URL)
+
+	s := tr.StartServer("GET /foo", http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+	s.SetAttr("fabio.service", "svc")
+	cs := s.StartChild("GET", KindClient)
+	cs.SetStatus(503)
+	cs.Finish()
+	s.SetStatus(503)
+	s.Finish()
+	tr.Flush()
+
+	var req otlpRequest
+	if err := json.Unmarshal(<-c.bodies, &req); err != nil {
+		t.Fatal(err)
+	}
+	rs := req.ResourceSpans[0]
+	if got, want := *rs.Resource.Attributes[0].Value.StringValue, "fabio"; got != want {
+		t.Fatalf("got service %q want %q", got, want)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if got, want := len(spans), 2; got != want {
+		t.Fatalf("got %d spans want %d", got, want)
+	}
+	client, server := spans[0], spans[1]
+	if got, want := server.ParentSpanID, "00f067aa0ba902b7"; got != want {
+		t.Fatalf("got server parent %q want %q", got, want)
+	}
+	if got, want := client.ParentSpanID, server.SpanID; got != want {
+		t.Fatalf("got client parent %q want %q", got, want)
+	}
+	if got, want := server.Kind, 2; got != want {
+		t.Fatalf("got kind %d want %d", got, want)
+	}
+	if got, want := client.Kind, 3; got != want {
+		t.Fatalf("got kind %d want %d", got, want)
+	}
+	if got, want := server.Status, (&otlpStatus{Code: 2, Message: "503 Service Unavailable"}); *got != *want {
+		t.Fatalf("got status %v want %v", got, want)
+	}
+	if got, want := len(server.Attributes), 2; got != want {
+		t.Fatalf("got %d attributes want %d", got, want)
+	}
+	if got, want := *server.Attributes[1].Value.IntValue, "503"; got != want {
+		t.Fatalf("got status code %q want %q", got, want)
+	}
+}
+
+func TestExportZipkin(t *testing.T) {
+	c := newCollector()
+	defer c.Close()
+	tr := newTracer(t, "zipkin", c.URL)
+
+	s := tr.StartServer("GET /foo", http.Header{})
+	s.SetAttr("fabio.route", "/foo")
+	s.SetStatus(200)
+	s.Finish()
+
+	// unsampled spans are not exported
+	tr.StartServer("GET", http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}}).Finish()
+	tr.Flush()
+
+	var spans []zipkinSpan
+	if err := json.Unmarshal(<-c.bodies, &spans); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(spans), 1; got != want {
+		t.Fatalf("got %d spans want %d", got, want)
+	}
+	got := spans[0]
+	if got.Name != "GET /foo" || got.Kind != "SERVER" || got.LocalEndpoint.ServiceName != "fabio" || got.Duration < 1 {
+		t.Fatalf("got %+v", got)
+	}
+	if got, want := got.Tags, map[string]string{"fabio.route": "/foo", "http.status_code": "200"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got tags %v want %v", got, want)
+	}
+}
+
+func TestExportBatchSize(t *testing.T) {
+	c := newCollector()
+	defer c.Close()
+	tr := newTracer(t, "zipkin", c.URL)
+
+	for i := 0; i < 10; i++ {
+		tr.StartServer("GET", http.Header{}).Finish()
+	}
+	select {
+	case b := <-c.bodies:
+		if got, want := strings.Count(string(b), `"traceId"`), 10; got != want {
+			t.Fatalf("got %d spans want %d", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal triggers the upgrade.
+var upgradeSignal os.Signal = syscall.SIGUSR2
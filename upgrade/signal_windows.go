@@ -0,0 +1,6 @@
+package upgrade
+
+import "os"
+
+// upgradeSignal is nil since upgrades are not supported on Windows.
+var upgradeSignal os.Signal
@@ -0,0 +1,359 @@
+// Package upgrade implements zero-downtime upgrades of the binary.
+//
+// On SIGUSR2 the process starts a new instance of the binary with the
+// same arguments which inherits the listening sockets. The new process
+// uses the inherited sockets instead of binding the addresses again
+// and signals when it is ready. Then the old process stops accepting
+// connections, drains the open connections and exits. If the new
+// process does not become ready the old process continues to serve
+// requests.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabiolb/fabio/exit"
+)
+
+const (
+	// envListeners contains the comma separated addresses of the
+	// inherited listeners which are passed as file descriptors
+	// starting with 3.
+	envListeners = "FABIO_UPGRADE_LISTENERS"
+
+	// envReady contains the file descriptor of the pipe on which
+	// the new process signals that it is ready.
+	envReady = "FABIO_UPGRADE_READY"
+)
+
+// ReadyTimeout is the maximum time the old process waits for the new
+// process to become ready.
+var ReadyTimeout = time.Minute
+
+var (
+	// mu guards inherited, listeners and upgrading.
+	mu sync.Mutex
+
+	// inherited contains the listeners from the parent process
+	// by address which have not been used yet.
+	inherited map[string]fileListener
+
+	// listeners contains the listeners of this process which
+	// are passed to the new process.
+	listeners []listener
+
+	// upgrading is true while a new process is started.
+	upgrading bool
+
+	// ready is the pipe to the parent process.
+	ready *os.File
+
+	// completed is set to 1 when the new process is ready.
+	completed int32
+)
+
+type listener struct {
+	addr string
+	l    fileListener
+}
+
+// fileListener is a TCP or unix socket listener which can be passed
+// to another process.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+func init() {
+	if err := inherit(); err != nil {
+		log.Print("[ERROR] upgrade: Cannot use inherited listeners. ", err)
+	}
+}
+
+// inherit restores the listeners and the ready pipe from the
+// environment of a process which was started by an upgrade.
+func inherit() error {
+	v := os.Getenv(envListeners)
+	fd := os.Getenv(envReady)
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReady)
+
+	if fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", envReady, fd)
+		}
+		ready = os.NewFile(uintptr(n), "ready")
+	}
+	if v == "" {
+		return nil
+	}
+
+	inherited = map[string]fileListener{}
+	for i, addr := range strings.Split(v, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("listener for %s: %s", addr, err)
+		}
+		fl, ok := l.(fileListener)
+		if !ok {
+			l.Close()
+			return fmt.Errorf("listener for %s is not a TCP or unix listener", addr)
+		}
+		inherited[addr] = fl
+	}
+	return nil
+}
+
+// ListenTCP returns the listener for the address which was inherited
+// from the parent process or listens on the address. The listener is
+// passed to the new process on an upgrade.
+func ListenTCP(laddr string, addr *net.TCPAddr) (*net.TCPListener, error) {
+	l, err := listen(laddr, "tcp", func() (fileListener, error) {
+		return net.ListenTCP("tcp", addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// ListenUnix returns the listener for the unix socket which was
+// inherited from the parent process or listens on the socket. A stale
+// socket file from a previous process is removed before listening.
+// The listener is passed to the new process on an upgrade.
+func ListenUnix(laddr string, addr *net.UnixAddr) (*net.UnixListener, error) {
+	l, err := listen(laddr, "unix", func() (fileListener, error) {
+		if err := removeStaleSocket(addr.Name); err != nil {
+			return nil, err
+		}
+		return net.ListenUnix("unix", addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+
+	// the socket file of an inherited listener is not removed on
+	// close by default but this process owns it now.
+	ul.SetUnlinkOnClose(true)
+	return ul, nil
+}
+
+// listen returns the inherited listener for the address if it is for
+// the same network or creates a new listener.
+func listen(laddr, network string, create func() (fileListener, error)) (fileListener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	l := inherited[laddr]
+	if l != nil && l.Addr().Network() == network {
+		delete(inherited, laddr)
+		log.Printf("[INFO] upgrade: Using inherited listener for %s", laddr)
+	} else {
+		var err error
+		if l, err = create(); err != nil {
+			return nil, err
+		}
+	}
+	listeners = append(listeners, listener{laddr, l})
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at path unless another
+// process accepts connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// claimTimeout is the time the servers have to claim the inherited
+// listeners after Ready has been called.
+var claimTimeout = time.Second
+
+// Ready signals the parent process that this process serves requests
+// and closes the inherited listeners which have not been used. It does
+// nothing if the process was not started by an upgrade.
+func Ready() {
+	// the servers start in their own go routines and
+	// may not have claimed their listeners yet.
+	deadline := time.Now().Add(claimTimeout)
+	for unclaimed() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for addr, l := range inherited {
+		log.Printf("[INFO] upgrade: Closing unused listener for %s", addr)
+		l.Close()
+	}
+	inherited = nil
+
+	if ready == nil {
+		return
+	}
+	if _, err := ready.Write([]byte{1}); err != nil {
+		log.Print("[ERROR] upgrade: Cannot signal readiness. ", err)
+	}
+	ready.Close()
+	ready = nil
+}
+
+func unclaimed() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(inherited)
+}
+
+// keepSockets prevents that the socket files of the unix listeners are
+// removed when they are closed since the new process uses them.
+func keepSockets() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, x := range listeners {
+		if ul, ok := x.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// Completed returns true if a new process has taken over the listeners.
+func Completed() bool {
+	return atomic.LoadInt32(&completed) == 1
+}
+
+// Listen starts a new process on SIGUSR2 and exits the current process
+// via the exit package when the new process is ready.
+func Listen() {
+	if upgradeSignal == nil {
+		return
+	}
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, upgradeSignal)
+	go func() {
+		for range sigchan {
+			if err := Upgrade(); err != nil {
+				log.Print("[ERROR] upgrade: ", err)
+				continue
+			}
+			log.Print("[INFO] upgrade: Shutting down")
+			exit.Exit(0)
+			return
+		}
+	}()
+}
+
+// Upgrade starts a new instance of the binary with the listeners of
+// this process and waits until it is ready. The new process is killed
+// if it does not become ready within ReadyTimeout.
+func Upgrade() error {
+	mu.Lock()
+	if upgrading || Completed() {
+		mu.Unlock()
+		return errors.New("upgrade in progress")
+	}
+	upgrading = true
+	defer func() {
+		mu.Lock()
+		upgrading = false
+		mu.Unlock()
+	}()
+
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, x := range listeners {
+		f, err := x.l.File()
+		if err != nil {
+			mu.Unlock()
+			return fmt.Errorf("cannot get file for listener %s. %s", x.addr, err)
+		}
+		addrs = append(addrs, x.addr)
+		files = append(files, f)
+	}
+	mu.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(addrs, ","),
+		envReady+"="+strconv.Itoa(3+len(files)),
+	)
+	cmd.ExtraFiles = append(files, w)
+
+	log.Printf("[INFO] upgrade: Starting %s", exe)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	readyc := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		readyc <- err
+	}()
+
+	select {
+	case err := <-readyc:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("new process %d failed. %s", cmd.Process.Pid, err)
+		}
+		atomic.StoreInt32(&completed, 1)
+		keepSockets()
+		log.Printf("[INFO] upgrade: New process %d is ready", cmd.Process.Pid)
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("new process %d exited. %v", cmd.Process.Pid, err)
+	case <-time.After(ReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d not ready after %s", cmd.Process.Pid, ReadyTimeout)
+	}
+}
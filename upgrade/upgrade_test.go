@@ -0,0 +1,110 @@
+package upgrade
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const envChild = "FABIO_UPGRADE_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envChild) == "1" {
+		child()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// child runs in the new process. It serves a single connection on the
+// inherited listener.
+func child() {
+	l, err := ListenTCP("127.0.0.1:0", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		os.Exit(1)
+	}
+	Ready()
+	c, err := l.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	c.Write([]byte("child"))
+	c.Close()
+}
+
+func TestUpgrade(t *testing.T) {
+	l, err := ListenTCP("127.0.0.1:0", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	os.Setenv(envChild, "1")
+	defer os.Unsetenv(envChild)
+	ReadyTimeout = 10 * time.Second
+
+	if err := Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	if !Completed() {
+		t.Fatal("got not completed want completed")
+	}
+	if err := Upgrade(); err == nil {
+		t.Fatal("got nil want error for second upgrade")
+	}
+
+	// the new process serves connections on the same
+	// address after the old listener has been closed.
+	l.Close()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "child"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fabio.sock")
+
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("got %v want nil for missing socket", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("got nil want error for socket in use")
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("got %v want nil for stale socket", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("got %v want stale socket removed", err)
+	}
+
+	ioutil.WriteFile(path, nil, 0644)
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("got nil want error for regular file")
+	}
+}